@@ -0,0 +1,78 @@
+// Package bencode implements encoding and decoding of bencoded values, the
+// serialization format used by .torrent files, HTTP tracker responses and the
+// extension protocol.
+//
+// Values map onto Go types like this:
+//
+//	integer     int, int8...int64, uint...uint64, bool (0 or 1)
+//	byte string string, []byte, [N]byte (exactly N bytes long)
+//	list        slice or array
+//	dictionary  struct or map with string keys
+//
+// Struct fields are matched to dictionary keys by their `bencode:"key"` tag,
+// or by the field name when there is no tag. A tag of "-" skips the field,
+// and ",omitempty" leaves zero values out when encoding.
+//
+// Decoding into an interface{} produces int64, string, []interface{} and
+// map[string]interface{} values.
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RawValue holds the bencoded bytes of a single value. Decoding into a
+// RawValue copies the value's bytes without interpreting them, so it can be
+// decoded later once its type is known, or hashed as it appeared on the wire
+// (for example a torrent's info dictionary). Encoding a RawValue writes the
+// bytes unchanged.
+type RawValue []byte
+
+var rawValueType = reflect.TypeOf(RawValue(nil))
+
+type field struct {
+	key       string
+	index     int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// structFields returns the encodable fields of t, sorted by key as bencode
+// requires for dictionaries.
+func structFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		f := field{key: sf.Name, index: i}
+		if tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				f.key = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					f.omitEmpty = true
+				}
+			}
+		}
+		fields = append(fields, f)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+	fieldCache.Store(t, fields)
+	return fields
+}
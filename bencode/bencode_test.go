@@ -0,0 +1,236 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	Length int64
+	Path   []string
+}
+
+type testInfo struct {
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Name        string     `bencode:"name"`
+	Files       []testFile `bencode:"files,omitempty"`
+	Private     bool       `bencode:"private,omitempty"`
+}
+
+type testMetaInfo struct {
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Info         testInfo   `bencode:"info"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	values := []interface{}{
+		int64(0),
+		int64(-42),
+		int64(1) << 62,
+		"",
+		"spam",
+		[]interface{}{},
+		[]interface{}{"a", int64(1), []interface{}{"b"}},
+		map[string]interface{}{},
+		map[string]interface{}{"cow": "moo", "spam": []interface{}{"a", "b"}},
+	}
+	for _, v := range values {
+		b, err := Marshal(v)
+		if err != nil {
+			t.Errorf("Marshal(%#v) failed: %v", v, err)
+			continue
+		}
+		var got interface{}
+		if err = Unmarshal(b, &got); err != nil {
+			t.Errorf("Unmarshal(%q) failed: %v", b, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("Unmarshal(%q) = %#v, want %#v", b, got, v)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		in  interface{}
+		out string
+	}{
+		{42, "i42e"},
+		{uint8(7), "i7e"},
+		{true, "i1e"},
+		{"spam", "4:spam"},
+		{[]byte("eggs"), "4:eggs"},
+		{[3]byte{'a', 'b', 'c'}, "3:abc"},
+		{[]int{1, 2}, "li1ei2ee"},
+		{map[string]int{"b": 2, "a": 1}, "d1:ai1e1:bi2ee"},
+		{testFile{Length: 5, Path: []string{"a", "b"}}, "d6:Lengthi5e4:Pathl1:a1:bee"},
+		{testInfo{PieceLength: 1, Pieces: "x", Name: "n"}, "d4:name1:n12:piece lengthi1e6:pieces1:xe"},
+		{struct{ Raw RawValue }{RawValue("li1ee")}, "d3:Rawli1eee"},
+	}
+	for _, tt := range tests {
+		b, err := Marshal(tt.in)
+		if err != nil {
+			t.Errorf("Marshal(%#v) failed: %v", tt.in, err)
+			continue
+		}
+		if string(b) != tt.out {
+			t.Errorf("Marshal(%#v) = %q, want %q", tt.in, b, tt.out)
+		}
+	}
+}
+
+func TestDecodeStruct(t *testing.T) {
+	want := testMetaInfo{
+		Announce:     "http://tracker/announce",
+		AnnounceList: [][]string{{"http://tracker/announce"}, {"udp://backup:80"}},
+		Info: testInfo{
+			PieceLength: 262144,
+			Pieces:      strings.Repeat("\x01", 40),
+			Name:        "dir",
+			Files:       []testFile{{1, []string{"a"}}, {2, []string{"b", "c"}}},
+		},
+		CreatedBy: "Taipei-Torrent",
+	}
+	b, err := Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got testMetaInfo
+	if err = Decode(bytes.NewReader(b), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode = %#v, want %#v", got, want)
+	}
+}
+
+func TestDecodeSkipsUnknownKeys(t *testing.T) {
+	var f testFile
+	in := "d5:extrad1:xli1eee6:lengthi3e4:pathl1:aee"
+	if err := Unmarshal([]byte(in), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Length != 3 || !reflect.DeepEqual(f.Path, []string{"a"}) {
+		t.Errorf("Unmarshal(%q) = %#v", in, f)
+	}
+}
+
+func TestRawValue(t *testing.T) {
+	info := "d4:name1:n12:piece lengthi1e6:pieces1:xe"
+	in := "d8:announce1:u4:info" + info + "e"
+	var m struct {
+		Announce string   `bencode:"announce"`
+		Info     RawValue `bencode:"info"`
+	}
+	if err := Unmarshal([]byte(in), &m); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Info) != info {
+		t.Fatalf("Info = %q, want %q", m.Info, info)
+	}
+	if sha1.Sum(m.Info) != sha1.Sum([]byte(info)) {
+		t.Errorf("RawValue bytes differ from the input")
+	}
+	var decoded testInfo
+	if err := m.Info.Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name != "n" || decoded.PieceLength != 1 {
+		t.Errorf("RawValue.Decode = %#v", decoded)
+	}
+	out, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("Marshal = %q, want %q", out, in)
+	}
+}
+
+// oneByteReader hands out data a byte at a time, so Decode can't rely on
+// having the whole value in one Read.
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestDecodeStream(t *testing.T) {
+	in := "d4:listli1ei2ee3:str5:helloe"
+	var got map[string]interface{}
+	if err := Decode(oneByteReader{strings.NewReader(in)}, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"list": []interface{}{int64(1), int64(2)}, "str": "hello"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode = %#v, want %#v", got, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		in string
+		v  interface{}
+	}{
+		{"", new(interface{})},
+		{"i", new(int)},
+		{"ie", new(int)},
+		{"i-0e", new(int)},
+		{"i03e", new(int)},
+		{"i1x", new(int)},
+		{"i300e", new(uint8)},
+		{"5:abc", new(string)},
+		{"03:abc", new(string)},
+		{"l1:a", new([]string)},
+		{"d1:ai1e", new(map[string]int)},
+		{"x", new(interface{})},
+		{"3:abc", new(int)},
+		{"i1e", new(string)},
+		{"2:ab", new([3]byte)},
+		{"di1ei2ee", new(map[string]int)},
+	}
+	for _, tt := range tests {
+		if err := Unmarshal([]byte(tt.in), tt.v); err == nil {
+			t.Errorf("Unmarshal(%q) into %T succeeded, want error", tt.in, tt.v)
+		}
+	}
+}
+
+func TestDecodeDepth(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("l", depth) + strings.Repeat("e", depth)
+	}
+	var v interface{}
+	if err := Unmarshal([]byte(nested(MAX_DEPTH)), &v); err != nil {
+		t.Errorf("%d deep: %v", MAX_DEPTH, err)
+	}
+	// Too deep, whether decoded, or skipped as an unknown key.
+	deep := nested(MAX_DEPTH + 1)
+	if _, ok := Unmarshal([]byte(deep), &v).(*SyntaxError); !ok {
+		t.Errorf("decoded a value %d deep", MAX_DEPTH+1)
+	}
+	var s struct{ A int }
+	if _, ok := Unmarshal([]byte("d1:x"+deep+"e"), &s).(*SyntaxError); !ok {
+		t.Errorf("skipped a value %d deep", MAX_DEPTH+1)
+	}
+	var raw RawValue
+	if _, ok := Unmarshal([]byte(deep), &raw).(*SyntaxError); !ok {
+		t.Errorf("captured a value %d deep", MAX_DEPTH+1)
+	}
+	// The depth is per value, not cumulative.
+	var l []interface{}
+	if err := Unmarshal([]byte("l"+nested(MAX_DEPTH-1)+nested(MAX_DEPTH-1)+"e"), &l); err != nil || len(l) != 2 {
+		t.Errorf("siblings: %v", err)
+	}
+}
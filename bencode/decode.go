@@ -0,0 +1,490 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// MAX_STRING_LENGTH bounds the byte strings Decode will read, so a corrupt
+// length prefix can't make us allocate unbounded memory.
+const MAX_STRING_LENGTH = 64 * 1024 * 1024
+
+// MAX_DEPTH bounds how deeply lists and dictionaries may nest, so a few
+// bytes of "llll..." can't exhaust the stack.
+const MAX_DEPTH = 1000
+
+// A SyntaxError is returned when the input is not valid bencode.
+type SyntaxError struct {
+	Offset int64 // Number of bytes read before the error was found.
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: syntax error at offset %d: %s", e.Offset, e.Msg)
+}
+
+// An UnmarshalTypeError is returned when a bencoded value can't be stored in
+// the Go value it is being decoded into.
+type UnmarshalTypeError struct {
+	Value string // "integer", "string", "list" or "dictionary"
+	Type  reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return "bencode: cannot decode " + e.Value + " into Go value of type " + e.Type.String()
+}
+
+// Decode reads a single bencoded value from r and stores it in the value
+// pointed to by v.
+//
+// Values are decoded as they are read, so a large dictionary is never held in
+// memory twice. If r is not also an io.ByteScanner it is wrapped in a
+// bufio.Reader, which may read past the end of the value; pass a *bufio.Reader
+// to decode several values from one stream.
+func Decode(r io.Reader, v interface{}) (err error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("bencode: Decode needs a non-nil pointer")
+	}
+	br, ok := r.(byteScanReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &decoder{r: br}
+	return d.value(rv.Elem())
+}
+
+// Unmarshal decodes the bencoded value in data into v.
+func Unmarshal(data []byte, v interface{}) error {
+	return Decode(bytes.NewReader(data), v)
+}
+
+// Decode decodes the bencoded value held in r into v.
+func (r RawValue) Decode(v interface{}) error {
+	return Unmarshal(r, v)
+}
+
+type byteScanReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+type decoder struct {
+	r      byteScanReader
+	offset int64
+	// When non-nil, every byte read is also appended here. Used to capture
+	// RawValues.
+	raw *bytes.Buffer
+	// How many lists and dictionaries we are inside.
+	depth int
+}
+
+func (d *decoder) readByte() (c byte, err error) {
+	c, err = d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	d.offset++
+	if d.raw != nil {
+		d.raw.WriteByte(c)
+	}
+	return
+}
+
+// peek returns the next byte without consuming it.
+func (d *decoder) peek() (c byte, err error) {
+	c, err = d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF && d.offset > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	err = d.r.UnreadByte()
+	return
+}
+
+// enter is called after reading the byte that opens a list or dictionary,
+// and leave when it is done with it.
+func (d *decoder) enter() error {
+	d.depth++
+	if d.depth > MAX_DEPTH {
+		return d.syntaxError("nested more than %d deep", MAX_DEPTH)
+	}
+	return nil
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+func (d *decoder) syntaxError(format string, args ...interface{}) error {
+	return &SyntaxError{Offset: d.offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+// readUntil reads digits (and a leading '-') up to and including the
+// delimiter, returning them without it.
+func (d *decoder) readUntil(delim byte) (string, error) {
+	var sb strings.Builder
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if c == delim {
+			return sb.String(), nil
+		}
+		if !(c >= '0' && c <= '9') && !(c == '-' && sb.Len() == 0) {
+			return "", d.syntaxError("unexpected %q in number", c)
+		}
+		if sb.Len() > 20 {
+			return "", d.syntaxError("number too long")
+		}
+		sb.WriteByte(c)
+	}
+}
+
+func (d *decoder) readInt() (string, error) {
+	if _, err := d.readByte(); err != nil { // 'i'
+		return "", err
+	}
+	s, err := d.readUntil('e')
+	if err != nil {
+		return "", err
+	}
+	if s == "" || s == "-" || s == "-0" ||
+		(len(s) > 1 && s[0] == '0') || strings.HasPrefix(s, "-0") {
+		return "", d.syntaxError("invalid integer %q", s)
+	}
+	return s, nil
+}
+
+func (d *decoder) readString() ([]byte, error) {
+	s, err := d.readUntil(':')
+	if err != nil {
+		return nil, err
+	}
+	if s == "" || s[0] == '-' || (len(s) > 1 && s[0] == '0') {
+		return nil, d.syntaxError("invalid string length %q", s)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n > MAX_STRING_LENGTH {
+		return nil, d.syntaxError("string length %q out of range", s)
+	}
+	var buf bytes.Buffer
+	// CopyN grows the buffer as data arrives, rather than trusting n up front.
+	copied, err := io.CopyN(&buf, d.r, n)
+	d.offset += copied
+	if d.raw != nil {
+		d.raw.Write(buf.Bytes())
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// value decodes the next value into v.
+func (d *decoder) value(v reflect.Value) (err error) {
+	if v.Type() == rawValueType {
+		return d.rawValue(v)
+	}
+	// Allocate through pointers.
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+		if v.Type() == rawValueType {
+			return d.rawValue(v)
+		}
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		var x interface{}
+		if x, err = d.generic(); err != nil {
+			return
+		}
+		v.Set(reflect.ValueOf(x))
+		return
+	}
+
+	c, err := d.peek()
+	if err != nil {
+		return
+	}
+	switch {
+	case c == 'i':
+		return d.intValue(v)
+	case c >= '0' && c <= '9':
+		return d.stringValue(v)
+	case c == 'l':
+		return d.listValue(v)
+	case c == 'd':
+		return d.dictValue(v)
+	}
+	return d.syntaxError("unexpected %q at start of value", c)
+}
+
+func (d *decoder) rawValue(v reflect.Value) (err error) {
+	outer := d.raw
+	d.raw = new(bytes.Buffer)
+	err = d.skip()
+	captured := d.raw.Bytes()
+	d.raw = outer
+	if outer != nil {
+		outer.Write(captured)
+	}
+	if err != nil {
+		return
+	}
+	v.SetBytes(captured)
+	return
+}
+
+func (d *decoder) intValue(v reflect.Value) (err error) {
+	s, err := d.readInt()
+	if err != nil {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, perr := strconv.ParseInt(s, 10, 64)
+		if perr != nil || v.OverflowInt(n) {
+			return d.syntaxError("integer %s overflows %v", s, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, perr := strconv.ParseUint(s, 10, 64)
+		if perr != nil || v.OverflowUint(n) {
+			return d.syntaxError("integer %s overflows %v", s, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		v.SetBool(s != "0")
+	default:
+		return &UnmarshalTypeError{"integer", v.Type()}
+	}
+	return
+}
+
+func (d *decoder) stringValue(v reflect.Value) (err error) {
+	b, err := d.readString()
+	if err != nil {
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return &UnmarshalTypeError{"string", v.Type()}
+		}
+		v.SetBytes(b)
+	case reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 || v.Len() != len(b) {
+			return &UnmarshalTypeError{"string", v.Type()}
+		}
+		reflect.Copy(v, reflect.ValueOf(b))
+	default:
+		return &UnmarshalTypeError{"string", v.Type()}
+	}
+	return
+}
+
+// atEnd consumes the 'e' closing a list or dictionary, if it is next.
+func (d *decoder) atEnd() (end bool, err error) {
+	c, err := d.peek()
+	if err != nil {
+		return
+	}
+	if c == 'e' {
+		_, err = d.readByte()
+		end = true
+	}
+	return
+}
+
+func (d *decoder) listValue(v reflect.Value) (err error) {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+	default:
+		return &UnmarshalTypeError{"list", v.Type()}
+	}
+	if _, err = d.readByte(); err != nil { // 'l'
+		return
+	}
+	defer d.leave()
+	if err = d.enter(); err != nil {
+		return
+	}
+	i := 0
+	if v.Kind() == reflect.Slice {
+		v.SetLen(0)
+	}
+	for {
+		var end bool
+		if end, err = d.atEnd(); err != nil || end {
+			break
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		} else if i >= v.Len() {
+			return &UnmarshalTypeError{"list", v.Type()}
+		}
+		if err = d.value(v.Index(i)); err != nil {
+			return
+		}
+		i++
+	}
+	return
+}
+
+func (d *decoder) dictValue(v reflect.Value) (err error) {
+	var fields []field
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnmarshalTypeError{"dictionary", v.Type()}
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+		fields = structFields(v.Type())
+	default:
+		return &UnmarshalTypeError{"dictionary", v.Type()}
+	}
+	if _, err = d.readByte(); err != nil { // 'd'
+		return
+	}
+	defer d.leave()
+	if err = d.enter(); err != nil {
+		return
+	}
+	for {
+		var end bool
+		if end, err = d.atEnd(); err != nil || end {
+			return
+		}
+		var key []byte
+		if key, err = d.readString(); err != nil {
+			return
+		}
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err = d.value(elem); err != nil {
+				return
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			continue
+		}
+		f := findField(fields, string(key))
+		if f == nil {
+			// Unknown keys are allowed; skip their values.
+			if err = d.skip(); err != nil {
+				return
+			}
+			continue
+		}
+		if err = d.value(v.Field(f.index)); err != nil {
+			return
+		}
+	}
+}
+
+func findField(fields []field, key string) *field {
+	for i := range fields {
+		if fields[i].key == key {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].key, key) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// skip reads and discards the next value.
+func (d *decoder) skip() (err error) {
+	c, err := d.peek()
+	if err != nil {
+		return
+	}
+	switch {
+	case c == 'i':
+		_, err = d.readInt()
+	case c >= '0' && c <= '9':
+		_, err = d.readString()
+	case c == 'l' || c == 'd':
+		if _, err = d.readByte(); err != nil {
+			return
+		}
+		defer d.leave()
+		if err = d.enter(); err != nil {
+			return
+		}
+		for {
+			var end bool
+			if end, err = d.atEnd(); err != nil || end {
+				return
+			}
+			if c == 'd' {
+				if _, err = d.readString(); err != nil {
+					return
+				}
+			}
+			if err = d.skip(); err != nil {
+				return
+			}
+		}
+	default:
+		err = d.syntaxError("unexpected %q at start of value", c)
+	}
+	return
+}
+
+// generic decodes the next value into the natural Go type for it.
+func (d *decoder) generic() (x interface{}, err error) {
+	c, err := d.peek()
+	if err != nil {
+		return
+	}
+	switch {
+	case c == 'i':
+		var n int64
+		err = d.intValue(reflect.ValueOf(&n).Elem())
+		x = n
+	case c >= '0' && c <= '9':
+		var b []byte
+		b, err = d.readString()
+		x = string(b)
+	case c == 'l':
+		var l []interface{}
+		err = d.listValue(reflect.ValueOf(&l).Elem())
+		if l == nil {
+			l = []interface{}{}
+		}
+		x = l
+	case c == 'd':
+		m := map[string]interface{}{}
+		err = d.dictValue(reflect.ValueOf(&m).Elem())
+		x = m
+	default:
+		err = d.syntaxError("unexpected %q at start of value", c)
+	}
+	return
+}
@@ -0,0 +1,176 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Encode writes the bencoding of v to w.
+//
+// Map keys and struct fields are written in sorted order, as the format
+// requires. Nil pointers and interfaces can't be represented and are an
+// error, except in struct fields marked omitempty.
+func Encode(w io.Writer, v interface{}) (err error) {
+	bw := bufio.NewWriter(w)
+	e := &encoder{w: bw}
+	if err = e.value(reflect.ValueOf(v)); err != nil {
+		return
+	}
+	return bw.Flush()
+}
+
+// Marshal returns the bencoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := Encode(&b, v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+type encoder struct {
+	w       *bufio.Writer
+	scratch [64]byte
+}
+
+func (e *encoder) writeInt(n int64) {
+	e.w.WriteByte('i')
+	e.w.Write(strconv.AppendInt(e.scratch[:0], n, 10))
+	e.w.WriteByte('e')
+}
+
+func (e *encoder) writeUint(n uint64) {
+	e.w.WriteByte('i')
+	e.w.Write(strconv.AppendUint(e.scratch[:0], n, 10))
+	e.w.WriteByte('e')
+}
+
+func (e *encoder) writeString(s string) {
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(len(s)), 10))
+	e.w.WriteByte(':')
+	e.w.WriteString(s)
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(len(b)), 10))
+	e.w.WriteByte(':')
+	e.w.Write(b)
+}
+
+func (e *encoder) value(v reflect.Value) (err error) {
+	if !v.IsValid() {
+		return fmt.Errorf("bencode: cannot encode nil value")
+	}
+	if v.Type() == rawValueType {
+		if v.Len() == 0 {
+			return fmt.Errorf("bencode: cannot encode empty RawValue")
+		}
+		e.w.Write(v.Bytes())
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("bencode: cannot encode nil %v", v.Type())
+		}
+		return e.value(v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Bool:
+		if v.Bool() {
+			e.writeInt(1)
+		} else {
+			e.writeInt(0)
+		}
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeBytes(v.Bytes())
+			return
+		}
+		return e.list(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.writeBytes(b)
+			return
+		}
+		return e.list(v)
+	case reflect.Map:
+		return e.dictFromMap(v)
+	case reflect.Struct:
+		return e.dictFromStruct(v)
+	default:
+		return fmt.Errorf("bencode: cannot encode value of type %v", v.Type())
+	}
+	return
+}
+
+func (e *encoder) list(v reflect.Value) (err error) {
+	e.w.WriteByte('l')
+	for i := 0; i < v.Len(); i++ {
+		if err = e.value(v.Index(i)); err != nil {
+			return
+		}
+	}
+	e.w.WriteByte('e')
+	return
+}
+
+func (e *encoder) dictFromMap(v reflect.Value) (err error) {
+	if v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("bencode: map key type must be a string, not %v", v.Type().Key())
+	}
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	e.w.WriteByte('d')
+	for _, k := range keys {
+		e.writeString(k.String())
+		if err = e.value(v.MapIndex(k)); err != nil {
+			return
+		}
+	}
+	e.w.WriteByte('e')
+	return
+}
+
+func (e *encoder) dictFromStruct(v reflect.Value) (err error) {
+	e.w.WriteByte('d')
+	for _, f := range structFields(v.Type()) {
+		fv := v.Field(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		e.writeString(f.key)
+		if err = e.value(fv); err != nil {
+			return
+		}
+	}
+	e.w.WriteByte('e')
+	return
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -5,11 +5,13 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"net"
 	"os"
 	"os/signal"
 	"path"
 	"runtime/pprof"
 	"runtime/debug"
+	"syscall"
 	"time"
 
 	"github.com/jackpal/Taipei-Torrent/torrent"
@@ -23,22 +25,35 @@ var (
 	createTorrent = flag.String("createTorrent", "", "If not empty, creates a torrent file from the given root. Writes to stdout")
 	createTracker = flag.String("createTracker", "", "Creates a tracker serving the given torrent file on the given address. Example --createTracker=:8080 to serve on port 8080.")
 
+	bindIP              = flag.String("bindIP", "", "Address to bind to for peer connections and DHT. An IP address, an interface name, or an interface name followed by [N] to pick its Nth address, e.g. en0[1]. Empty means all interfaces.")
 	port                = flag.Int("port", 7777, "Port to listen on. 0 means pick random port. Note that 6881 is blacklisted by some trackers.")
 	fileDir             = flag.String("fileDir", ".", "path to directory where files are stored")
 	seedRatio           = flag.Float64("seedRatio", math.Inf(0), "Seed until ratio >= this value before quitting.")
 	useDeadlockDetector = flag.Bool("useDeadlockDetector", false, "Panic and print stack dumps when the program is stuck.")
 	useLPD              = flag.Bool("useLPD", false, "Use Local Peer Discovery")
-	useUPnP             = flag.Bool("useUPnP", false, "Use UPnP to open port in firewall.")
+	useUPnP             = flag.Bool("useUPnP", false, "Use UPnP to open port in firewall. With -useNATPMP too, whichever the gateway answers first is used.")
 	useNATPMP           = flag.Bool("useNATPMP", false, "Use NAT-PMP to open port in firewall.")
+	useUTP              = flag.Bool("useUTP", false, "Use uTP as well as TCP for peers. uTP yields bandwidth to other traffic. Can't be used with -useDHT, which needs the UDP side of the port.")
 	gateway             = flag.String("gateway", "", "IP Address of gateway.")
 	useDHT              = flag.Bool("useDHT", false, "Use DHT to get peers.")
+	dhtRouters          = flag.String("dhtRouters", "", "Comma separated list of DHT routers used for bootstrapping, e.g. router.bittorrent.com:6881,dht.transmissionbt.com:6881. Empty means use the DHT package defaults.")
+	dhtMaxNodes         = flag.Int("dhtMaxNodes", 0, "Maximum number of nodes kept in the DHT routing table. 0 means use the DHT package default.")
+	dhtMaxInfoHashPeers = flag.Int("dhtMaxInfoHashPeers", 0, "Maximum number of peers the DHT remembers per torrent. 0 means use the DHT package default.")
 	trackerlessMode     = flag.Bool("trackerlessMode", false, "Do not get peers from the tracker. Good for testing DHT mode.")
-	proxyAddress        = flag.String("proxyAddress", "", "Address of a SOCKS5 proxy to use.")
+	proxyAddress        = flag.String("proxyAddress", "", "Address of a SOCKS5 proxy to use for TCP connections: peers, HTTP trackers and torrent downloads. UDP trackers and local peer discovery are skipped with a proxy. DHT and uTP don't use it.")
+	proxyUsername       = flag.String("proxyUsername", "", "User name for the SOCKS5 proxy. Empty means no authentication.")
+	proxyPassword       = flag.String("proxyPassword", "", "Password for the SOCKS5 proxy.")
 	initialCheck        = flag.Bool("initialCheck", true, "Do an initial hash check on files when adding torrents.")
+	preallocate         = flag.Bool("preallocate", true, "Allocate disk space for a torrent's files before downloading. Avoids fragmentation, and fails early if the disk is too small.")
 	useSFTP             = flag.String("useSFTP", "", "SFTP connection string, to store torrents over SFTP. e.g. 'username:password@192.168.1.25:22/path/'")
 	useRamCache         = flag.Int("useRamCache", 0, "Size in MiB of cache in ram, to reduce traffic on torrent storage.")
 	useHdCache          = flag.Int("useHdCache", 0, "Size in MiB of cache in OS temp directory, to reduce traffic on torrent storage.")
+	writeBackCache      = flag.Int("writeBackCache", torrent.DEFAULT_PIECE_CACHE_SIZE, "Size in MiB of each torrent's write-back cache, which holds downloaded pieces in ram and writes them out in order. 0 disables it. Not used with -useRamCache or -useHdCache.")
 	execOnSeeding       = flag.String("execOnSeeding", "", "Command to execute when torrent has fully downloaded and has begun seeding.")
+	pieceSelection      = flag.String("pieceSelection", "rarest", "Which piece to download next: rarest (the piece the fewest peers have), sequential or random.")
+	downloadLimit       = flag.Int64("downloadLimit", 0, "Maximum download rate in KiB/s, across all torrents. 0 means unlimited.")
+	uploadLimit         = flag.Int64("uploadLimit", 0, "Maximum upload rate in KiB/s, across all torrents. 0 means unlimited.")
+	blocklist           = flag.String("blocklist", "", "File of IP ranges in P2P (PeerGuardian) format to never connect to, e.g. 'Some organization:1.2.3.0-1.2.3.255' per line. Reloaded on SIGHUP.")
 	quickResume         = flag.Bool("quickResume", false, "Save torrenting data to resume faster. '-initialCheck' should be set to false, to prevent hash check on resume.")
 	maxActive           = flag.Int("maxActive", 16, "How many torrents should be active at a time. Torrents added beyond this value are queued.")
 	memoryPerTorrent	= flag.Int("memoryPerTorrent", -1, "Maximum memory (in MiB) per torrent used for Active Pieces. 0 means minimum. -1 (default) means unlimited.")
@@ -49,22 +64,38 @@ func parseTorrentFlags() (flags *torrent.TorrentFlags, err error) {
 	if err != nil {
 		return
 	}
+	bindAddr, err := bindIPFromFlags()
+	if err != nil {
+		return
+	}
+	ipBlocklist, err := blocklistFromFlags()
+	if err != nil {
+		return
+	}
 	flags = &torrent.TorrentFlags{
 		Dial:                dialer,
+		BindIP:              bindAddr,
 		Port:                portFromFlags(),
 		FileDir:             *fileDir,
 		SeedRatio:           *seedRatio,
 		UseDeadlockDetector: *useDeadlockDetector,
 		UseLPD:              *useLPD,
 		UseDHT:              *useDHT,
+		DHTRouters:          *dhtRouters,
+		DHTMaxNodes:         *dhtMaxNodes,
+		DHTMaxInfoHashPeers: *dhtMaxInfoHashPeers,
 		UseUPnP:             *useUPnP,
 		UseNATPMP:           *useNATPMP,
+		UseUTP:              *useUTP,
 		TrackerlessMode:     *trackerlessMode,
 		// IP address of gateway
 		Gateway:            *gateway,
 		InitialCheck:       *initialCheck,
 		FileSystemProvider: fsproviderFromFlags(),
 		Cacher:             cacheproviderFromFlags(),
+		PieceSelection:     *pieceSelection,
+		RateLimiter:        rateLimiterFromFlags(),
+		Blocklist:          ipBlocklist,
 		ExecOnSeeding:      *execOnSeeding,
 		QuickResume:        *quickResume,
 		MaxActive:          *maxActive,
@@ -82,6 +113,58 @@ func portFromFlags() int {
 	return rr.Intn(48000) + 1025
 }
 
+func bindIPFromFlags() (net.IP, error) {
+	if *bindIP == "" {
+		return nil, nil
+	}
+	addr, err := resolveBindIPAddr(*bindIP)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+func rateLimiterFromFlags() *torrent.RateLimiter {
+	if *downloadLimit <= 0 && *uploadLimit <= 0 {
+		return nil
+	}
+	return torrent.NewRateLimiter(*downloadLimit*1024, *uploadLimit*1024)
+}
+
+func blocklistFromFlags() (b *torrent.Blocklist, err error) {
+	if *blocklist == "" {
+		return
+	}
+	f, err := os.Open(*blocklist)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if b, err = torrent.LoadBlocklist(f); err != nil {
+		return
+	}
+	log.Println("Blocking", b.Len(), "IP ranges from", *blocklist)
+	go reloadBlocklistOnHangup(b, *blocklist)
+	return
+}
+
+func reloadBlocklistOnHangup(b *torrent.Blocklist, name string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		f, err := os.Open(name)
+		if err == nil {
+			err = b.Reload(f)
+			f.Close()
+		}
+		if err != nil {
+			log.Println("Couldn't reload blocklist, keeping the old one:", err)
+			continue
+		}
+		log.Println("Reloaded blocklist:", b.Len(), "IP ranges")
+	}
+}
+
 func cacheproviderFromFlags() torrent.CacheProvider {
 	if (*useRamCache) > 0 && (*useHdCache) > 0 {
 		log.Panicln("Only one cache at a time, please.")
@@ -94,6 +177,10 @@ func cacheproviderFromFlags() torrent.CacheProvider {
 	if (*useHdCache) > 0 {
 		return torrent.NewHdCacheProvider(*useHdCache)
 	}
+
+	if (*writeBackCache) > 0 {
+		return torrent.NewPieceCacheProvider(*writeBackCache)
+	}
 	return nil
 }
 
@@ -101,12 +188,18 @@ func fsproviderFromFlags() torrent.FsProvider {
 	if len(*useSFTP) > 0 {
 		return torrent.NewSftpFsProvider(*useSFTP)
 	}
-	return torrent.OsFsProvider{}
+	return torrent.OsFsProvider{Preallocate: *preallocate}
 }
 
 func dialerFromFlags() (proxy.Dialer, error) {
 	if len(*proxyAddress) > 0 {
-		return proxy.SOCKS5("tcp", string(*proxyAddress), nil, &proxy.Direct)
+		if *useDHT {
+			log.Println("Warning: DHT traffic doesn't go through the proxy.")
+		}
+		if *useUTP {
+			log.Println("Warning: uTP peer connections don't go through the proxy.")
+		}
+		return torrent.NewSOCKS5Dialer(*proxyAddress, *proxyUsername, *proxyPassword)
 	}
 	return proxy.FromEnvironment(), nil
 }
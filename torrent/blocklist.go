@@ -0,0 +1,140 @@
+package torrent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IP blocklists in the P2P (PeerGuardian) text format, one range per line:
+//
+//	Some organization:1.2.3.0-1.2.3.255
+//
+// Blank lines and lines starting with # are skipped. Only IPv4 ranges can be
+// written in this format, so IPv6 addresses are never blocked.
+
+type Blocklist struct {
+	mu     sync.RWMutex
+	ranges []blockedRange // Sorted by start
+	// maxEnd[i] is the largest end of ranges[:i+1], so a lookup knows when
+	// to stop looking back through overlapping ranges.
+	maxEnd []uint32
+}
+
+type blockedRange struct {
+	start, end  uint32
+	description string
+}
+
+type byRangeStart []blockedRange
+
+func (a byRangeStart) Len() int           { return len(a) }
+func (a byRangeStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byRangeStart) Less(i, j int) bool { return a[i].start < a[j].start }
+
+// LoadBlocklist parses a blocklist.
+func LoadBlocklist(r io.Reader) (b *Blocklist, err error) {
+	b = &Blocklist{}
+	if err = b.Reload(r); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload replaces the blocklist's ranges with those read from r, while it
+// is in use. If r can't be parsed, the old ranges stay.
+func (b *Blocklist) Reload(r io.Reader) (err error) {
+	ranges, err := parseBlocklist(r)
+	if err != nil {
+		return
+	}
+	sort.Stable(byRangeStart(ranges))
+	maxEnd := make([]uint32, len(ranges))
+	for i, br := range ranges {
+		maxEnd[i] = br.end
+		if i > 0 && maxEnd[i-1] > br.end {
+			maxEnd[i] = maxEnd[i-1]
+		}
+	}
+	b.mu.Lock()
+	b.ranges, b.maxEnd = ranges, maxEnd
+	b.mu.Unlock()
+	return
+}
+
+func parseBlocklist(r io.Reader) (ranges []blockedRange, err error) {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Descriptions may contain colons; addresses don't.
+		colon := strings.LastIndex(line, ":")
+		dash := strings.LastIndex(line, "-")
+		if colon < 0 || dash < colon {
+			return nil, fmt.Errorf("Blocklist line %d: expected description:start-end, got %q", lineNum, line)
+		}
+		start, ok1 := parseIPv4(line[colon+1 : dash])
+		end, ok2 := parseIPv4(line[dash+1:])
+		if !ok1 || !ok2 || end < start {
+			return nil, fmt.Errorf("Blocklist line %d: bad range %q", lineNum, line[colon+1:])
+		}
+		ranges = append(ranges, blockedRange{start, end, line[:colon]})
+	}
+	err = scanner.Err()
+	return
+}
+
+func parseIPv4(s string) (ip uint32, ok bool) {
+	v4 := net.ParseIP(strings.TrimSpace(s)).To4()
+	if v4 == nil {
+		return
+	}
+	return binary.BigEndian.Uint32(v4), true
+}
+
+// IsBlocked reports whether ip is in one of the ranges, and if so, that
+// range's description. A nil Blocklist blocks nothing.
+func (b *Blocklist) IsBlocked(ip net.IP) (blocked bool, description string) {
+	if b == nil {
+		return
+	}
+	v4 := ip.To4()
+	if v4 == nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(v4)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	// The last range starting at or before ip, then back through any
+	// earlier ones that might still reach it.
+	i := sort.Search(len(b.ranges), func(i int) bool { return b.ranges[i].start > n }) - 1
+	for ; i >= 0 && b.maxEnd[i] >= n; i-- {
+		if b.ranges[i].end >= n {
+			return true, b.ranges[i].description
+		}
+	}
+	return
+}
+
+// Len returns the number of ranges.
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.ranges)
+}
+
+// isBlockedAddr is IsBlocked for a host:port address.
+func (b *Blocklist) isBlockedAddr(addr string) (blocked bool, description string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	return b.IsBlocked(net.ParseIP(host))
+}
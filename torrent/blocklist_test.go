@@ -0,0 +1,61 @@
+package torrent
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testBlocklist = `# A comment
+
+Bad: people:1.2.3.0-1.2.3.255
+Wide:10.0.0.0-10.255.255.255
+Narrow:10.1.0.0-10.1.0.10
+Single:192.168.0.5-192.168.0.5
+`
+
+func TestBlocklist(t *testing.T) {
+	b, err := LoadBlocklist(strings.NewReader(testBlocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip          string
+		description string // Empty if not blocked
+	}{
+		{"1.2.3.4", "Bad: people"},
+		{"1.2.4.0", ""},
+		{"10.1.0.5", "Narrow"},
+		// Past the narrow range, but still inside the wide one.
+		{"10.2.0.0", "Wide"},
+		{"192.168.0.5", "Single"},
+		{"192.168.0.6", ""},
+		{"0.0.0.0", ""},
+		{"::1", ""},
+	}
+	for _, test := range tests {
+		blocked, description := b.IsBlocked(net.ParseIP(test.ip))
+		if blocked != (test.description != "") || description != test.description {
+			t.Errorf("IsBlocked(%s) = %v, %q, want %q", test.ip, blocked, description, test.description)
+		}
+	}
+
+	// A bad reload keeps the old list.
+	if err = b.Reload(strings.NewReader("Bad:1.2.3.4-1.2.3.0\n")); err == nil {
+		t.Error("loaded a range that ends before it starts")
+	}
+	if blocked, _ := b.IsBlocked(net.ParseIP("1.2.3.4")); !blocked {
+		t.Error("failed reload dropped the old ranges")
+	}
+	if err = b.Reload(strings.NewReader("New:5.6.7.8-5.6.7.8\n")); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, _ := b.IsBlocked(net.ParseIP("1.2.3.4")); blocked || b.Len() != 1 {
+		t.Errorf("after reload: 1.2.3.4 blocked %v, %d ranges", blocked, b.Len())
+	}
+
+	var none *Blocklist
+	if blocked, _ := none.IsBlocked(net.ParseIP("1.2.3.4")); blocked {
+		t.Error("nil Blocklist blocks")
+	}
+}
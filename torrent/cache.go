@@ -109,6 +109,12 @@ func (r *RamCache) Close() error {
 	return r.underlying.Close()
 }
 
+// Writes go straight through to the underlying store, so its modification
+// time is ours.
+func (r *RamCache) ModTime() (time.Time, error) {
+	return modTime(r.underlying)
+}
+
 func (r *RamCache) ReadAt(p []byte, off int64) (retInt int, retErr error) {
 	boxI := off / r.pieceSize
 	boxOff := off % r.pieceSize
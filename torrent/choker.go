@@ -8,26 +8,31 @@ import (
 // BitTorrent choking policy.
 
 // The choking policy's view of a peer. For current policies we only care
-// about identity and download bandwidth.
+// about identity and bandwidth.
 type Choker interface {
 	DownloadBPS() float32 // bps
+	UploadBPS() float32   // bps
 }
 
 type ChokePolicy interface {
 	// Only pass in interested peers.
 	// mutate the chokers into a list where the first N are to be unchoked.
-	Choke(chokers []Choker) (unchokeCount int, err error)
+	// seeding is true once we have the whole torrent.
+	Choke(chokers []Choker, seeding bool) (unchokeCount int, err error)
 }
 
 // Our naive never-choke policy
 type NeverChokePolicy struct{}
 
-func (n *NeverChokePolicy) Choke(chokers []Choker) (unchokeCount int, err error) {
+func (n *NeverChokePolicy) Choke(chokers []Choker, seeding bool) (unchokeCount int, err error) {
 	return len(chokers), nil
 }
 
 // Our interpretation of the classic bittorrent choke policy.
 // Expects to be called once every 10 seconds.
+// While downloading we reward the peers that give us the most data. While
+// seeding there's nothing to get, so we favor the peers we can upload to
+// fastest, which spreads the data quickest.
 // See the section "Choking and optimistic unchoking" in
 // https://wiki.theory.org/BitTorrentSpecification
 type ClassicChokePolicy struct {
@@ -49,14 +54,32 @@ func (a ByDownloadBPS) Less(i, j int) bool {
 	return a[i].DownloadBPS() > a[j].DownloadBPS()
 }
 
-const HIGH_BANDWIDTH_SLOTS = 3
+type ByUploadBPS []Choker
+
+func (a ByUploadBPS) Len() int {
+	return len(a)
+}
+
+func (a ByUploadBPS) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a ByUploadBPS) Less(i, j int) bool {
+	return a[i].UploadBPS() > a[j].UploadBPS()
+}
+
+const HIGH_BANDWIDTH_SLOTS = 4
 const OPTIMISTIC_UNCHOKE_INDEX = HIGH_BANDWIDTH_SLOTS
 
 // How many cycles of this algorithm before we pick a new optimistic
 const OPTIMISTIC_UNCHOKE_COUNT = 3
 
-func (ccp *ClassicChokePolicy) Choke(chokers []Choker) (unchokeCount int, err error) {
-	sort.Sort(ByDownloadBPS(chokers))
+func (ccp *ClassicChokePolicy) Choke(chokers []Choker, seeding bool) (unchokeCount int, err error) {
+	if seeding {
+		sort.Sort(ByUploadBPS(chokers))
+	} else {
+		sort.Sort(ByDownloadBPS(chokers))
+	}
 
 	optimistIndex := ccp.findOptimist(chokers)
 	if optimistIndex >= 0 {
@@ -9,24 +9,29 @@ import (
 type testChoker struct {
 	name        string
 	downloadBPS float32
+	uploadBPS   float32
 }
 
 func (t *testChoker) DownloadBPS() float32 {
 	return t.downloadBPS
 }
 
+func (t *testChoker) UploadBPS() float32 {
+	return t.uploadBPS
+}
+
 func (t *testChoker) String() string {
-	return fmt.Sprintf("{%#v, %g}", t.name, t.downloadBPS)
+	return fmt.Sprintf("{%#v, %g, %g}", t.name, t.downloadBPS, t.uploadBPS)
 }
 
 var chokersSets [][]*testChoker = [][]*testChoker{
 	[]*testChoker{},
-	[]*testChoker{{"a", 0}},
-	[]*testChoker{{"a", 0}, {"b", 1}},
-	[]*testChoker{{"a", 0}, {"b", 1}, {"c", 2}},
-	[]*testChoker{{"a", 0}, {"b", 1}, {"c", 2}, {"d", 3}},
-	[]*testChoker{{"a", 0}, {"b", 1}, {"c", 2}, {"d", 3},
-		{"e", 4}, {"f", 5}, {"g", 6}},
+	[]*testChoker{{"a", 0, 6}},
+	[]*testChoker{{"a", 0, 6}, {"b", 1, 5}},
+	[]*testChoker{{"a", 0, 6}, {"b", 1, 5}, {"c", 2, 4}},
+	[]*testChoker{{"a", 0, 6}, {"b", 1, 5}, {"c", 2, 4}, {"d", 3, 3}},
+	[]*testChoker{{"a", 0, 6}, {"b", 1, 5}, {"c", 2, 4}, {"d", 3, 3},
+		{"e", 4, 2}, {"f", 5, 1}, {"g", 6, 0}},
 }
 
 func toChokerSlice(chokers []*testChoker) (result []Choker) {
@@ -42,7 +47,7 @@ func TestNeverChokePolicy(t *testing.T) {
 		policy := NeverChokePolicy{}
 		candidates := toChokerSlice(chokers)
 		candidatesCopy := append([]Choker{}, candidates...)
-		unchokeCount, err := policy.Choke(candidates)
+		unchokeCount, err := policy.Choke(candidates, false)
 		if err != nil || unchokeCount != len(candidates) ||
 			!similar(candidates, candidatesCopy) {
 			t.Errorf("NeverChokePolicy.Choke(%v) => %v, %d, %v",
@@ -77,7 +82,7 @@ func TestClassicChokePolicy(t *testing.T) {
 		policy := ClassicChokePolicy{}
 		candidates := toChokerSlice(chokers)
 		candidatesCopy := append([]Choker{}, candidates...)
-		unchokeCount, err := policy.Choke(candidates)
+		unchokeCount, err := policy.Choke(candidates, false)
 		expectedUnchokeCount := len(candidates)
 		maxUnchokeCount := OPTIMISTIC_UNCHOKE_INDEX + 1
 		if expectedUnchokeCount > maxUnchokeCount {
@@ -85,17 +90,28 @@ func TestClassicChokePolicy(t *testing.T) {
 		}
 		if err != nil || unchokeCount != expectedUnchokeCount ||
 			!similar(candidates, candidatesCopy) ||
-			!verifyClassicSortOrder(candidates, HIGH_BANDWIDTH_SLOTS) {
+			!verifyClassicSortOrder(candidates, HIGH_BANDWIDTH_SLOTS, Choker.DownloadBPS) {
 			t.Errorf("ClassicChokePolicy.Choke(%v) => %v, %d, %v",
 				candidatesCopy, candidates, unchokeCount, err)
 		}
 	}
 }
 
-func verifyClassicSortOrder(a []Choker, highBandwidthSlotCount int) bool {
+func TestClassicChokePolicySeeding(t *testing.T) {
+	policy := ClassicChokePolicy{}
+	candidates := toChokerSlice(chokersSets[len(chokersSets)-1])
+	unchokeCount, err := policy.Choke(candidates, true)
+	if err != nil || unchokeCount != OPTIMISTIC_UNCHOKE_INDEX+1 ||
+		!verifyClassicSortOrder(candidates, HIGH_BANDWIDTH_SLOTS, Choker.UploadBPS) {
+		t.Errorf("ClassicChokePolicy.Choke(seeding) => %v, %d, %v",
+			candidates, unchokeCount, err)
+	}
+}
+
+func verifyClassicSortOrder(a []Choker, highBandwidthSlotCount int, rate func(Choker) float32) bool {
 	var lowestHighBandwidthSlotBps float32 = float32(math.Inf(0))
 	for i, aa := range a {
-		bps := aa.DownloadBPS()
+		bps := rate(aa)
 		if i < highBandwidthSlotCount {
 			if bps < lowestHighBandwidthSlotBps {
 				lowestHighBandwidthSlotBps = bps
@@ -0,0 +1,176 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackpal/Taipei-Torrent/bencode"
+)
+
+// Extension Protocol, BEP 10.
+
+const VERSION = "dev"
+
+// How long Negotiate waits for the peer's extension handshake.
+const EXTENSION_HANDSHAKE_TIMEOUT = 30 * time.Second
+
+// An ExtensionHandler handles the payload of an extension message, after the
+// extended message ID.
+type ExtensionHandler func(msg []byte, p *peerState)
+
+type extension struct {
+	name    string
+	handler ExtensionHandler
+}
+
+// ExtensionProtocol holds the extensions we support, and the IDs we want
+// peers to use for them.
+type ExtensionProtocol struct {
+	// Sent as "p" in the handshake, so peers that connected to us know which
+	// port to give out in PEX.
+	ListenPort uint16
+	// Sent as "metadata_size" in the handshake when non-zero (BEP 9).
+	MetadataSize int
+
+	byID   map[uint8]extension
+	byName map[string]uint8
+}
+
+func NewExtensionProtocol(listenPort uint16) *ExtensionProtocol {
+	return &ExtensionProtocol{
+		ListenPort: listenPort,
+		byID:       make(map[uint8]extension),
+		byName:     make(map[string]uint8),
+	}
+}
+
+// RegisterExtension tells peers that we support the named extension, and that
+// they should send its messages with the given ID. ID 0 is the handshake
+// itself, so it can't be used.
+func (e *ExtensionProtocol) RegisterExtension(name string, id uint8, handler ExtensionHandler) {
+	if id == EXTENSION_HANDSHAKE {
+		panic("torrent: extension ID 0 is reserved for the handshake")
+	}
+	if other, ok := e.byID[id]; ok {
+		panic(fmt.Sprintf("torrent: extension ID %d used by both %s and %s", id, other.name, name))
+	}
+	if _, ok := e.byName[name]; ok {
+		panic("torrent: extension " + name + " registered twice")
+	}
+	e.byID[id] = extension{name, handler}
+	e.byName[name] = id
+}
+
+// Lookup returns the extension registered with ID id.
+func (e *ExtensionProtocol) Lookup(id uint8) (name string, handler ExtensionHandler, ok bool) {
+	ext, ok := e.byID[id]
+	return ext.name, ext.handler, ok
+}
+
+// handshakeMessage is the extension handshake, starting with the EXTENSION
+// message ID.
+func (e *ExtensionProtocol) handshakeMessage() []byte {
+	m := make(map[string]int, len(e.byName))
+	for name, id := range e.byName {
+		m[name] = int(id)
+	}
+	handshake := map[string]interface{}{
+		"m": m,
+		"v": "Taipei-Torrent/" + VERSION,
+	}
+	if e.ListenPort != 0 {
+		handshake["p"] = int(e.ListenPort)
+	}
+	if e.MetadataSize > 0 {
+		handshake["metadata_size"] = e.MetadataSize
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(EXTENSION)
+	buf.WriteByte(EXTENSION_HANDSHAKE)
+	// Marshaling maps of strings and ints can't fail.
+	bencode.Encode(&buf, handshake)
+	return buf.Bytes()
+}
+
+// agreed picks the extensions from a peer's "m" dictionary that we support
+// too. The IDs are the ones we must use when sending to that peer. An ID of 0
+// means the peer has disabled that extension.
+func (e *ExtensionProtocol) agreed(theirs map[string]int) map[string]uint8 {
+	agreed := make(map[string]uint8)
+	for name, id := range theirs {
+		if _, ok := e.byName[name]; ok && id > 0 && id <= 255 {
+			agreed[name] = uint8(id)
+		}
+	}
+	return agreed
+}
+
+// Negotiate performs the extension handshake on conn, which must already
+// have completed the BitTorrent handshake with the extension bit set. Other
+// messages that arrive before the peer's handshake are discarded. It returns
+// the extensions both sides support, with the IDs the peer wants us to use.
+func (e *ExtensionProtocol) Negotiate(conn net.Conn) (agreed map[string]uint8, err error) {
+	conn.SetDeadline(time.Now().Add(EXTENSION_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+	_, agreed, err = e.negotiate(conn)
+	return
+}
+
+// negotiate is Negotiate without the deadline, also returning the peer's
+// whole handshake.
+func (e *ExtensionProtocol) negotiate(conn net.Conn) (h *ExtensionHandshake, agreed map[string]uint8, err error) {
+	err = writeMessage(conn, e.handshakeMessage())
+	if err != nil {
+		return
+	}
+	for {
+		var msg []byte
+		msg, err = readMessage(conn)
+		if err != nil {
+			return
+		}
+		if len(msg) < 2 || msg[0] != EXTENSION || msg[1] != EXTENSION_HANDSHAKE {
+			continue
+		}
+		h = new(ExtensionHandshake)
+		err = bencode.Unmarshal(msg[2:], h)
+		if err != nil {
+			return
+		}
+		agreed = e.agreed(h.M)
+		if len(agreed) == 0 {
+			err = errors.New("no extensions in common")
+		}
+		return
+	}
+}
+
+// writeMessage and readMessage send and receive one length-prefixed peer
+// message, for code that talks to a peer outside of peerReader and
+// peerWriter.
+func writeMessage(conn net.Conn, msg []byte) (err error) {
+	err = writeNBOUint32(conn, uint32(len(msg)))
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(msg)
+	return
+}
+
+func readMessage(conn net.Conn) (msg []byte, err error) {
+	n, err := readNBOUint32(conn)
+	if err != nil {
+		return
+	}
+	if n > 130*1024 {
+		return nil, fmt.Errorf("message size too large: %d", n)
+	}
+	msg = make([]byte, n)
+	_, err = io.ReadFull(conn, msg)
+	return
+}
@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/jackpal/Taipei-Torrent/bencode"
+)
+
+func testExtensionProtocol() *ExtensionProtocol {
+	e := NewExtensionProtocol(6881)
+	e.RegisterExtension("ut_metadata", 1, nil)
+	e.RegisterExtension("ut_pex", 2, nil)
+	return e
+}
+
+func TestExtensionHandshakeMessage(t *testing.T) {
+	e := testExtensionProtocol()
+	msg := e.handshakeMessage()
+	if msg[0] != EXTENSION || msg[1] != EXTENSION_HANDSHAKE {
+		t.Fatalf("message starts with %v", msg[:2])
+	}
+	var h ExtensionHandshake
+	if err := bencode.Unmarshal(msg[2:], &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.P != 6881 || h.V != "Taipei-Torrent/"+VERSION {
+		t.Errorf("p = %v, v = %q", h.P, h.V)
+	}
+	if want := map[string]int{"ut_metadata": 1, "ut_pex": 2}; !reflect.DeepEqual(h.M, want) {
+		t.Errorf("m = %v, want %v", h.M, want)
+	}
+}
+
+func TestExtensionNegotiate(t *testing.T) {
+	e := testExtensionProtocol()
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	go func() {
+		defer theirs.Close()
+		// Read our handshake.
+		n, err := readNBOUint32(theirs)
+		if err != nil {
+			return
+		}
+		io.CopyN(ioutil.Discard, theirs, int64(n))
+		// A bitfield first, which Negotiate should skip.
+		writeNBOUint32(theirs, 2)
+		theirs.Write([]byte{BITFIELD, 0xff})
+		var buf bytes.Buffer
+		buf.Write([]byte{EXTENSION, EXTENSION_HANDSHAKE})
+		bencode.Encode(&buf, map[string]interface{}{
+			"m": map[string]int{"ut_metadata": 3, "ut_pex": 0, "lt_donthave": 7},
+		})
+		writeNBOUint32(theirs, uint32(buf.Len()))
+		theirs.Write(buf.Bytes())
+	}()
+	agreed, err := e.Negotiate(ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]uint8{"ut_metadata": 3}; !reflect.DeepEqual(agreed, want) {
+		t.Errorf("agreed = %v, want %v", agreed, want)
+	}
+}
+
+func TestRegisterExtensionTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering ID 1 twice didn't panic")
+		}
+	}()
+	e := testExtensionProtocol()
+	e.RegisterExtension("lt_donthave", 1, nil)
+}
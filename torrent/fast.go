@@ -0,0 +1,185 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// Fast Extension, BEP 6.
+
+// How many pieces we let each peer download from us while it is choked.
+const ALLOWED_FAST_SET_SIZE = 10
+
+// How many ALLOWED_FAST messages we keep from a peer before we have the
+// metadata to check them.
+const MAX_QUEUED_ALLOWED_FAST = 64
+
+// sendHaves tells a new peer which pieces we have. With the Fast Extension,
+// a seed or an empty peer can say so in one byte instead of a bitfield.
+func (ts *TorrentSession) sendHaves(p *peerState) {
+	switch {
+	case p.fast && ts.totalPieces > 0 && ts.goodPieces == ts.totalPieces:
+		p.sendOneCharMessage(HAVE_ALL)
+	case p.fast && ts.goodPieces == 0:
+		p.sendOneCharMessage(HAVE_NONE)
+	default:
+		p.SendBitfield(ts.pieceSet)
+	}
+	if p.fast {
+		ts.sendAllowedFast(p)
+	}
+}
+
+// sendAllowedFast offers p the pieces of its allowed fast set that we have,
+// so it can start downloading before we unchoke it.
+func (ts *TorrentSession) sendAllowedFast(p *peerState) {
+	host, _, err := net.SplitHostPort(p.address)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil {
+		// BEP 6 only defines the set for IPv4 addresses.
+		return
+	}
+	p.ourAllowedFast = make(map[uint32]bool)
+	for _, piece := range allowedFastSet(ip, ts.M.InfoHash, ts.totalPieces, ALLOWED_FAST_SET_SIZE) {
+		if !ts.pieceSet.IsSet(int(piece)) {
+			continue
+		}
+		p.ourAllowedFast[piece] = true
+		msg := make([]byte, 5)
+		msg[0] = ALLOWED_FAST
+		uint32ToBytes(msg[1:5], piece)
+		p.sendMessage(msg)
+	}
+}
+
+// allowedFastSet is the canonical allowed fast set from BEP 6, so that a peer
+// gets the same pieces however often it reconnects.
+func allowedFastSet(ip net.IP, infoHash string, numPieces, k int) (set []uint32) {
+	if numPieces <= 0 {
+		return
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	x := make([]byte, 0, sha1.Size+len(infoHash))
+	x = append(x, ip.To4().Mask(net.CIDRMask(24, 32))...)
+	x = append(x, infoHash...)
+	have := make(map[uint32]bool, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces)
+			if !have[index] {
+				have[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return
+}
+
+func (p *peerState) sendRejectRequest(index, begin, length uint32) {
+	msg := make([]byte, 13)
+	msg[0] = REJECT_REQUEST
+	uint32ToBytes(msg[1:5], index)
+	uint32ToBytes(msg[5:9], begin)
+	uint32ToBytes(msg[9:13], length)
+	p.sendMessage(msg)
+}
+
+// doRejectRequest forgets a request p won't serve, so the block can be asked
+// for again.
+func (ts *TorrentSession) doRejectRequest(p *peerState, index, begin uint32) (err error) {
+	requestIndex := (uint64(index) << 32) | uint64(begin)
+	if _, ok := p.our_requests[requestIndex]; !ok {
+		return errors.New("reject for a block we didn't request")
+	}
+	delete(p.our_requests, requestIndex)
+	ts.removeRequest(int(index), int(begin/STANDARD_BLOCK_LENGTH))
+	return
+}
+
+// requestAllowedFast asks a peer that is choking us for blocks of the pieces
+// it has allowed us to get anyway.
+func (ts *TorrentSession) requestAllowedFast(p *peerState) (err error) {
+	if !ts.Session.HaveTorrent || len(p.our_requests) >= p.maxRequests() {
+		return
+	}
+	for piece := range p.theirAllowedFast {
+		if ts.pieceSet.IsSet(piece) || !p.have.IsSet(piece) {
+			continue
+		}
+		if _, ok := ts.activePieces[piece]; !ok {
+			if len(ts.activePieces) >= ts.maxActivePieces {
+				continue
+			}
+			pieceLength := ts.pieceLength(piece)
+			pieceCount := (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
+			ts.activePieces[piece] = &ActivePiece{make([]int, pieceCount), make([]byte, pieceLength), make(map[string]bool)}
+		}
+		err = ts.RequestBlock2(p, piece, false)
+		if err != io.EOF {
+			return
+		}
+	}
+	return nil
+}
+
+// queueFastMessage keeps a HAVE_ALL, HAVE_NONE or ALLOWED_FAST message that
+// came before the metadata, for applyQueuedFast.
+func (p *peerState) queueFastMessage(message []byte) (err error) {
+	if !p.fast {
+		return errors.New("Fast Extension message from a peer without it")
+	}
+	switch message[0] {
+	case HAVE_ALL, HAVE_NONE:
+		if len(message) != 1 {
+			return errors.New("Unexpected length")
+		}
+		if !p.can_receive_bitfield {
+			return errors.New("Late have all/none message")
+		}
+		p.can_receive_bitfield = false
+		p.queuedHaveAll = message[0] == HAVE_ALL
+	case ALLOWED_FAST:
+		if len(message) != 5 {
+			return errors.New("Unexpected length")
+		}
+		if len(p.queuedAllowedFast) < MAX_QUEUED_ALLOWED_FAST {
+			p.queuedAllowedFast = append(p.queuedAllowedFast, bytesToUint32(message[1:]))
+		}
+	}
+	return
+}
+
+// applyQueuedFast applies the messages queueFastMessage kept, now that we
+// have the metadata.
+func (ts *TorrentSession) applyQueuedFast(p *peerState) (err error) {
+	if p.queuedHaveAll {
+		for i := 0; i < ts.totalPieces; i++ {
+			p.have.Set(i)
+		}
+		ts.pieceSelector.AddPeerPieces(p.have)
+		p.queuedHaveAll = false
+		ts.checkInteresting(p)
+	}
+	for _, n := range p.queuedAllowedFast {
+		// Unlike after the metadata, a bad index is only dropped: the peer
+		// couldn't know we didn't have the piece count yet.
+		if n < uint32(ts.totalPieces) {
+			p.theirAllowedFast[int(n)] = true
+		}
+	}
+	p.queuedAllowedFast = nil
+	if p.peer_choking && len(p.theirAllowedFast) > 0 {
+		err = ts.requestAllowedFast(p)
+	}
+	return
+}
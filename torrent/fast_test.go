@@ -0,0 +1,84 @@
+package torrent
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// The example from BEP 6.
+	ip := net.ParseIP("80.4.4.200")
+	infoHash := strings.Repeat("\xaa", 20)
+	want := []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+	if got := allowedFastSet(ip, infoHash, 1313, 7); !reflect.DeepEqual(got, want[:7]) {
+		t.Errorf("k=7: got %v, want %v", got, want[:7])
+	}
+	if got := allowedFastSet(ip, infoHash, 1313, 9); !reflect.DeepEqual(got, want) {
+		t.Errorf("k=9: got %v, want %v", got, want)
+	}
+	// Can't pick more pieces than there are.
+	if got := allowedFastSet(ip, infoHash, 3, 10); len(got) != 3 {
+		t.Errorf("3 pieces: got %v", got)
+	}
+}
+
+func TestHaveAll(t *testing.T) {
+	ts := &TorrentSession{
+		M:             &MetaInfo{},
+		Session:       SessionInfo{HaveTorrent: true},
+		totalPieces:   8,
+		pieceSet:      NewBitset(8),
+		pieceSelector: NewRarestFirst(8),
+	}
+	p := NewPeerState(nil)
+	p.have = NewBitset(8)
+	p.can_receive_bitfield = true
+	if err := ts.generalMessage([]byte{HAVE_ALL}, p); err == nil {
+		t.Error("HAVE_ALL accepted from a peer without the Fast Extension")
+	}
+
+	p.fast = true
+	if err := ts.generalMessage([]byte{HAVE_ALL}, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.have.FindNextClear(0) != -1 || !p.am_interested {
+		t.Errorf("after HAVE_ALL: have %x, interested %v", p.have.Bytes(), p.am_interested)
+	}
+	if err := ts.generalMessage([]byte{HAVE_NONE}, p); err == nil {
+		t.Error("HAVE_NONE accepted after HAVE_ALL")
+	}
+}
+
+func TestFastBeforeMetadata(t *testing.T) {
+	ts := &TorrentSession{M: &MetaInfo{}, Session: SessionInfo{FromMagnet: true}}
+	p := NewPeerState(nil)
+	p.have = NewBitset(0)
+	p.fast = true
+	for _, message := range [][]byte{{HAVE_ALL}, {ALLOWED_FAST, 0, 0, 0, 3}, {ALLOWED_FAST, 0, 0, 0, 99}} {
+		if err := ts.DoMessage(p, message); err != nil {
+			t.Fatalf("message %d: %v", message[0], err)
+		}
+	}
+	if err := ts.DoMessage(p, []byte{HAVE_NONE}); err == nil {
+		t.Error("HAVE_NONE accepted after HAVE_ALL")
+	}
+
+	// The metadata arrives.
+	ts.Session.HaveTorrent = true
+	ts.totalPieces = 8
+	ts.pieceSet = NewBitset(8)
+	ts.pieceSelector = NewRarestFirst(8)
+	ts.activePieces = make(map[int]*ActivePiece)
+	p.have = NewBitset(8)
+	if err := ts.applyQueuedFast(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.have.FindNextClear(0) != -1 || !p.am_interested {
+		t.Errorf("have %x, interested %v", p.have.Bytes(), p.am_interested)
+	}
+	if len(p.theirAllowedFast) != 1 || !p.theirAllowedFast[3] {
+		t.Errorf("allowed fast %v", p.theirAllowedFast)
+	}
+}
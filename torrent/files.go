@@ -2,7 +2,12 @@ package torrent
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 )
 
 // Interface for a file.
@@ -59,7 +64,10 @@ func NewFileStore(info *InfoDict, fileSystem FileSystem) (f FileStore, totalSize
 	for i, _ := range info.Files {
 		src := &info.Files[i]
 		var file File
-		file, err = fs.fileSystem.Open(src.Path, src.Length)
+		_, err = SanitizeTorrentPath(src.Path)
+		if err == nil {
+			file, err = fs.fileSystem.Open(src.Path, src.Length)
+		}
 		if err != nil {
 			// Close all files opened up to now.
 			for i2 := 0; i2 < i; i2++ {
@@ -76,6 +84,48 @@ func NewFileStore(info *InfoDict, fileSystem FileSystem) (f FileStore, totalSize
 	return
 }
 
+// PathTraversalError is returned for a file path in a torrent that could
+// write outside the torrent's directory, or that the OS can't store.
+type PathTraversalError struct {
+	Path []string
+}
+
+func (e *PathTraversalError) Error() string {
+	return fmt.Sprintf("unsafe file path in torrent: %q", e.Path)
+}
+
+// Names Windows reserves for devices, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeTorrentPath checks the path components of a file in a torrent, and
+// joins them into a relative path. Components can't be empty, "." or "..",
+// or contain path separators or null bytes, so the path can't be absolute or
+// climb out of the torrent's directory. On Windows reserved device names and
+// drive letters are rejected too.
+func SanitizeTorrentPath(components []string) (p string, err error) {
+	if len(components) == 0 {
+		return "", &PathTraversalError{components}
+	}
+	for _, c := range components {
+		if c == "" || c == "." || c == ".." || strings.ContainsAny(c, "/\\\x00") {
+			return "", &PathTraversalError{components}
+		}
+		if runtime.GOOS == "windows" {
+			base := strings.ToUpper(strings.SplitN(c, ".", 2)[0])
+			if windowsReservedNames[base] || strings.ContainsRune(c, ':') {
+				return "", &PathTraversalError{components}
+			}
+		}
+	}
+	return filepath.Join(components...), nil
+}
+
 func (f *fileStore) find(offset int64) int {
 	// Binary search
 	offsets := f.offsets
@@ -170,3 +220,18 @@ func (f *fileStore) Close() (err error) {
 	}
 	return
 }
+
+// ModTime is the newest modification time of the store's files.
+func (f *fileStore) ModTime() (t time.Time, err error) {
+	for _, entry := range f.files {
+		var ft time.Time
+		ft, err = modTime(entry.file)
+		if err != nil {
+			return
+		}
+		if ft.After(t) {
+			t = ft
+		}
+	}
+	return
+}
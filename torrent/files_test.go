@@ -4,6 +4,8 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -55,3 +57,37 @@ func TestFileStoreRead(t *testing.T) {
 		}
 	}
 }
+
+func TestSanitizeTorrentPath(t *testing.T) {
+	for _, ok := range [][]string{{"a"}, {"dir", "sub", "file.txt"}, {".hidden"}, {"a..b"}} {
+		if p, err := SanitizeTorrentPath(ok); err != nil || p != filepath.Join(ok...) {
+			t.Errorf("SanitizeTorrentPath(%q) = %q, %v", ok, p, err)
+		}
+	}
+	for _, bad := range [][]string{nil, {""}, {".."}, {"a", "..", ".."}, {"."},
+		{"/etc/passwd"}, {"a/../../b"}, {"a\\..\\b"}, {"nul\x00byte"}} {
+		_, err := SanitizeTorrentPath(bad)
+		if _, ok := err.(*PathTraversalError); !ok {
+			t.Errorf("SanitizeTorrentPath(%q) = %v, want a PathTraversalError", bad, err)
+		}
+	}
+}
+
+func TestNewFileStoreRejectsTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, _ := OsFsProvider{}.NewFS(filepath.Join(dir, "torrent"))
+	info := &InfoDict{PieceLength: 512, Files: []FileDict{
+		{Length: 10, Path: []string{"ok"}},
+		{Length: 10, Path: []string{"..", "escaped"}},
+	}}
+	if _, _, err = NewFileStore(info, fs); err == nil {
+		t.Fatal("NewFileStore accepted a path outside the torrent")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("file outside the torrent directory was created: %v", err)
+	}
+}
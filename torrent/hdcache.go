@@ -107,6 +107,12 @@ func (r *HdCache) empty() {
 	}
 }
 
+// Writes go straight through to the underlying store, so its modification
+// time is ours.
+func (r *HdCache) ModTime() (time.Time, error) {
+	return modTime(r.underlying)
+}
+
 func (r *HdCache) ReadAt(p []byte, off int64) (retInt int, retErr error) {
 	boxI := int(off / r.pieceSize)
 	boxOff := off % r.pieceSize
@@ -2,10 +2,11 @@ package torrent
 
 import (
 	"fmt"
-	"github.com/jackpal/gateway"
 	"log"
 	"net"
 	"strconv"
+
+	"golang.org/x/net/proxy"
 )
 
 // btConn wraps an incoming network connection and contains metadata that helps
@@ -16,13 +17,15 @@ type BtConn struct {
 	header     []byte
 	Infohash   string
 	id         string
+	source     PeerSource
 }
 
-// listenForPeerConnections listens on a TCP port for incoming connections and
-// demuxes them to the appropriate active torrentSession based on the InfoHash
-// in the header.
-func ListenForPeerConnections(flags *TorrentFlags) (conChan chan *BtConn, listenPort int, err error) {
-	listener, listenPort, err := CreateListener(flags)
+// listenForPeerConnections listens on a TCP port, and with uTP on the same
+// UDP port, for incoming connections and demuxes them to the appropriate
+// active torrentSession based on the InfoHash in the header. nat is nil
+// unless a NAT port mapping was requested; closing it removes the mapping.
+func ListenForPeerConnections(flags *TorrentFlags) (conChan chan *BtConn, listenPort int, nat *NATMapper, err error) {
+	listener, listenPort, nat, err := CreateListener(flags)
 	if err != nil {
 		return
 	}
@@ -32,104 +35,119 @@ func ListenForPeerConnections(flags *TorrentFlags) (conChan chan *BtConn, listen
 		log.Printf("Listener failed while finding the host/port for %v: %v", portstring, err)
 		return
 	}
-	go func() {
-		for {
-			var conn net.Conn
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Println("Listener accept failed:", err)
-				continue
-			}
-			header, err := readHeader(conn)
-			if err != nil {
-				log.Println("Error reading header: ", err)
-				continue
-			}
-			peersInfoHash := string(header[8:28])
-			id := string(header[28:48])
-			conChan <- &BtConn{
-				header:     header,
-				Infohash:   peersInfoHash,
-				id:         id,
-				conn:       conn,
-				RemoteAddr: conn.RemoteAddr(),
-			}
-		}
-	}()
+	go acceptPeerConnections(listener, flags.Blocklist, conChan)
+	if flags.utpSocket != nil {
+		go acceptPeerConnections(flags.utpSocket, flags.Blocklist, conChan)
+	}
 	return
 }
 
-func CreateListener(flags *TorrentFlags) (listener net.Listener, externalPort int, err error) {
+func acceptPeerConnections(listener net.Listener, blocklist *Blocklist, conChan chan *BtConn) {
+	for {
+		var conn net.Conn
+		conn, err := listener.Accept()
+		if err == errUTPClosed {
+			return
+		}
+		if err != nil {
+			log.Println("Listener accept failed:", err)
+			continue
+		}
+		if blocked, rule := blocklist.isBlockedAddr(conn.RemoteAddr().String()); blocked {
+			log.Println("Rejecting blocklisted peer", conn.RemoteAddr(), "(", rule, ")")
+			conn.Close()
+			continue
+		}
+		header, err := readHeader(conn)
+		if err != nil {
+			log.Println("Error reading header: ", err)
+			continue
+		}
+		peersInfoHash := string(header[8:28])
+		id := string(header[28:48])
+		conChan <- &BtConn{
+			header:     header,
+			Infohash:   peersInfoHash,
+			id:         id,
+			conn:       conn,
+			RemoteAddr: conn.RemoteAddr(),
+		}
+	}
+}
+
+func CreateListener(flags *TorrentFlags) (listener net.Listener, externalPort int, mapper *NATMapper, err error) {
 	nat, err := CreatePortMapping(flags)
 	if err != nil {
 		err = fmt.Errorf("Unable to create NAT: %v", err)
 		return
 	}
-	listenPort := flags.Port
-	if nat != nil {
-		var external net.IP
-		if external, err = nat.GetExternalAddress(); err != nil {
-			err = fmt.Errorf("Unable to get external IP address from NAT: %v", err)
-			return
-		}
-		log.Println("External ip address: ", external)
-		if listenPort, err = chooseListenPort(nat, listenPort); err != nil {
-			log.Println("Could not choose listen port.", err)
-			log.Println("Peer connectivity will be affected.")
-		}
-	}
-	listener, err = net.ListenTCP("tcp", &net.TCPAddr{Port: listenPort})
+	listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: flags.BindIP, Port: flags.Port})
 	if err != nil {
 		log.Fatal("Listen failed:", err)
 	}
-	if listenPort == 0 {
-		_, portString, _ := net.SplitHostPort(listener.Addr().String())
-		listenPort, _ = strconv.Atoi(portString)
-		flags.Port = listenPort
-	}
+	_, portString, _ := net.SplitHostPort(listener.Addr().String())
+	listenPort, _ := strconv.Atoi(portString)
+	// The DHT shares the port we actually got.
+	flags.Port = listenPort
 	log.Println("Listening for peers on port:", listenPort)
+	if flags.UseUTP {
+		listenUTP(flags)
+	}
 	externalPort = listenPort
+	if nat != nil {
+		if mapper, err = NewNATMapper(nat, listenPort); err != nil {
+			log.Println("Could not map listen port.", err)
+			log.Println("Peer connectivity will be affected.")
+			err = nil
+		} else {
+			externalPort = mapper.ExternalPort()
+		}
+	}
 	return
 }
 
-// createPortMapping creates a NAT port mapping, or nil if none requested or found.
-func CreatePortMapping(flags *TorrentFlags) (nat NAT, err error) {
-	if flags.UseUPnP && flags.UseNATPMP {
-		err = fmt.Errorf("Cannot specify both -useUPnP and -useNATPMP")
+// listenUTP opens flags.utpSocket on flags.Port, or logs why it can't.
+func listenUTP(flags *TorrentFlags) {
+	if flags.Dial != nil && flags.Dial != proxy.Direct {
+		// A SOCKS5 proxy only carries TCP for us.
+		log.Println("Not using uTP: it can't go through the proxy.")
 		return
 	}
-	if flags.UseUPnP {
-		log.Println("Using UPnP to open port.")
-		nat, err = Discover()
+	s, err := ListenUTP(&net.UDPAddr{IP: flags.BindIP, Port: flags.Port})
+	if err != nil {
+		log.Println("Not using uTP:", err)
+		return
 	}
-	if flags.UseNATPMP {
-		var gatewayIP net.IP
-		if flags.Gateway == "" {
-			log.Printf("useNATPMP but gateway not provided, trying discovery")
-			gatewayIP, err = gateway.DiscoverGateway()
-			if err != nil {
-				return
-			}
-			log.Printf("...discovered gateway IP: %s", gatewayIP)
-		} else {
-			gatewayIP = net.ParseIP(flags.Gateway)
-		}
-		log.Println("Using NAT-PMP to open port.")
+	flags.utpSocket = s
+	log.Println("Listening for uTP peers on port:", flags.Port)
+}
+
+// createPortMapping creates a NAT port mapping, or nil if none requested or found.
+// With both UPnP and NAT-PMP, whichever gateway answers first is used.
+func CreatePortMapping(flags *TorrentFlags) (nat NAT, err error) {
+	var gatewayIP net.IP
+	if flags.UseNATPMP && flags.Gateway != "" {
+		gatewayIP = net.ParseIP(flags.Gateway)
 		if gatewayIP == nil {
 			err = fmt.Errorf("Could not parse gateway %q", flags.Gateway)
+			return
 		}
-		nat = NewNatPMP(gatewayIP)
 	}
-	return
-}
-
-func chooseListenPort(nat NAT, externalPort int) (listenPort int, err error) {
-	// TODO: Unmap port when exiting. (Right now we never exit cleanly.)
-	// TODO: Defend the port, remap when router reboots
-	listenPort, err = nat.AddPortMapping("tcp", externalPort, externalPort,
-		"Taipei-Torrent port "+strconv.Itoa(externalPort), 360000)
+	switch {
+	case flags.UseUPnP && flags.UseNATPMP:
+		log.Println("Using NAT-PMP or UPnP to open port.")
+		nat, err = DiscoverNAT(gatewayIP)
+	case flags.UseUPnP:
+		log.Println("Using UPnP to open port.")
+		nat, err = Discover()
+	case flags.UseNATPMP:
+		log.Println("Using NAT-PMP to open port.")
+		nat, err = DiscoverNatPMP(gatewayIP)
+	}
 	if err != nil {
-		return
+		// Carry on without a port mapping.
+		log.Println(err)
+		nat, err = nil, nil
 	}
 	return
 }
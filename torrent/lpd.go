@@ -3,17 +3,33 @@ package torrent
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// Local Peer Discovery, BEP 14.
+
+const (
+	LPD_IPV4_GROUP = "239.192.152.143:6771"
+	LPD_IPV6_GROUP = "[ff15::efc0:988f]:6771"
+
+	LPD_ANNOUNCE_INTERVAL = 5 * time.Minute
+	// Each announce is moved by up to this much either way, so clients that
+	// started together don't flood the LAN in lockstep.
+	LPD_ANNOUNCE_JITTER = 30 * time.Second
+)
+
 var (
 	request_template = "BT-SEARCH * HTTP/1.1\r\n" +
-		"Host: 239.192.152.143:6771\r\n" +
-		"Port: %u\r\n" +
+		"Host: %s\r\n" +
+		"Port: %d\r\n" +
 		"Infohash: %X\r\n\r\n"
 )
 
@@ -22,105 +38,158 @@ type Announce struct {
 	Infohash string
 }
 
+// A multicast group we announce to and listen on.
+type lpdGroup struct {
+	host string
+	addr *net.UDPAddr
+	conn *net.UDPConn
+}
+
 type Announcer struct {
 	btPort uint16
-	addr   *net.UDPAddr
-	conn   *net.UDPConn
+	groups []*lpdGroup
 
-	Announces       chan *Announce
-	activeAnnounces map[string]*time.Ticker
+	Announces chan *Announce
+
+	mu sync.Mutex
+	// Closing the channel stops announcing that infohash.
+	activeAnnounces map[string]chan struct{}
 }
 
+// NewAnnouncer joins the IPv4 and IPv6 LPD multicast groups. It only fails if
+// neither can be joined.
 func NewAnnouncer(listenPort uint16) (lpd *Announcer, err error) {
-	addr, err := net.ResolveUDPAddr("udp4", "239.192.152.143:6771")
-	if err != nil {
-		return
+	lpd = &Announcer{
+		btPort:          listenPort,
+		Announces:       make(chan *Announce),
+		activeAnnounces: make(map[string]chan struct{}),
+	}
+	for _, g := range []struct{ network, host string }{
+		{"udp4", LPD_IPV4_GROUP},
+		{"udp6", LPD_IPV6_GROUP},
+	} {
+		group, gerr := joinLPDGroup(g.network, g.host)
+		if gerr != nil {
+			log.Println("Couldn't join LPD group", g.host, ":", gerr)
+			err = gerr
+			continue
+		}
+		lpd.groups = append(lpd.groups, group)
 	}
+	if len(lpd.groups) == 0 {
+		return nil, err
+	}
+	err = nil
+	for _, group := range lpd.groups {
+		go lpd.run(group)
+	}
+	return
+}
 
-	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+func joinLPDGroup(network, host string) (group *lpdGroup, err error) {
+	addr, err := net.ResolveUDPAddr(network, host)
 	if err != nil {
 		return
 	}
-
-	activeAnnounces := make(map[string]*time.Ticker)
-	lpd = &Announcer{
-		btPort:          listenPort,
-		addr:            addr,
-		conn:            conn,
-		Announces:       make(chan *Announce),
-		activeAnnounces: activeAnnounces,
+	conn, err := net.ListenMulticastUDP(network, nil, addr)
+	if err != nil {
+		return
 	}
-
-	go lpd.run()
+	group = &lpdGroup{host: host, addr: addr, conn: conn}
 	return
 }
 
-func (lpd *Announcer) run() {
+func (lpd *Announcer) run(group *lpdGroup) {
 	for {
-		answer := make([]byte, 256)
-		_, from, err := lpd.conn.ReadFromUDP(answer)
+		answer := make([]byte, 1500)
+		n, from, err := group.conn.ReadFromUDP(answer)
 		if err != nil {
 			log.Println("Error reading from UDP: ", err)
 			continue
 		}
 
-		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(answer)))
+		announces, err := parseLPDAnnounce(answer[:n], from)
 		if err != nil {
-			log.Println("Error reading HTTP request from UDP: ", err)
+			log.Println("Bad LPD announce from", from, ":", err)
 			continue
 		}
-
-		if req.Method != "BT-SEARCH" {
-			log.Println("Invalid method: ", req.Method)
+		for _, a := range announces {
+			lpd.Announces <- a
 		}
+	}
+}
 
-		ih := req.Header.Get("Infohash")
-		if ih == "" {
-			log.Println("No Infohash")
-			continue
-		}
+// parseLPDAnnounce parses a BT-SEARCH message. Peers may list several
+// infohashes in one message.
+func parseLPDAnnounce(packet []byte, from *net.UDPAddr) (announces []*Announce, err error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		return
+	}
 
-		port := req.Header.Get("Port")
-		if port == "" {
-			log.Println("No port")
-			continue
-		}
+	if req.Method != "BT-SEARCH" {
+		err = fmt.Errorf("Invalid method: %v", req.Method)
+		return
+	}
 
-		addr, err := net.ResolveTCPAddr("tcp4", from.IP.String()+":"+port)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		lpd.Announces <- &Announce{addr.String(), ih}
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		err = fmt.Errorf("Bad port %q", req.Header.Get("Port"))
+		return
+	}
+	peer := (&net.TCPAddr{IP: from.IP, Port: port, Zone: from.Zone}).String()
+
+	for _, ih := range req.Header["Infohash"] {
+		announces = append(announces, &Announce{peer, ih})
 	}
+	if len(announces) == 0 {
+		err = errors.New("No Infohash")
+	}
+	return
 }
 
 func (lpd *Announcer) Announce(ih string) {
+	lpd.mu.Lock()
+	defer lpd.mu.Unlock()
+	if _, ok := lpd.activeAnnounces[ih]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	lpd.activeAnnounces[ih] = stop
+
+	// Announce at launch, then about every 5 minutes
 	go func() {
-		requestMessage := []byte(fmt.Sprintf(request_template, lpd.btPort,
-			ih))
+		for {
+			lpd.send(ih)
+			select {
+			case <-stop:
+				return
+			case <-time.After(lpdAnnounceDelay()):
+			}
+		}
+	}()
+}
 
-		// Announce at launch, then every 5 minutes
-		_, err := lpd.conn.WriteToUDP(requestMessage, lpd.addr)
+func (lpd *Announcer) send(ih string) {
+	for _, group := range lpd.groups {
+		requestMessage := []byte(fmt.Sprintf(request_template, group.host, lpd.btPort, ih))
+		_, err := group.conn.WriteToUDP(requestMessage, group.addr)
 		if err != nil {
 			log.Println(err)
 		}
+	}
+}
 
-		ticker := time.NewTicker(5 * time.Minute)
-		lpd.activeAnnounces[ih] = ticker
-
-		for _ = range ticker.C {
-			_, err := lpd.conn.WriteToUDP(requestMessage, lpd.addr)
-			if err != nil {
-				log.Println(err)
-			}
-		}
-	}()
+func lpdAnnounceDelay() time.Duration {
+	return LPD_ANNOUNCE_INTERVAL - LPD_ANNOUNCE_JITTER +
+		time.Duration(rand.Int63n(int64(2*LPD_ANNOUNCE_JITTER)))
 }
 
 func (lpd *Announcer) StopAnnouncing(ih string) {
-	if ticker, ok := lpd.activeAnnounces[ih]; ok {
-		ticker.Stop()
+	lpd.mu.Lock()
+	defer lpd.mu.Unlock()
+	if stop, ok := lpd.activeAnnounces[ih]; ok {
+		close(stop)
 		delete(lpd.activeAnnounces, ih)
 	}
 }
@@ -0,0 +1,51 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseLPDAnnounce(t *testing.T) {
+	from := &net.UDPAddr{IP: net.ParseIP("192.168.1.7"), Port: 6771}
+	packet := fmt.Sprintf(request_template, LPD_IPV4_GROUP, 7777, "\x01\x02")
+	announces, err := parseLPDAnnounce([]byte(packet), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(announces) != 1 || announces[0].Peer != "192.168.1.7:7777" || announces[0].Infohash != "0102" {
+		t.Errorf("parseLPDAnnounce(%q) = %+v", packet, announces[0])
+	}
+
+	from6 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6771, Zone: "eth0"}
+	packet = "BT-SEARCH * HTTP/1.1\r\nHost: " + LPD_IPV6_GROUP + "\r\nPort: 6881\r\n" +
+		"Infohash: aa\r\nInfohash: bb\r\n\r\n"
+	announces, err = parseLPDAnnounce([]byte(packet), from6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(announces) != 2 || announces[0].Peer != "[fe80::1%eth0]:6881" || announces[1].Infohash != "bb" {
+		t.Errorf("parseLPDAnnounce(%q) = %+v", packet, announces)
+	}
+
+	for _, bad := range []string{
+		"GET / HTTP/1.1\r\nPort: 1\r\nInfohash: aa\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nInfohash: aa\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 99999\r\nInfohash: aa\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n",
+		"garbage",
+	} {
+		if _, err = parseLPDAnnounce([]byte(bad), from); err == nil {
+			t.Errorf("parseLPDAnnounce(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestLPDAnnounceDelay(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := lpdAnnounceDelay()
+		if d < LPD_ANNOUNCE_INTERVAL-LPD_ANNOUNCE_JITTER || d >= LPD_ANNOUNCE_INTERVAL+LPD_ANNOUNCE_JITTER {
+			t.Fatalf("lpdAnnounceDelay() = %v", d)
+		}
+	}
+}
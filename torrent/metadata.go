@@ -0,0 +1,176 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jackpal/Taipei-Torrent/bencode"
+	"golang.org/x/net/proxy"
+)
+
+// Fetching the info dictionary from peers with ut_metadata, BEP 9.
+
+const (
+	METADATA_PIECE_SIZE = 16 * 1024
+	// Real info dictionaries are far smaller than this. Anything bigger is a
+	// peer trying to make us allocate memory.
+	MAX_METADATA_SIZE = 16 * 1024 * 1024
+	// How long we give one peer to send the whole info dictionary.
+	METADATA_FETCH_TIMEOUT = time.Minute
+)
+
+// MetadataFetcher downloads the info dictionary for a magnet link from peers,
+// without starting a torrent session.
+type MetadataFetcher struct {
+	InfoHash string
+	PeerID   string
+	Dial     proxy.Dialer
+
+	timeout    time.Duration
+	extensions *ExtensionProtocol
+}
+
+func NewMetadataFetcher(dialer proxy.Dialer, infoHash, peerID string) *MetadataFetcher {
+	f := &MetadataFetcher{
+		InfoHash:   infoHash,
+		PeerID:     peerID,
+		Dial:       dialer,
+		timeout:    METADATA_FETCH_TIMEOUT,
+		extensions: NewExtensionProtocol(0),
+	}
+	// We only read the replies in fetchFrom, so there's no handler.
+	f.extensions.RegisterExtension("ut_metadata", 1, nil)
+	return f
+}
+
+// Fetch tries each peer in turn, for example as they come in from the DHT,
+// until one sends an info dictionary that matches the infohash. It fails if
+// peers is closed first.
+func (f *MetadataFetcher) Fetch(peers <-chan string) (info []byte, err error) {
+	err = errors.New("no peers")
+	for peer := range peers {
+		info, err = f.fetchFrom(peer)
+		if err == nil {
+			return
+		}
+		log.Println("Couldn't get metadata from", peer, ":", err)
+	}
+	return nil, fmt.Errorf("couldn't get metadata from any peer, last error: %v", err)
+}
+
+func (f *MetadataFetcher) fetchFrom(peer string) (info []byte, err error) {
+	conn, err := proxyNetDial(f.Dial, "tcp", peer)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(f.timeout))
+
+	header := make([]byte, 68)
+	copy(header, kBitTorrentHeader[0:])
+	header[25] |= 0x10
+	copy(header[28:48], []byte(f.InfoHash))
+	copy(header[48:68], []byte(f.PeerID))
+	_, err = conn.Write(header)
+	if err != nil {
+		return
+	}
+	theirheader, err := readHeader(conn)
+	if err != nil {
+		return
+	}
+	if string(theirheader[8:28]) != f.InfoHash {
+		return nil, errors.New("peer has a different torrent")
+	}
+	if theirheader[5]&0x10 == 0 {
+		return nil, errors.New("peer doesn't support the extension protocol")
+	}
+
+	h, agreed, err := f.extensions.negotiate(conn)
+	if err != nil {
+		return
+	}
+	id, ok := agreed["ut_metadata"]
+	if !ok {
+		return nil, errors.New("peer doesn't support ut_metadata")
+	}
+	if h.MetadataSize == 0 || h.MetadataSize > MAX_METADATA_SIZE {
+		return nil, fmt.Errorf("bad metadata_size %d", h.MetadataSize)
+	}
+	return f.download(conn, id, int(h.MetadataSize))
+}
+
+// download requests every piece of the metadata at once, then reads replies
+// until it has them all.
+func (f *MetadataFetcher) download(conn net.Conn, id uint8, size int) (info []byte, err error) {
+	pieces := make([][]byte, (size+METADATA_PIECE_SIZE-1)/METADATA_PIECE_SIZE)
+	for i := range pieces {
+		var buf bytes.Buffer
+		buf.WriteByte(EXTENSION)
+		buf.WriteByte(id)
+		bencode.Encode(&buf, map[string]int{
+			"msg_type": METADATA_REQUEST,
+			"piece":    i,
+		})
+		err = writeMessage(conn, buf.Bytes())
+		if err != nil {
+			return
+		}
+	}
+
+	for missing := len(pieces); missing > 0; {
+		var msg []byte
+		msg, err = readMessage(conn)
+		if err != nil {
+			return
+		}
+		// Replies come with the ID we gave ut_metadata in our handshake.
+		if len(msg) < 2 || msg[0] != EXTENSION || msg[1] != f.extensions.byName["ut_metadata"] {
+			continue
+		}
+		var m MetadataMessage
+		var piece []byte
+		m, piece, err = parseMetadataMessage(msg[2:])
+		if err != nil {
+			return
+		}
+		switch {
+		case m.MsgType == METADATA_REJECT:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", m.Piece)
+		case m.MsgType != METADATA_DATA:
+			continue
+		case m.Piece >= uint(len(pieces)):
+			return nil, fmt.Errorf("peer sent metadata piece %d of %d", m.Piece, len(pieces))
+		}
+		if pieces[m.Piece] == nil {
+			missing--
+		}
+		pieces[m.Piece] = piece
+	}
+
+	info = bytes.Join(pieces, nil)
+	if len(info) != size {
+		return nil, fmt.Errorf("got %d bytes of metadata, want %d", len(info), size)
+	}
+	if sum := sha1.Sum(info); string(sum[:]) != f.InfoHash {
+		return nil, fmt.Errorf("metadata has the wrong hash %x", sum)
+	}
+	return
+}
+
+// parseMetadataMessage splits a ut_metadata message into its bencoded
+// header and, for data messages, the piece that follows it.
+func parseMetadataMessage(msg []byte) (m MetadataMessage, piece []byte, err error) {
+	r := bytes.NewReader(msg)
+	err = bencode.Decode(r, &m)
+	if err != nil {
+		return
+	}
+	piece = msg[len(msg)-r.Len():]
+	return
+}
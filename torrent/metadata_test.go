@@ -0,0 +1,144 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/Taipei-Torrent/bencode"
+)
+
+// serveMetadata answers ut_metadata requests for info on one connection. If
+// corrupt is set, the last byte it sends is wrong.
+func serveMetadata(t *testing.T, info []byte, corrupt bool) (addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		theirheader, err := readHeader(conn)
+		if err != nil {
+			return
+		}
+		header := make([]byte, 68)
+		copy(header, kBitTorrentHeader[0:])
+		header[25] |= 0x10
+		copy(header[28:48], theirheader[8:28])
+		copy(header[48:68], strings.Repeat("s", 20))
+		conn.Write(header)
+
+		e := NewExtensionProtocol(0)
+		e.MetadataSize = len(info)
+		e.RegisterExtension("ut_metadata", 3, nil)
+		_, agreed, err := e.negotiate(conn)
+		if err != nil {
+			return
+		}
+		data := append([]byte(nil), info...)
+		if corrupt {
+			data[len(data)-1] ^= 0xff
+		}
+		for {
+			msg, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			m, _, err := parseMetadataMessage(msg[2:])
+			if err != nil || msg[1] != 3 || m.MsgType != METADATA_REQUEST {
+				t.Errorf("bad request %q", msg)
+				return
+			}
+			end := int(m.Piece+1) * METADATA_PIECE_SIZE
+			if end > len(data) {
+				end = len(data)
+			}
+			var buf bytes.Buffer
+			buf.Write([]byte{EXTENSION, agreed["ut_metadata"]})
+			bencode.Encode(&buf, MetadataMessage{METADATA_DATA, m.Piece, uint(len(data))})
+			buf.Write(data[int(m.Piece)*METADATA_PIECE_SIZE : end])
+			writeMessage(conn, buf.Bytes())
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestMetadataFetcher(t *testing.T) {
+	// Two and a bit pieces.
+	info := []byte("d4:name" + strings.Repeat("x", 2*METADATA_PIECE_SIZE+100) + "e")
+	sum := sha1.Sum(info)
+	f := NewMetadataFetcher(nil, string(sum[:]), strings.Repeat("p", 20))
+
+	peers := make(chan string, 2)
+	peers <- serveMetadata(t, info, true)
+	peers <- serveMetadata(t, info, false)
+	close(peers)
+	got, err := f.Fetch(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, info) {
+		t.Errorf("got %d bytes of metadata, want %d", len(got), len(info))
+	}
+}
+
+func TestMetadataFetcherBadHash(t *testing.T) {
+	info := []byte("d4:name4:teste")
+	sum := sha1.Sum(info)
+	f := NewMetadataFetcher(nil, string(sum[:]), strings.Repeat("p", 20))
+
+	peers := make(chan string, 1)
+	peers <- serveMetadata(t, info, true)
+	close(peers)
+	if _, err := f.Fetch(peers); err == nil || !strings.Contains(err.Error(), "wrong hash") {
+		t.Errorf("Fetch error = %v, want a hash mismatch", err)
+	}
+}
+
+func TestBadMetadataRerequested(t *testing.T) {
+	sum := sha1.Sum([]byte("d4:name4:teste"))
+	ts := &TorrentSession{
+		M:         &MetaInfo{InfoHash: string(sum[:])},
+		Session:   SessionInfo{ME: &MetaDataExchange{}},
+		peers:     make(map[string]*peerState),
+		badPieces: make(map[string]int),
+	}
+	addPeer := func(addr string) *peerState {
+		c, _ := net.Pipe()
+		p := NewPeerState(c)
+		p.address = addr
+		p.theirExtensions = map[string]uint8{"ut_metadata": 3}
+		p.metadataSize = 14
+		ts.peers[addr] = p
+		return p
+	}
+	bad := addPeer("10.0.0.1:1")
+	other := addPeer("10.0.0.2:2")
+	if !ts.requestMetadata(bad) {
+		t.Fatal("didn't ask for the metadata")
+	}
+	<-bad.writeChan2
+
+	msg, err := bencode.Marshal(map[string]int{"msg_type": METADATA_DATA, "piece": 0, "total_size": 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.DoMetadata(append(msg, "d4:name4:beste"...), bad)
+	if _, ok := ts.peers[bad.address]; ok || !ts.isBanned(bad.address) {
+		t.Error("peer that sent bad metadata is still around")
+	}
+	if !ts.Session.ME.Transferring || len(ts.Session.ME.Pieces) != 1 || ts.Session.ME.Pieces[0] != nil {
+		t.Errorf("metadata exchange state %+v", ts.Session.ME)
+	}
+	m, _, err := parseMetadataMessage((<-other.writeChan2)[2:])
+	if err != nil || m.MsgType != METADATA_REQUEST || m.Piece != 0 {
+		t.Errorf("other peer was sent %+v, %v", m, err)
+	}
+}
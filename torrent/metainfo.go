@@ -2,22 +2,24 @@ package torrent
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
 
 	"golang.org/x/net/proxy"
 
-	bencode "github.com/jackpal/bencode-go"
-	"github.com/nictuku/dht"
+	"github.com/jackpal/Taipei-Torrent/bencode"
 )
 
 type FileDict struct {
@@ -90,21 +92,19 @@ func GetMetaInfo(dialer proxy.Dialer, torrent string) (metaInfo *MetaInfo, err e
 		}
 		input = r.Body
 	} else if strings.HasPrefix(torrent, "magnet:") {
-		magnet, err := parseMagnet(torrent)
+		magnet, err := ParseMagnetURI(torrent)
 		if err != nil {
 			log.Println("Couldn't parse magnet: ", err)
 			return nil, err
 		}
 
-		ih, err := dht.DecodeInfoHash(magnet.InfoHashes[0])
-		if err != nil {
-			return nil, err
+		metaInfo = &MetaInfo{InfoHash: magnet.InfoHash}
+		if len(magnet.Trackers) > 0 {
+			metaInfo.AnnounceList = [][]string{magnet.Trackers}
 		}
 
-		metaInfo = &MetaInfo{InfoHash: string(ih), AnnounceList: magnet.Trackers}
-
 		//Gives us something to call the torrent until metadata can be procurred
-		metaInfo.Info.Name = hex.EncodeToString([]byte(ih))
+		metaInfo.Info.Name = hex.EncodeToString([]byte(magnet.InfoHash))
 
 		return metaInfo, err
 
@@ -114,50 +114,77 @@ func GetMetaInfo(dialer proxy.Dialer, torrent string) (metaInfo *MetaInfo, err e
 		}
 	}
 
-	// We need to calcuate the sha1 of the Info map, including every value in the
-	// map. The easiest way to do this is to read the data using the Decode
-	// API, and then pick through it manually.
-	var m interface{}
-	m, err = bencode.Decode(input)
-	input.Close()
-	if err != nil {
-		err = errors.New("Couldn't parse torrent file phase 1: " + err.Error())
-		return
-	}
+	defer input.Close()
+	return ParseTorrentFile(input)
+}
 
-	topMap, ok := m.(map[string]interface{})
-	if !ok {
-		err = errors.New("Couldn't parse torrent file phase 2.")
-		return
-	}
+// A TorrentParseError means a torrent file is not valid bencode, or has a
+// value of the wrong type.
+type TorrentParseError struct {
+	Err error
+}
 
-	infoMap, ok := topMap["info"]
-	if !ok {
-		err = errors.New("Couldn't parse torrent file. info")
-		return
-	}
-	var b bytes.Buffer
-	if err = bencode.Marshal(&b, infoMap); err != nil {
-		return
-	}
-	hash := sha1.New()
-	hash.Write(b.Bytes())
+func (e *TorrentParseError) Error() string {
+	return "Couldn't parse torrent file: " + e.Err.Error()
+}
 
-	var m2 MetaInfo
-	err = bencode.Unmarshal(&b, &m2.Info)
-	if err != nil {
-		return
-	}
+func (e *TorrentParseError) Unwrap() error {
+	return e.Err
+}
+
+// A MissingFieldError means a torrent file decoded, but lacks a field every
+// torrent needs.
+type MissingFieldError struct {
+	Field string
+}
 
-	m2.InfoHash = string(hash.Sum(nil))
-	m2.Announce = getString(topMap, "announce")
-	m2.AnnounceList = getSliceSliceString(topMap, "announce-list")
-	m2.CreationDate = getString(topMap, "creation date")
-	m2.Comment = getString(topMap, "comment")
-	m2.CreatedBy = getString(topMap, "created by")
-	m2.Encoding = strings.ToUpper(getString(topMap, "encoding"))
+func (e *MissingFieldError) Error() string {
+	return "Torrent file is missing required field: " + e.Field
+}
+
+// ParseTorrentFile reads a bencoded .torrent file. The InfoHash is the sha1 of
+// the info dictionary exactly as it appears in the file.
+func ParseTorrentFile(r io.Reader) (metaInfo *MetaInfo, err error) {
+	var top map[string]bencode.RawValue
+	if err = bencode.Decode(r, &top); err != nil {
+		return nil, &TorrentParseError{err}
+	}
+	info, ok := top["info"]
+	if !ok {
+		return nil, &MissingFieldError{"info"}
+	}
+	var m MetaInfo
+	if err = info.Decode(&m.Info); err != nil {
+		return nil, &TorrentParseError{err}
+	}
+	switch {
+	case m.Info.PieceLength <= 0:
+		return nil, &MissingFieldError{"info.piece length"}
+	case len(m.Info.Pieces) == 0 || len(m.Info.Pieces)%sha1.Size != 0:
+		return nil, &MissingFieldError{"info.pieces"}
+	case m.Info.Length == 0 && len(m.Info.Files) == 0:
+		return nil, &MissingFieldError{"info.length or info.files"}
+	}
+	hash := sha1.Sum(info)
+	m.InfoHash = string(hash[:])
+
+	// The remaining fields are optional, and some clients write them with
+	// odd types, so pick through them leniently.
+	topMap := make(map[string]interface{}, len(top))
+	for k, v := range top {
+		var x interface{}
+		if k != "info" && v.Decode(&x) == nil {
+			topMap[k] = x
+		}
+	}
+	m.Announce = getString(topMap, "announce")
+	m.AnnounceList = getSliceSliceString(topMap, "announce-list")
+	m.CreationDate = getString(topMap, "creation date")
+	m.Comment = getString(topMap, "comment")
+	m.CreatedBy = getString(topMap, "created by")
+	m.Encoding = strings.ToUpper(getString(topMap, "encoding"))
 
-	metaInfo = &m2
+	metaInfo = &m
 	return
 }
 
@@ -413,7 +440,7 @@ func (m *MetaInfo) UpdateInfoHash(metaInfo *MetaInfo) (err error) {
 	var b bytes.Buffer
 	infoMap := m.Info.toMap()
 	if len(infoMap) > 0 {
-		err = bencode.Marshal(&b, infoMap)
+		err = bencode.Encode(&b, infoMap)
 		if err != nil {
 			return
 		}
@@ -501,7 +528,7 @@ func (m *MetaInfo) Bencode(w io.Writer) (err error) {
 	if m.Encoding != "" {
 		mi["encoding"] = m.Encoding
 	}
-	bencode.Marshal(w, mi)
+	bencode.Encode(w, mi)
 	return
 }
 
@@ -515,12 +542,16 @@ type TrackerResponse struct {
 	Incomplete     uint
 	Peers          string
 	Peers6         string
+	// The announce URL of the tracker that answered. Not part of the
+	// response.
+	Tracker string `bencode:"-"`
 }
 
 type SessionInfo struct {
 	PeerID     string
 	Port       uint16
 	OurAddresses map[string]bool //List of addresses that resolve to ourselves.
+	ExternalIP   net.IP          // From the NAT gateway; sent to trackers.
 	Uploaded   uint64
 	Downloaded uint64
 	Left       uint64
@@ -529,41 +560,93 @@ type SessionInfo struct {
 	FromMagnet  bool
 	HaveTorrent bool
 
-	OurExtensions map[int]string
-	ME            *MetaDataExchange
+	Extensions *ExtensionProtocol
+	ME         *MetaDataExchange
 }
 
 type MetaDataExchange struct {
 	Transferring bool
 	Pieces       [][]byte
+	// The addresses of the peers that sent us pieces.
+	senders map[string]bool
+}
+
+// An HTTP error status from a tracker.
+type trackerHTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *trackerHTTPError) Error() string {
+	return fmt.Sprintf("tracker returned %d %s", e.StatusCode, e.Body)
+}
+
+// isTrackerUnavailable tells whether err means the tracker is down or
+// unreachable, rather than that it refused our request.
+func isTrackerUnavailable(err error) bool {
+	switch e := err.(type) {
+	case *trackerHTTPError:
+		return e.StatusCode >= 500
+	case *url.Error, net.Error:
+		return true
+	}
+	return false
 }
 
 func getTrackerInfo(dialer proxy.Dialer, url string) (tr *TrackerResponse, err error) {
-	r, err := proxyHttpGet(dialer, url)
+	var tr2 TrackerResponse
+	err = getTrackerResponse(dialer, url, &tr2)
 	if err != nil {
 		return
 	}
-	defer r.Body.Close()
-	if r.StatusCode >= 400 {
-		data, _ := ioutil.ReadAll(r.Body)
-		reason := "Bad Request " + string(data)
-		log.Println(reason)
-		err = errors.New(reason)
+	tr = &tr2
+	return
+}
+
+// getTrackerResponse fetches url from an HTTP tracker and decodes the
+// bencoded answer into v.
+func getTrackerResponse(dialer proxy.Dialer, url string, v interface{}) (err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
 		return
 	}
-	var tr2 TrackerResponse
-	err = bencode.Unmarshal(r.Body, &tr2)
-	r.Body.Close()
+	req.Header.Set("User-Agent", "Taipei-Torrent/"+VERSION)
+	// Asking ourselves means the transport leaves the decoding to us.
+	req.Header.Set("Accept-Encoding", "gzip")
+	client := proxyHttpClient(dialer)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > TRACKER_MAX_REDIRECTS {
+			return fmt.Errorf("stopped after %d redirects", TRACKER_MAX_REDIRECTS)
+		}
+		return nil
+	}
+	r, err := client.Do(req)
 	if err != nil {
 		return
 	}
-	tr = &tr2
-	return
+	defer r.Body.Close()
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(r.Body)
+		if err != nil {
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	if r.StatusCode >= 400 {
+		data, _ := ioutil.ReadAll(body)
+		err = &trackerHTTPError{r.StatusCode, string(data)}
+		log.Println(err)
+		return
+	}
+	return bencode.Decode(body, v)
 }
 
 func saveMetaInfo(metadata string) (err error) {
 	var info InfoDict
-	err = bencode.Unmarshal(bytes.NewReader([]byte(metadata)), &info)
+	err = bencode.Unmarshal([]byte(metadata), &info)
 	if err != nil {
 		return
 	}
@@ -1,6 +1,9 @@
 package torrent
 
 import (
+	"fmt"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -36,3 +39,52 @@ func testOnePieceLength(t *testing.T, totalLength int64) {
 		}
 	}
 }
+
+func TestParseTorrentFile(t *testing.T) {
+	f, err := os.Open("../testData/a.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := ParseTorrentFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ih := fmt.Sprintf("%x", m.InfoHash); ih != "a41d1f89286454b18d8d4cb2e02ffe11587476c4" {
+		t.Errorf("InfoHash = %v", ih)
+	}
+	if m.Announce != "http://tracker.osst.co.uk:6969/announce" || m.CreatedBy != "mktorrent 1.0" {
+		t.Errorf("Announce = %q, CreatedBy = %q", m.Announce, m.CreatedBy)
+	}
+}
+
+func TestParseTorrentFileErrors(t *testing.T) {
+	tests := []struct {
+		in      string
+		missing bool
+	}{
+		{"", false},
+		{"d8:announce", false},
+		{"li1ee", false},
+		{"d4:infoi1ee", false},
+		{"d8:announce1:ue", true},
+		{"d4:infod4:name1:nee", true},
+		{"d4:infod12:piece lengthi1e6:pieces3:abcee", true},
+		{"d4:infod12:piece lengthi1e6:pieces20:abcdefghijklmnopqrstee", true},
+	}
+	for _, tt := range tests {
+		_, err := ParseTorrentFile(strings.NewReader(tt.in))
+		switch err.(type) {
+		case *MissingFieldError:
+			if !tt.missing {
+				t.Errorf("ParseTorrentFile(%q) = %v, want a parse error", tt.in, err)
+			}
+		case *TorrentParseError:
+			if tt.missing {
+				t.Errorf("ParseTorrentFile(%q) = %v, want a missing field error", tt.in, err)
+			}
+		default:
+			t.Errorf("ParseTorrentFile(%q) = %v", tt.in, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package torrent
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Keeps our port forwarded through a NAT for as long as we run: TCP for
+// peers, UDP for uTP peers or the DHT, whichever is in use.
+
+const (
+	// The lifetime we ask for. RFC 6886 recommends two hours.
+	NAT_MAPPING_LIFETIME = 2 * time.Hour
+	// How soon we try again after a refresh fails.
+	NAT_MAPPING_RETRY = time.Minute
+)
+
+var natMappingProtocols = []string{"tcp", "udp"}
+
+// NATs that tell us how long they granted a mapping for.
+type leasingNAT interface {
+	addPortMappingLease(protocol string, externalPort, internalPort int, timeout int) (mappedExternalPort int, lifetime time.Duration, err error)
+}
+
+type NATMapper struct {
+	nat  NAT
+	port int // Internal port
+
+	mu            sync.Mutex
+	externalPorts map[string]int // By protocol
+	externalIP    net.IP
+
+	quit chan bool
+	done chan bool
+}
+
+// NewNATMapper maps port on nat for TCP and UDP, and renews the mappings
+// until Close.
+func NewNATMapper(nat NAT, port int) (m *NATMapper, err error) {
+	m = &NATMapper{nat: nat, port: port, externalPorts: make(map[string]int), quit: make(chan bool), done: make(chan bool)}
+	lifetime, err := m.mapPorts()
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := nat.GetExternalAddress(); err != nil {
+		log.Println("Unable to get external IP address from NAT:", err)
+	} else {
+		m.externalIP = ip
+		log.Println("External ip address: ", ip)
+	}
+	go m.refresh(lifetime)
+	return
+}
+
+// mapPorts asks for all the mappings, and returns how long the shortest
+// will last.
+func (m *NATMapper) mapPorts() (lifetime time.Duration, err error) {
+	description := "Taipei-Torrent port " + strconv.Itoa(m.port)
+	for _, protocol := range natMappingProtocols {
+		// Renew the port we got last time, which may not be the one we
+		// first asked for.
+		external := m.externalPort(protocol)
+		if external == 0 {
+			external = m.port
+		}
+		var mapped int
+		var granted time.Duration
+		if l, ok := m.nat.(leasingNAT); ok {
+			mapped, granted, err = l.addPortMappingLease(protocol, external, m.port, int(NAT_MAPPING_LIFETIME.Seconds()))
+		} else {
+			mapped, err = m.nat.AddPortMapping(protocol, external, m.port, description, int(NAT_MAPPING_LIFETIME.Seconds()))
+			granted = NAT_MAPPING_LIFETIME
+		}
+		if err != nil {
+			return
+		}
+		if lifetime == 0 || granted < lifetime {
+			lifetime = granted
+		}
+		m.mu.Lock()
+		if old := m.externalPorts[protocol]; old != 0 && old != mapped {
+			log.Println("NAT moved our external", protocol, "port from", old, "to", mapped)
+		}
+		m.externalPorts[protocol] = mapped
+		m.mu.Unlock()
+	}
+	return
+}
+
+func (m *NATMapper) refresh(lifetime time.Duration) {
+	defer close(m.done)
+	wait := renewAfter(lifetime)
+	for {
+		select {
+		case <-time.After(wait):
+		case <-m.quit:
+			return
+		}
+		lifetime, err := m.mapPorts()
+		if err != nil {
+			log.Println("Couldn't renew NAT port mapping:", err)
+			wait = NAT_MAPPING_RETRY
+			continue
+		}
+		wait = renewAfter(lifetime)
+	}
+}
+
+// Renewing at 60% of the lifetime leaves time to try again before the
+// mapping runs out.
+func renewAfter(lifetime time.Duration) time.Duration {
+	if lifetime <= 0 {
+		return NAT_MAPPING_RETRY
+	}
+	return lifetime * 6 / 10
+}
+
+// ExternalPort is the port peers outside the NAT reach us on.
+func (m *NATMapper) ExternalPort() int {
+	return m.externalPort("tcp")
+}
+
+func (m *NATMapper) externalPort(protocol string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.externalPorts[protocol]
+}
+
+// ExternalIP is the NAT's address on the internet, or nil if it didn't
+// tell us.
+func (m *NATMapper) ExternalIP() net.IP {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.externalIP
+}
+
+// Close stops renewing the mappings and deletes them.
+func (m *NATMapper) Close() (err error) {
+	close(m.quit)
+	<-m.done
+	for _, protocol := range natMappingProtocols {
+		if err2 := m.nat.DeletePortMapping(protocol, m.externalPort(protocol), m.port); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return
+}
+
+// DiscoverNAT looks for a NAT-PMP gateway and a UPnP gateway at the same
+// time, and returns whichever answers first. gatewayIP is the NAT-PMP
+// gateway; nil means the default route's.
+func DiscoverNAT(gatewayIP net.IP) (nat NAT, err error) {
+	return firstNAT(
+		func() (NAT, error) { return DiscoverNatPMP(gatewayIP) },
+		Discover)
+}
+
+// firstNAT runs the discoveries concurrently. It returns the first NAT
+// found, or the last error if none is.
+func firstNAT(discoveries ...func() (NAT, error)) (nat NAT, err error) {
+	type result struct {
+		nat NAT
+		err error
+	}
+	// Buffered, so the losers don't leak.
+	results := make(chan result, len(discoveries))
+	for _, discover := range discoveries {
+		go func(discover func() (NAT, error)) {
+			nat, err := discover()
+			results <- result{nat, err}
+		}(discover)
+	}
+	for range discoveries {
+		r := <-results
+		if r.err == nil {
+			return r.nat, nil
+		}
+		err = r.err
+	}
+	return
+}
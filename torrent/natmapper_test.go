@@ -0,0 +1,91 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNAT grants short leases, and remembers what it was asked to do.
+type fakeNAT struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	mapped   map[string]int // Requests per protocol
+	deleted  []string
+}
+
+func (n *fakeNAT) GetExternalAddress() (addr net.IP, err error) {
+	return net.IPv4(203, 0, 113, 1), nil
+}
+
+func (n *fakeNAT) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (mappedExternalPort int, err error) {
+	mappedExternalPort, _, err = n.addPortMappingLease(protocol, externalPort, internalPort, timeout)
+	return
+}
+
+func (n *fakeNAT) addPortMappingLease(protocol string, externalPort, internalPort int, timeout int) (mappedExternalPort int, lifetime time.Duration, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.mapped[protocol]++
+	return externalPort + 1, n.lifetime, nil
+}
+
+func (n *fakeNAT) DeletePortMapping(protocol string, externalPort, internalPort int) (err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.deleted = append(n.deleted, protocol)
+	return
+}
+
+func TestNATMapper(t *testing.T) {
+	nat := &fakeNAT{lifetime: 50 * time.Millisecond, mapped: make(map[string]int)}
+	m, err := NewNATMapper(nat, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ExternalPort() != 6882 || !m.ExternalIP().Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Errorf("external address %v:%d", m.ExternalIP(), m.ExternalPort())
+	}
+
+	// The mappings are renewed before the lease runs out.
+	time.Sleep(200 * time.Millisecond)
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	if nat.mapped["tcp"] < 3 || nat.mapped["udp"] != nat.mapped["tcp"] {
+		t.Errorf("mapped %v times in 4 lifetimes", nat.mapped)
+	}
+	if len(nat.deleted) != 2 {
+		t.Errorf("deleted %v on Close", nat.deleted)
+	}
+}
+
+func TestDiscoverNatPMPTimeout(t *testing.T) {
+	// Nothing answers NAT-PMP on the loopback address.
+	start := time.Now()
+	if _, err := DiscoverNatPMP(net.IPv4(127, 0, 0, 1)); err == nil {
+		t.Error("found a NAT-PMP gateway on localhost")
+	}
+	if d := time.Since(start); d > 4*NATPMP_DISCOVERY_TIMEOUT {
+		t.Errorf("discovery took %v", d)
+	}
+}
+
+func TestFirstNAT(t *testing.T) {
+	slow := &fakeNAT{}
+	fast := &fakeNAT{}
+	nat, err := firstNAT(
+		func() (NAT, error) { return nil, errors.New("no gateway") },
+		func() (NAT, error) { time.Sleep(100 * time.Millisecond); return slow, nil },
+		func() (NAT, error) { return fast, nil })
+	if err != nil || nat != fast {
+		t.Errorf("firstNAT = %v, %v", nat, err)
+	}
+	if _, err = firstNAT(func() (NAT, error) { return nil, errors.New("no gateway") }); err == nil {
+		t.Error("firstNAT found a NAT when every discovery failed")
+	}
+}
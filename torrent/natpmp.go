@@ -3,7 +3,9 @@ package torrent
 import (
 	"fmt"
 	"net"
+	"time"
 
+	"github.com/jackpal/gateway"
 	natpmp "github.com/jackpal/go-nat-pmp"
 )
 
@@ -11,15 +13,39 @@ import (
 
 // TODO:
 //  + Register for changes to the external address.
-//  + Re-register port mapping when router reboots.
-//  + A mechanism for keeping a port mapping registered.
+
+const (
+	// How long we wait for a gateway to answer before deciding it doesn't
+	// speak NAT-PMP.
+	NATPMP_DISCOVERY_TIMEOUT = 250 * time.Millisecond
+	// How long any later request may take, retries included.
+	NATPMP_TIMEOUT = 5 * time.Second
+)
 
 type natPMPClient struct {
 	client *natpmp.Client
 }
 
 func NewNatPMP(gateway net.IP) (nat NAT) {
-	return &natPMPClient{natpmp.NewClient(gateway)}
+	return &natPMPClient{natpmp.NewClientWithTimeout(gateway, NATPMP_TIMEOUT)}
+}
+
+// DiscoverNatPMP finds the gateway of our default route if gatewayIP is nil,
+// and checks that it answers NAT-PMP requests.
+func DiscoverNatPMP(gatewayIP net.IP) (nat NAT, err error) {
+	if gatewayIP == nil {
+		gatewayIP, err = gateway.DiscoverGateway()
+		if err != nil {
+			return
+		}
+	}
+	probe := &natPMPClient{natpmp.NewClientWithTimeout(gatewayIP, NATPMP_DISCOVERY_TIMEOUT)}
+	if _, err = probe.GetExternalAddress(); err != nil {
+		err = fmt.Errorf("No NAT-PMP gateway at %v: %v", gatewayIP, err)
+		return
+	}
+	nat = NewNatPMP(gatewayIP)
+	return
 }
 
 func (n *natPMPClient) GetExternalAddress() (addr net.IP, err error) {
@@ -34,6 +60,13 @@ func (n *natPMPClient) GetExternalAddress() (addr net.IP, err error) {
 
 func (n *natPMPClient) AddPortMapping(protocol string, externalPort, internalPort int,
 	description string, timeout int) (mappedExternalPort int, err error) {
+	mappedExternalPort, _, err = n.addPortMappingLease(protocol, externalPort, internalPort, timeout)
+	return
+}
+
+// The gateway may grant a shorter lifetime than we asked for.
+func (n *natPMPClient) addPortMappingLease(protocol string, externalPort, internalPort int,
+	timeout int) (mappedExternalPort int, lifetime time.Duration, err error) {
 	if timeout <= 0 {
 		err = fmt.Errorf("timeout must not be <= 0")
 		return
@@ -44,6 +77,7 @@ func (n *natPMPClient) AddPortMapping(protocol string, externalPort, internalPor
 		return
 	}
 	mappedExternalPort = int(response.MappedExternalPort)
+	lifetime = time.Duration(response.PortMappingLifetimeInSeconds) * time.Second
 	return
 }
 
@@ -2,14 +2,19 @@ package torrent
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"os"
 	"path"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // a torrent FileSystem that is backed by real OS files
 type osFileSystem struct {
-	storePath string
+	storePath   string
+	preallocate bool
 }
 
 // A torrent File that is backed by an OS file
@@ -17,10 +22,14 @@ type osFile struct {
 	filePath string
 }
 
-type OsFsProvider struct{}
+type OsFsProvider struct {
+	// Allocate disk space for each file up front, rather than leaving holes
+	// to be filled as pieces arrive.
+	Preallocate bool
+}
 
 func (o OsFsProvider) NewFS(directory string) (fs FileSystem, err error) {
-	return &osFileSystem{directory}, nil
+	return &osFileSystem{directory, o.Preallocate}, nil
 }
 
 func (o *osFileSystem) Open(name []string, length int64) (file File, err error) {
@@ -34,7 +43,7 @@ func (o *osFileSystem) Open(name []string, length int64) (file File, err error)
 	}
 	osfile := &osFile{fullPath}
 	file = osfile
-	err = osfile.ensureExists(length)
+	err = osfile.ensureExists(length, o.preallocate)
 	return
 }
 
@@ -64,7 +73,7 @@ func ensureDirectory(fullPath string) (err error) {
 	return
 }
 
-func (o *osFile) ensureExists(length int64) (err error) {
+func (o *osFile) ensureExists(length int64, preallocate bool) (err error) {
 	name := o.filePath
 	st, err := os.Stat(name)
 	if err != nil && os.IsNotExist(err) {
@@ -83,9 +92,60 @@ func (o *osFile) ensureExists(length int64) (err error) {
 		err = errors.New("Could not truncate file.")
 		return
 	}
+	if preallocate && length > 0 {
+		err = o.preallocate(length)
+	}
+	return
+}
+
+var errNoFallocate = errors.New("fallocate is not supported")
+
+// preallocate reserves length bytes of disk for the file, so it doesn't get
+// fragmented, and so we find out now if the disk is too small.
+func (o *osFile) preallocate(length int64) (err error) {
+	f, err := os.OpenFile(o.filePath, os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	err = fallocate(f, length)
+	if err == errNoFallocate {
+		err = extendFile(f, length)
+	}
+	if err != nil {
+		if isNoSpace(err) {
+			log.Println("Not enough disk space for", o.filePath, "which needs", humanSize(float64(length)))
+		}
+		return fmt.Errorf("could not preallocate %s: %v", o.filePath, err)
+	}
 	return
 }
 
+// extendFile is what we do without fallocate. It's not as good: the file
+// system may still leave holes. It never touches data already written.
+func extendFile(f *os.File, length int64) (err error) {
+	st, err := f.Stat()
+	if err != nil || st.Size() >= length {
+		return
+	}
+	return f.Truncate(length)
+}
+
+func isNoSpace(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOSPC
+}
+
+func (o *osFile) ModTime() (t time.Time, err error) {
+	st, err := os.Stat(o.filePath)
+	if err != nil {
+		return
+	}
+	return st.ModTime(), nil
+}
+
 func (o *osFile) ReadAt(p []byte, off int64) (n int, err error) {
 	file, err := os.OpenFile(o.filePath, os.O_RDWR, 0600)
 	if err != nil {
@@ -1,13 +1,12 @@
 package torrent
 
 import (
-	"bytes"
 	"io"
 	"log"
 	"net"
 	"time"
 
-	bencode "github.com/jackpal/bencode-go"
+	"github.com/jackpal/Taipei-Torrent/bencode"
 )
 
 const MAX_OUR_REQUESTS = 2
@@ -37,9 +36,32 @@ type peerState struct {
 	// This field tells if the peer can send a bitfield or not
 	can_receive_bitfield bool
 
-	theirExtensions map[string]int
+	// The extensions we both support, and the IDs they want us to use.
+	theirExtensions map[string]uint8
+
+	// How we found this peer.
+	source PeerSource
+	pex    pexState
+
+	// Both sides support the Fast Extension, BEP 6.
+	fast bool
+	// How many requests the peer says it queues, and how big it says the
+	// metadata is, from its extension handshake. 0 if it didn't say.
+	reqq         int
+	metadataSize uint
+	// We're connected over uTP rather than TCP.
+	utp bool
+	// The pieces we may get from this peer while it chokes us, and the ones
+	// it may get from us while we choke it.
+	theirAllowedFast map[int]bool
+	ourAllowedFast   map[uint32]bool
+	// Fast Extension messages that came before a magnet link's metadata,
+	// kept until we know how many pieces there are.
+	queuedHaveAll     bool
+	queuedAllowedFast []uint32
 
 	downloaded Accumulator
+	uploaded   Accumulator
 }
 
 func (p *peerState) creditDownload(length int64) {
@@ -55,6 +77,18 @@ func (p *peerState) DownloadBPS() float32 {
 	return float32(p.downloaded.GetRateNoUpdate())
 }
 
+func (p *peerState) creditUpload(length int64) {
+	p.uploaded.Add(time.Now(), length)
+}
+
+func (p *peerState) computeUploadRate() {
+	p.uploaded.GetRate(time.Now())
+}
+
+func (p *peerState) UploadBPS() float32 {
+	return float32(p.uploaded.GetRateNoUpdate())
+}
+
 func queueingWriter(in, out chan []byte) {
 	queue := make(map[int][]byte)
 	head, tail := 0, 0
@@ -96,6 +130,7 @@ func NewPeerState(conn net.Conn) *peerState {
 		am_choking: true, peer_choking: true,
 		peer_requests:        make(map[uint64]bool, MAX_PEER_REQUESTS),
 		our_requests:         make(map[uint64]time.Time, MAX_OUR_REQUESTS),
+		theirAllowedFast:     make(map[int]bool),
 		can_receive_bitfield: true}
 }
 
@@ -141,6 +176,14 @@ func (p *peerState) SetChoke(choke bool) {
 	}
 }
 
+// maxRequests is how many requests we keep outstanding with p.
+func (p *peerState) maxRequests() int {
+	if p.reqq > 0 && p.reqq < MAX_OUR_REQUESTS {
+		return p.reqq
+	}
+	return MAX_OUR_REQUESTS
+}
+
 func (p *peerState) SetInterested(interested bool) {
 	if interested != p.am_interested {
 		// log.Println("SetInterested", interested, p.address)
@@ -160,26 +203,22 @@ func (p *peerState) SendBitfield(bs *Bitset) {
 	p.sendMessage(msg)
 }
 
-func (p *peerState) SendExtensions(port uint16) {
-
-	handshake := map[string]interface{}{
-		"m": map[string]int{
-			"ut_metadata": 1,
-		},
-		"v": "Taipei-Torrent dev",
-	}
+func (p *peerState) SendExtensions(e *ExtensionProtocol) {
+	p.sendMessage(e.handshakeMessage())
+}
 
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, handshake)
+// sendExtensionMessage sends v, bencoded, as the named extension's message.
+// The peer must have announced the extension in its handshake.
+func (p *peerState) sendExtensionMessage(name string, v interface{}) {
+	raw, err := bencode.Marshal(v)
 	if err != nil {
-		//log.Println("Error when marshalling extension message")
 		return
 	}
 
-	msg := make([]byte, 2+buf.Len())
+	msg := make([]byte, len(raw)+2)
 	msg[0] = EXTENSION
-	msg[1] = EXTENSION_HANDSHAKE
-	copy(msg[2:], buf.Bytes())
+	msg[1] = p.theirExtensions[name]
+	copy(msg[2:], raw)
 
 	p.sendMessage(msg)
 }
@@ -308,17 +347,5 @@ func (p *peerState) sendMetadataRequest(piece int) {
 		"msg_type": METADATA_REQUEST,
 		"piece":    piece,
 	}
-
-	var raw bytes.Buffer
-	err := bencode.Marshal(&raw, m)
-	if err != nil {
-		return
-	}
-
-	msg := make([]byte, raw.Len()+2)
-	msg[0] = EXTENSION
-	msg[1] = byte(p.theirExtensions["ut_metadata"])
-	copy(msg[2:], raw.Bytes())
-
-	p.sendMessage(msg)
+	p.sendExtensionMessage("ut_metadata", m)
 }
@@ -0,0 +1,257 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackpal/Taipei-Torrent/bencode"
+)
+
+// Peer Exchange, BEP 11.
+
+const (
+	// We send each peer at most one PEX message per PEX_INTERVAL.
+	PEX_INTERVAL = time.Minute
+	// Messages from a peer that arrive sooner than this after its previous
+	// one are ignored, so a chatty peer can't flood us with addresses.
+	PEX_MIN_RECEIVE_INTERVAL = 45 * time.Second
+	// Limit on the added and dropped entries in one message, in each
+	// direction.
+	PEX_MAX_PEERS = 50
+)
+
+// Flags for entries of added.f.
+const (
+	PEX_FLAG_SEED        = 0x02
+	PEX_FLAG_UTP         = 0x04
+	PEX_FLAG_CONNECTABLE = 0x10
+)
+
+// PeerSource records how we learned about a peer.
+type PeerSource int
+
+const (
+	SourceIncoming PeerSource = iota // They connected to us.
+	SourceTracker
+	SourceDHT
+	SourceLPD
+	SourcePEX
+)
+
+func (s PeerSource) String() string {
+	switch s {
+	case SourceIncoming:
+		return "incoming"
+	case SourceTracker:
+		return "tracker"
+	case SourceDHT:
+		return "DHT"
+	case SourceLPD:
+		return "LPD"
+	case SourcePEX:
+		return "PEX"
+	}
+	return "unknown"
+}
+
+type PEXMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// Per-connection PEX state.
+type pexState struct {
+	lastReceived time.Time
+	// The peers we have told this peer about, and not since dropped.
+	told map[string]bool
+}
+
+// sendPEX tells every peer that supports ut_pex which peers we have connected
+// to or dropped since our last message to it. Called every PEX_INTERVAL.
+func (ts *TorrentSession) sendPEX() {
+	if ts.M.Info.Private != 0 {
+		return
+	}
+	for _, p := range ts.peers {
+		if _, ok := p.theirExtensions["ut_pex"]; !ok {
+			continue
+		}
+		msg, ok := ts.pexMessageFor(p)
+		if !ok {
+			continue
+		}
+		p.sendExtensionMessage("ut_pex", msg)
+	}
+}
+
+// pexMessageFor works out the added and dropped lists for p, and records them
+// as told. ok is false if there is nothing new to say.
+func (ts *TorrentSession) pexMessageFor(p *peerState) (msg *PEXMessage, ok bool) {
+	if p.pex.told == nil {
+		p.pex.told = make(map[string]bool)
+	}
+	var added, dropped []string
+	for addr, other := range ts.peers {
+		// Incoming connections come from ephemeral ports nobody can dial.
+		if other == p || other.source == SourceIncoming || p.pex.told[addr] {
+			continue
+		}
+		added = append(added, addr)
+	}
+	for addr := range p.pex.told {
+		if _, ok := ts.peers[addr]; !ok {
+			dropped = append(dropped, addr)
+		}
+	}
+	// Sorted so the same peers are told first when we have more than
+	// PEX_MAX_PEERS to send.
+	sort.Strings(added)
+	sort.Strings(dropped)
+
+	var m PEXMessage
+	var addedBuf, addedF, added6Buf, added6F, droppedBuf, dropped6Buf bytes.Buffer
+	n := 0
+	for _, addr := range added {
+		if n == PEX_MAX_PEERS {
+			break
+		}
+		b, ok := compactPeer(addr)
+		if !ok {
+			continue
+		}
+		var flags byte = PEX_FLAG_CONNECTABLE
+		if have := ts.peers[addr].have; have != nil && have.n > 0 && have.FindNextClear(0) == -1 {
+			flags |= PEX_FLAG_SEED
+		}
+		if ts.peers[addr].utp {
+			flags |= PEX_FLAG_UTP
+		}
+		if len(b) == 6 {
+			addedBuf.Write(b)
+			addedF.WriteByte(flags)
+		} else {
+			added6Buf.Write(b)
+			added6F.WriteByte(flags)
+		}
+		p.pex.told[addr] = true
+		n++
+	}
+	n = 0
+	for _, addr := range dropped {
+		if n == PEX_MAX_PEERS {
+			break
+		}
+		delete(p.pex.told, addr)
+		n++
+		if b, ok := compactPeer(addr); !ok {
+			continue
+		} else if len(b) == 6 {
+			droppedBuf.Write(b)
+		} else {
+			dropped6Buf.Write(b)
+		}
+	}
+	m.Added, m.AddedF = addedBuf.String(), addedF.String()
+	m.Added6, m.Added6F = added6Buf.String(), added6F.String()
+	m.Dropped, m.Dropped6 = droppedBuf.String(), dropped6Buf.String()
+	if m == (PEXMessage{}) {
+		return nil, false
+	}
+	return &m, true
+}
+
+// DoPEX handles a ut_pex message from p.
+func (ts *TorrentSession) DoPEX(msg []byte, p *peerState) {
+	if ts.M.Info.Private != 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.pex.lastReceived) < PEX_MIN_RECEIVE_INTERVAL {
+		return
+	}
+	p.pex.lastReceived = now
+
+	var m PEXMessage
+	err := bencode.Unmarshal(msg, &m)
+	if err != nil {
+		log.Println("[", ts.M.Info.Name, "] Error when parsing PEX message from", p.address, ":", err)
+		return
+	}
+	peers := append(decodeCompactPeers(m.Added, net.IPv4len), decodeCompactPeers(m.Added6, net.IPv6len)...)
+	if len(peers) > PEX_MAX_PEERS {
+		peers = peers[:PEX_MAX_PEERS]
+	}
+	newPeerCount := 0
+	for _, peer := range peers {
+		if ts.tryNewPeer(peer, SourcePEX) {
+			newPeerCount++
+		}
+	}
+	if newPeerCount > 0 {
+		log.Println("[", ts.M.Info.Name, "] PEX from", p.address, "gave us", newPeerCount, "new peers")
+	}
+}
+
+// compactPeer encodes host:port in the 6 byte (IPv4) or 18 byte (IPv6)
+// compact form.
+func compactPeer(addr string) (b []byte, ok bool) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return
+	}
+	return []byte(FormatPeerContact(ip, port)), true
+}
+
+// decodeCompactPeers splits a string of compact peers with ipLen byte
+// addresses into host:port strings. A trailing partial entry is ignored.
+func decodeCompactPeers(s string, ipLen int) (peers []string) {
+	entryLen := ipLen + 2
+	for i := 0; i+entryLen <= len(s); i += entryLen {
+		ip, port, _ := ParsePeerContact(s[i : i+entryLen])
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	return
+}
+
+// ParsePeerContact decodes a peer in the compact form used by trackers, PEX
+// and the DHT: a 4 or 16 byte IP address followed by a 2 byte port, both in
+// network byte order.
+func ParsePeerContact(s string) (ip net.IP, port int, err error) {
+	ipLen := len(s) - 2
+	if ipLen != net.IPv4len && ipLen != net.IPv6len {
+		return nil, 0, fmt.Errorf("compact peer contact is %d bytes, want 6 or 18", len(s))
+	}
+	ip = net.IP(s[:ipLen])
+	port = int(binary.BigEndian.Uint16([]byte(s[ipLen:])))
+	return
+}
+
+// FormatPeerContact is the inverse of ParsePeerContact. IPv4 addresses are
+// always written in the 6 byte form.
+func FormatPeerContact(ip net.IP, port int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	b := make([]byte, len(ip)+2)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[len(ip):], uint16(port))
+	return string(b)
+}
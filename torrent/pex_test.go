@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompactPeer(t *testing.T) {
+	for _, tt := range []struct {
+		addr  string
+		ipLen int
+	}{
+		{"10.0.0.1:6881", 4},
+		{"[2001:db8::1]:51413", 16},
+	} {
+		b, ok := compactPeer(tt.addr)
+		if !ok || len(b) != tt.ipLen+2 {
+			t.Errorf("compactPeer(%v) = %x, %v", tt.addr, b, ok)
+			continue
+		}
+		peers := decodeCompactPeers(string(b), tt.ipLen)
+		if !reflect.DeepEqual(peers, []string{tt.addr}) {
+			t.Errorf("decodeCompactPeers(compactPeer(%v)) = %v", tt.addr, peers)
+		}
+	}
+	for _, bad := range []string{"10.0.0.1", "host:1", "10.0.0.1:0", "10.0.0.1:70000"} {
+		if b, ok := compactPeer(bad); ok {
+			t.Errorf("compactPeer(%v) = %x, want failure", bad, b)
+		}
+	}
+}
+
+func TestPeerContact(t *testing.T) {
+	for _, tt := range []struct {
+		ip   string
+		port int
+		s    string
+	}{
+		{"10.0.0.1", 6881, "\x0a\x00\x00\x01\x1a\xe1"},
+		{"::ffff:10.0.0.1", 6881, "\x0a\x00\x00\x01\x1a\xe1"},
+		{"2001:db8::1", 51413, "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01\xc8\xd5"},
+	} {
+		s := FormatPeerContact(net.ParseIP(tt.ip), tt.port)
+		if s != tt.s {
+			t.Errorf("FormatPeerContact(%v, %v) = %x, want %x", tt.ip, tt.port, s, tt.s)
+		}
+		ip, port, err := ParsePeerContact(s)
+		if err != nil || !ip.Equal(net.ParseIP(tt.ip)) || port != tt.port {
+			t.Errorf("ParsePeerContact(%x) = %v, %v, %v", s, ip, port, err)
+		}
+	}
+	if _, _, err := ParsePeerContact("\x0a\x00\x00\x01\x1a"); err == nil {
+		t.Error("ParsePeerContact accepted 5 bytes")
+	}
+}
+
+func TestPEXMessageFor(t *testing.T) {
+	ts := &TorrentSession{peers: make(map[string]*peerState)}
+	addPeer := func(addr string, source PeerSource) *peerState {
+		p := &peerState{address: addr, source: source, have: NewBitset(8)}
+		ts.peers[addr] = p
+		return p
+	}
+	p := addPeer("10.0.0.1:1000", SourceTracker)
+	addPeer("10.0.0.2:2000", SourceDHT)
+	addPeer("[2001:db8::3]:3000", SourcePEX)
+	addPeer("10.0.0.4:40000", SourceIncoming)
+	seed := addPeer("10.0.0.5:5000", SourceLPD)
+	for i := 0; i < 8; i++ {
+		seed.have.Set(i)
+	}
+
+	m, ok := ts.pexMessageFor(p)
+	if !ok {
+		t.Fatal("pexMessageFor found nothing to send")
+	}
+	if got := decodeCompactPeers(m.Added, 4); !reflect.DeepEqual(got, []string{"10.0.0.2:2000", "10.0.0.5:5000"}) {
+		t.Errorf("added = %v", got)
+	}
+	if m.AddedF != string([]byte{PEX_FLAG_CONNECTABLE, PEX_FLAG_CONNECTABLE | PEX_FLAG_SEED}) {
+		t.Errorf("added.f = %x", m.AddedF)
+	}
+	if got := decodeCompactPeers(m.Added6, 16); !reflect.DeepEqual(got, []string{"[2001:db8::3]:3000"}) {
+		t.Errorf("added6 = %v", got)
+	}
+
+	// Nothing changed, so nothing to say.
+	if m, ok = ts.pexMessageFor(p); ok {
+		t.Errorf("second pexMessageFor = %+v, want nothing", m)
+	}
+
+	delete(ts.peers, "10.0.0.2:2000")
+	addPeer("10.0.0.6:6000", SourceTracker)
+	m, ok = ts.pexMessageFor(p)
+	if !ok {
+		t.Fatal("pexMessageFor found nothing to send")
+	}
+	if got := decodeCompactPeers(m.Added, 4); !reflect.DeepEqual(got, []string{"10.0.0.6:6000"}) {
+		t.Errorf("added = %v", got)
+	}
+	if got := decodeCompactPeers(m.Dropped, 4); !reflect.DeepEqual(got, []string{"10.0.0.2:2000"}) {
+		t.Errorf("dropped = %v", got)
+	}
+}
@@ -0,0 +1,269 @@
+package torrent
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A write-back cache: verified pieces are kept in memory and written to the
+// underlying store in the background, in piece order, so a spinning disk
+// sees a few long writes instead of one seek per piece.
+
+// Each torrent's cache size, in MiB, if none is given.
+const DEFAULT_PIECE_CACHE_SIZE = 64
+
+// How often the background goroutine writes dirty pieces out.
+const PIECE_CACHE_FLUSH_INTERVAL = 5 * time.Second
+
+// This provider gives each torrent its own write-back cache of capacity MiB.
+type PieceCacheProvider struct {
+	capacity int
+}
+
+func NewPieceCacheProvider(capacity int) CacheProvider {
+	if capacity <= 0 {
+		capacity = DEFAULT_PIECE_CACHE_SIZE
+	}
+	return &PieceCacheProvider{capacity}
+}
+
+func (p *PieceCacheProvider) NewCache(infohash string, numPieces int, pieceSize int64, torrentLength int64, underlying FileStore) FileStore {
+	return NewPieceCache(underlying, pieceSize, int64(p.capacity)*1024*1024)
+}
+
+type PieceCache struct {
+	underlying FileStore
+	pieceSize  int64
+	capacity   int64 // bytes
+
+	mu     sync.Mutex
+	size   int64
+	lru    *list.List // of *cachedPiece, most recently used first
+	pieces map[int]*list.Element
+	// Dirty pieces that were evicted but are still being written out.
+	writing map[int]*cachedPiece
+	err     error // The first write error, returned by Flush and Close.
+
+	flushNow chan bool
+	quit     chan bool
+	done     chan bool
+}
+
+type cachedPiece struct {
+	index int
+	data  []byte
+	dirty bool // Not written to the underlying store yet.
+}
+
+// NewPieceCache returns a write-back cache of capacity bytes in front of
+// underlying, and starts its flushing goroutine. Close stops it.
+func NewPieceCache(underlying FileStore, pieceSize, capacity int64) *PieceCache {
+	c := &PieceCache{
+		underlying: underlying,
+		pieceSize:  pieceSize,
+		capacity:   capacity,
+		lru:        list.New(),
+		pieces:     make(map[int]*list.Element),
+		writing:    make(map[int]*cachedPiece),
+		flushNow:   make(chan bool, 1),
+		quit:       make(chan bool),
+		done:       make(chan bool),
+	}
+	go c.flusher()
+	return c
+}
+
+// WritePiece keeps p, like RamCache does, so the caller mustn't reuse it.
+func (c *PieceCache) WritePiece(p []byte, piece int) (n int, err error) {
+	data := p
+	c.mu.Lock()
+	if e, ok := c.pieces[piece]; ok {
+		// Replace rather than update the entry, so a Flush that is writing
+		// the old data out doesn't mark the new data clean.
+		c.size += int64(len(data) - len(e.Value.(*cachedPiece).data))
+		e.Value = &cachedPiece{piece, data, true}
+		c.lru.MoveToFront(e)
+	} else {
+		c.pieces[piece] = c.lru.PushFront(&cachedPiece{piece, data, true})
+		c.size += int64(len(data))
+	}
+	evicted := c.evict()
+	if c.size > c.capacity/2 {
+		select {
+		case c.flushNow <- true:
+		default:
+		}
+	}
+	c.mu.Unlock()
+
+	// Written without the lock, so reads of other pieces don't wait on the
+	// disk.
+	for _, cp := range evicted {
+		_, werr := c.underlying.WritePiece(cp.data, cp.index)
+		c.mu.Lock()
+		c.setErr(werr)
+		if c.writing[cp.index] == cp {
+			delete(c.writing, cp.index)
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(p), c.err
+}
+
+// evict drops least recently used pieces until the cache fits, and returns
+// the dirty ones, which the caller has to write out. They stay readable
+// until then. Called with c.mu held.
+func (c *PieceCache) evict() (evicted []*cachedPiece) {
+	for c.size > c.capacity && c.lru.Len() > 1 {
+		e := c.lru.Back()
+		cp := e.Value.(*cachedPiece)
+		if cp.dirty {
+			c.writing[cp.index] = cp
+			evicted = append(evicted, cp)
+		}
+		c.lru.Remove(e)
+		delete(c.pieces, cp.index)
+		c.size -= int64(len(cp.data))
+	}
+	return
+}
+
+// Called with c.mu held.
+func (c *PieceCache) setErr(err error) {
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+// Dirty reports whether piece is still waiting to be written to the
+// underlying store.
+func (c *PieceCache) Dirty(piece int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.pieces[piece]; ok && e.Value.(*cachedPiece).dirty {
+		return true
+	}
+	_, ok := c.writing[piece]
+	return ok
+}
+
+// ReadAt serves cached pieces from memory, and the rest from the underlying
+// store.
+func (c *PieceCache) ReadAt(p []byte, off int64) (n int, err error) {
+	for len(p) > 0 {
+		piece := int(off / c.pieceSize)
+		pieceOff := off % c.pieceSize
+		chunk := c.pieceSize - pieceOff
+		if chunk > int64(len(p)) {
+			chunk = int64(len(p))
+		}
+		var nThisTime int
+		c.mu.Lock()
+		var data []byte
+		e, ok := c.pieces[piece]
+		if ok {
+			c.lru.MoveToFront(e)
+			data = e.Value.(*cachedPiece).data
+		} else if cp, writing := c.writing[piece]; writing {
+			ok = true
+			data = cp.data
+		}
+		if ok && pieceOff < int64(len(data)) {
+			nThisTime = copy(p[:chunk], data[pieceOff:])
+		}
+		c.mu.Unlock()
+		if !ok {
+			nThisTime, err = c.underlying.ReadAt(p[:chunk], off)
+			if err != nil {
+				n += nThisTime
+				return
+			}
+		}
+		if nThisTime == 0 {
+			// Past the end of the last piece.
+			for i := range p {
+				p[i] = 0
+			}
+			return n + len(p), nil
+		}
+		n += nThisTime
+		p = p[nThisTime:]
+		off += int64(nThisTime)
+	}
+	return
+}
+
+// Flush writes every dirty piece to the underlying store.
+func (c *PieceCache) Flush() error {
+	c.mu.Lock()
+	var dirty []*cachedPiece
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if cp := e.Value.(*cachedPiece); cp.dirty {
+			dirty = append(dirty, cp)
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Sort(byPieceIndex(dirty))
+	for _, cp := range dirty {
+		// A piece's data never changes once cached, so it can be written
+		// without the lock.
+		_, err := c.underlying.WritePiece(cp.data, cp.index)
+		c.mu.Lock()
+		c.setErr(err)
+		if err == nil {
+			cp.dirty = false
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *PieceCache) flusher() {
+	ticker := time.NewTicker(PIECE_CACHE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.flushNow:
+			c.Flush()
+		case <-c.quit:
+			close(c.done)
+			return
+		}
+	}
+}
+
+// Close writes out the remaining dirty pieces and closes the underlying
+// store.
+func (c *PieceCache) Close() error {
+	close(c.quit)
+	<-c.done
+	err := c.Flush()
+	cerr := c.underlying.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Pieces may still be waiting in memory; call Flush first for a time that
+// covers every write.
+func (c *PieceCache) ModTime() (time.Time, error) {
+	return modTime(c.underlying)
+}
+
+type byPieceIndex []*cachedPiece
+
+func (a byPieceIndex) Len() int           { return len(a) }
+func (a byPieceIndex) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPieceIndex) Less(i, j int) bool { return a[i].index < a[j].index }
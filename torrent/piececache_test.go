@@ -0,0 +1,166 @@
+package torrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// memStore is a FileStore in memory that counts its reads and writes.
+type memStore struct {
+	mu     sync.Mutex
+	data   []byte
+	reads  int
+	writes []int
+	closed bool
+}
+
+func (m *memStore) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads++
+	return copy(p, m.data[off:]), nil
+}
+
+func (m *memStore) WritePiece(p []byte, piece int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes = append(m.writes, piece)
+	return copy(m.data[piece*4:], p), nil
+}
+
+func (m *memStore) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestPieceCache(t *testing.T) {
+	m := &memStore{data: make([]byte, 14)}
+	c := NewPieceCache(m, 4, 8)
+	c.WritePiece([]byte("aaaa"), 0)
+	c.WritePiece([]byte("bbbb"), 1)
+	buf := make([]byte, 6)
+	if _, err := c.ReadAt(buf, 2); err != nil || string(buf) != "aabbbb" || m.reads != 0 {
+		t.Errorf("ReadAt = %q, %v, with %d underlying reads", buf, err, m.reads)
+	}
+
+	// Piece 0 was used last, so piece 1 goes.
+	c.ReadAt(buf[:1], 0)
+	c.WritePiece([]byte("cccc"), 2)
+	c.mu.Lock()
+	_, have0 := c.pieces[0]
+	_, have1 := c.pieces[1]
+	c.mu.Unlock()
+	if !have0 || have1 {
+		t.Errorf("after eviction: have piece 0 %v, piece 1 %v", have0, have1)
+	}
+	if _, err := c.ReadAt(buf[:4], 4); err != nil || string(buf[:4]) != "bbbb" {
+		t.Errorf("evicted piece reads %q, %v", buf[:4], err)
+	}
+	c.WritePiece([]byte("dd"), 3)
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.closed || !bytes.Equal(m.data, []byte("aaaabbbbccccdd")) {
+		t.Errorf("after Close: closed %v, data %q", m.closed, m.data)
+	}
+}
+
+// slowStore holds each write until release is closed.
+type slowStore struct {
+	memStore
+	started chan bool
+	release chan bool
+}
+
+func (s *slowStore) WritePiece(p []byte, piece int) (int, error) {
+	select {
+	case s.started <- true:
+	default:
+	}
+	<-s.release
+	return s.memStore.WritePiece(p, piece)
+}
+
+func TestPieceCacheEvictWithoutLock(t *testing.T) {
+	s := &slowStore{memStore{data: make([]byte, 12)}, make(chan bool, 1), make(chan bool)}
+	c := NewPieceCache(s, 4, 8)
+	// Only eviction writes anything.
+	close(c.quit)
+	<-c.done
+	c.WritePiece([]byte("aaaa"), 0)
+	c.WritePiece([]byte("bbbb"), 1)
+	written := make(chan bool)
+	go func() {
+		c.WritePiece([]byte("cccc"), 2)
+		close(written)
+	}()
+	<-s.started
+
+	// Piece 0 is on its way to the disk. It, and the cached pieces, can be
+	// read meanwhile.
+	buf := make([]byte, 12)
+	if _, err := c.ReadAt(buf, 0); err != nil || string(buf) != "aaaabbbbcccc" {
+		t.Errorf("ReadAt = %q, %v", buf, err)
+	}
+	if !c.Dirty(0) || !c.Dirty(2) {
+		t.Error("pieces reported clean before they were written")
+	}
+	close(s.release)
+	<-written
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.Dirty(0) || string(s.data) != "aaaabbbbcccc" {
+		t.Errorf("after Flush: data %q", s.data)
+	}
+}
+
+// A multi-file torrent whose pieces arrive in random order, like they do
+// with rarest first.
+func benchmarkWritePieces(b *testing.B, cached bool) {
+	const pieceLength, numPieces = 256 * 1024, 64
+	dir, err := ioutil.TempDir("", "piececache")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := &InfoDict{PieceLength: pieceLength}
+	for i := 0; i < 8; i++ {
+		info.Files = append(info.Files, FileDict{Length: numPieces * pieceLength / 8, Path: []string{strconv.Itoa(i)}})
+	}
+	piece := make([]byte, pieceLength)
+	rand.Read(piece)
+	b.SetBytes(numPieces * pieceLength)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fs, _ := OsFsProvider{}.NewFS(dir)
+		var store FileStore
+		store, _, err = NewFileStore(info, fs)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if cached {
+			store = NewPieceCache(store, pieceLength, DEFAULT_PIECE_CACHE_SIZE*1024*1024)
+		}
+		for _, p := range rand.Perm(numPieces) {
+			store.WritePiece(piece, p)
+		}
+		store.Close()
+	}
+}
+
+func BenchmarkWritePiecesDirect(b *testing.B) {
+	benchmarkWritePieces(b, false)
+}
+
+func BenchmarkWritePiecesCached(b *testing.B) {
+	benchmarkWritePieces(b, true)
+}
@@ -96,30 +96,30 @@ func hashPiece(h chan chunk, result chan chunk) {
 	}
 }
 
-func checkPiece(piece []byte, m *MetaInfo, pieceIndex int) (good bool, err error) {
+// PieceVerifier checks downloaded pieces against the SHA1 hashes in the
+// metainfo.
+type PieceVerifier struct {
+	pieces [][sha1.Size]byte
+}
+
+func NewPieceVerifier(m *MetaInfo, numPieces int) (v *PieceVerifier, err error) {
 	ref := m.Info.Pieces
-	var currentSum []byte
-	currentSum, err = computePieceSum(piece)
-	if err != nil {
+	if len(ref) != numPieces*sha1.Size {
+		err = fmt.Errorf("Info.Pieces has %d bytes, want %d for %d pieces",
+			len(ref), numPieces*sha1.Size, numPieces)
 		return
 	}
-	base := pieceIndex * sha1.Size
-	end := base + sha1.Size
-	refSha1 := []byte(ref[base:end])
-	good = checkEqual(refSha1, currentSum)
-	if !good {
-		err = fmt.Errorf("reference sha1: %v != piece sha1: %v", refSha1, currentSum)
+	v = &PieceVerifier{make([][sha1.Size]byte, numPieces)}
+	for i := range v.pieces {
+		copy(v.pieces[i][:], ref[i*sha1.Size:])
 	}
 	return
 }
 
-func computePieceSum(piece []byte) (sum []byte, err error) {
-	hasher := sha1.New()
-
-	_, err = hasher.Write(piece)
-	if err != nil {
-		return
+// Verify reports whether data is piece index.
+func (v *PieceVerifier) Verify(index int, data []byte) bool {
+	if index < 0 || index >= len(v.pieces) {
+		return false
 	}
-	sum = hasher.Sum(nil)
-	return
+	return sha1.Sum(data) == v.pieces[index]
 }
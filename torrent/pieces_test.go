@@ -30,3 +30,47 @@ func TestComputeSums(t *testing.T) {
 		}
 	}
 }
+
+func TestPieceVerifier(t *testing.T) {
+	a, b := []byte("first piece"), []byte("second")
+	sumA, sumB := sha1.Sum(a), sha1.Sum(b)
+	m := &MetaInfo{Info: InfoDict{Pieces: string(sumA[:]) + string(sumB[:])}}
+	v, err := NewPieceVerifier(m, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		index int
+		data  []byte
+		want  bool
+	}{
+		{0, a, true},
+		{1, b, true},
+		{0, b, false},
+		{1, append(b, 0), false},
+		{2, a, false},
+		{-1, a, false},
+	} {
+		if got := v.Verify(tt.index, tt.data); got != tt.want {
+			t.Errorf("Verify(%d, %q) = %v, want %v", tt.index, tt.data, got, tt.want)
+		}
+	}
+	if _, err = NewPieceVerifier(m, 3); err == nil {
+		t.Error("NewPieceVerifier accepted 2 hashes for 3 pieces")
+	}
+}
+
+func BenchmarkPieceVerify(b *testing.B) {
+	piece := make([]byte, 256*1024)
+	sum := sha1.Sum(piece)
+	v, err := NewPieceVerifier(&MetaInfo{Info: InfoDict{Pieces: string(sum[:])}}, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(piece)))
+	for i := 0; i < b.N; i++ {
+		if !v.Verify(0, piece) {
+			b.Fatal("Verify failed")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Choosing which piece to download next.
+
+var ErrNoPieces = errors.New("no piece to download")
+
+type PieceSelector interface {
+	// Next picks one of the pieces set in candidates: pieces the peer has and
+	// we neither have nor are downloading.
+	Next(candidates *Bitset) (piece int, err error)
+
+	// Keep track of which pieces our peers have. AddPeerPieces and
+	// RemovePeerPieces are for a peer's whole bitfield, when it arrives and
+	// when the peer goes away.
+	AddPeerPiece(piece int)
+	AddPeerPieces(have *Bitset)
+	RemovePeerPieces(have *Bitset)
+}
+
+// NewPieceSelector returns the named selector: "rarest" (the default if name
+// is empty), "sequential" or "random".
+func NewPieceSelector(name string, numPieces int) (PieceSelector, error) {
+	switch name {
+	case "", "rarest":
+		return NewRarestFirst(numPieces), nil
+	case "sequential":
+		return Sequential{}, nil
+	case "random":
+		return Random{}, nil
+	}
+	return nil, fmt.Errorf("unknown piece selection %q, want rarest, sequential or random", name)
+}
+
+// RarestFirst picks the piece the fewest of our peers have, so rare pieces
+// get spread through the swarm before their owners leave.
+type RarestFirst struct {
+	pieceCount []int
+}
+
+func NewRarestFirst(numPieces int) *RarestFirst {
+	return &RarestFirst{make([]int, numPieces)}
+}
+
+func (r *RarestFirst) Next(candidates *Bitset) (piece int, err error) {
+	// Ties are broken at random, so clients that see the same swarm don't
+	// all go for the same piece.
+	piece, ties := -1, 0
+	for i := candidates.FindNextSet(0); i >= 0; i = candidates.FindNextSet(i + 1) {
+		switch {
+		case piece < 0 || r.pieceCount[i] < r.pieceCount[piece]:
+			piece, ties = i, 1
+		case r.pieceCount[i] == r.pieceCount[piece]:
+			ties++
+			if rand.Intn(ties) == 0 {
+				piece = i
+			}
+		}
+	}
+	if piece < 0 {
+		err = ErrNoPieces
+	}
+	return
+}
+
+func (r *RarestFirst) AddPeerPiece(piece int) {
+	if piece >= 0 && piece < len(r.pieceCount) {
+		r.pieceCount[piece]++
+	}
+}
+
+func (r *RarestFirst) AddPeerPieces(have *Bitset) {
+	for i := have.FindNextSet(0); i >= 0; i = have.FindNextSet(i + 1) {
+		r.AddPeerPiece(i)
+	}
+}
+
+func (r *RarestFirst) RemovePeerPieces(have *Bitset) {
+	for i := have.FindNextSet(0); i >= 0; i = have.FindNextSet(i + 1) {
+		if i < len(r.pieceCount) && r.pieceCount[i] > 0 {
+			r.pieceCount[i]--
+		}
+	}
+}
+
+// Sequential picks the lowest numbered piece, for streaming.
+type Sequential struct{}
+
+func (Sequential) Next(candidates *Bitset) (piece int, err error) {
+	piece = candidates.FindNextSet(0)
+	if piece < 0 {
+		err = ErrNoPieces
+	}
+	return
+}
+
+func (Sequential) AddPeerPiece(piece int)        {}
+func (Sequential) AddPeerPieces(have *Bitset)    {}
+func (Sequential) RemovePeerPieces(have *Bitset) {}
+
+// Random picks any candidate with equal probability.
+type Random struct{}
+
+func (Random) Next(candidates *Bitset) (piece int, err error) {
+	piece, n := -1, 0
+	for i := candidates.FindNextSet(0); i >= 0; i = candidates.FindNextSet(i + 1) {
+		n++
+		if rand.Intn(n) == 0 {
+			piece = i
+		}
+	}
+	if piece < 0 {
+		err = ErrNoPieces
+	}
+	return
+}
+
+func (Random) AddPeerPiece(piece int)        {}
+func (Random) AddPeerPieces(have *Bitset)    {}
+func (Random) RemovePeerPieces(have *Bitset) {}
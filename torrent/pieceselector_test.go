@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"testing"
+)
+
+func bitsetOf(n int, pieces ...int) *Bitset {
+	b := NewBitset(n)
+	for _, i := range pieces {
+		b.Set(i)
+	}
+	return b
+}
+
+func TestRarestFirst(t *testing.T) {
+	r := NewRarestFirst(5)
+	r.AddPeerPieces(bitsetOf(5, 0, 1, 2, 3))
+	r.AddPeerPieces(bitsetOf(5, 0, 1, 3))
+	r.AddPeerPieces(bitsetOf(5, 0, 3, 4))
+	r.AddPeerPiece(4)
+	// Counts are now 3, 2, 1, 3, 2.
+	for _, tt := range []struct {
+		candidates *Bitset
+		want       int
+	}{
+		{bitsetOf(5, 0, 1, 2, 3, 4), 2},
+		{bitsetOf(5, 0, 1, 3), 1},
+	} {
+		got, err := r.Next(tt.candidates)
+		if got != tt.want || err != nil {
+			t.Errorf("Next(%x) = %d, %v, want %d", tt.candidates.Bytes(), got, err, tt.want)
+		}
+	}
+	if got, _ := r.Next(bitsetOf(5, 0, 3)); got != 0 && got != 3 {
+		t.Errorf("Next picked %d out of a tie between 0 and 3", got)
+	}
+	if _, err := r.Next(bitsetOf(5)); err != ErrNoPieces {
+		t.Errorf("Next with no candidates: err = %v", err)
+	}
+
+	// The peer with piece 2 leaves, and 2 is no longer the rarest.
+	r.RemovePeerPieces(bitsetOf(5, 0, 1, 2, 3))
+	r.AddPeerPieces(bitsetOf(5, 2))
+	r.AddPeerPiece(2)
+	if got, _ := r.Next(bitsetOf(5, 1, 2)); got != 1 {
+		t.Errorf("after removing a peer, Next = %d, want 1", got)
+	}
+}
+
+func TestSequentialAndRandom(t *testing.T) {
+	candidates := bitsetOf(10, 3, 5, 8)
+	if got, err := (Sequential{}).Next(candidates); got != 3 || err != nil {
+		t.Errorf("Sequential.Next = %d, %v, want 3", got, err)
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		got, err := (Random{}).Next(candidates)
+		if err != nil || !candidates.IsSet(got) {
+			t.Fatalf("Random.Next = %d, %v", got, err)
+		}
+		seen[got] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Random.Next only picked %v in 100 tries", seen)
+	}
+	for _, s := range []PieceSelector{Sequential{}, Random{}} {
+		if _, err := s.Next(NewBitset(10)); err != ErrNoPieces {
+			t.Errorf("%T.Next with no candidates: err = %v", s, err)
+		}
+	}
+}
+
+func TestNewPieceSelector(t *testing.T) {
+	for _, name := range []string{"", "rarest", "sequential", "random"} {
+		if _, err := NewPieceSelector(name, 4); err != nil {
+			t.Errorf("NewPieceSelector(%q): %v", name, err)
+		}
+	}
+	if _, err := NewPieceSelector("fastest", 4); err == nil {
+		t.Error("NewPieceSelector accepted an unknown name")
+	}
+}
+
+func TestPeerPiecesBeforeMetadata(t *testing.T) {
+	// A magnet link's session has no piece count or selector yet.
+	ts := &TorrentSession{M: &MetaInfo{}, Session: SessionInfo{FromMagnet: true}}
+	p := NewPeerState(nil)
+	p.have = NewBitset(0)
+	p.fast = true
+	for _, message := range [][]byte{{HAVE_ALL}, {BITFIELD}} {
+		if err := ts.DoMessage(p, message); err != nil {
+			t.Errorf("message %d: %v", message[0], err)
+		}
+		p.can_receive_bitfield = true
+		if err := ts.generalMessage(message, p); err != nil {
+			t.Errorf("message %d: %v", message[0], err)
+		}
+	}
+}
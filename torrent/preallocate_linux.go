@@ -0,0 +1,15 @@
+package torrent
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func fallocate(f *os.File, length int64) error {
+	err := unix.Fallocate(int(f.Fd()), 0, 0, length)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return errNoFallocate
+	}
+	return err
+}
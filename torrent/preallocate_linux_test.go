@@ -0,0 +1,41 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prealloc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const length = 1 << 20
+	fs, _ := OsFsProvider{Preallocate: true}.NewFS(dir)
+	if _, err = fs.Open([]string{"f"}, length); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != length {
+		t.Errorf("size %d, want %d", st.Size(), length)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "f"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if fallocate(f, length) == errNoFallocate {
+		t.Skip("the temp directory's file system doesn't support fallocate")
+	}
+	if allocated := st.Sys().(*syscall.Stat_t).Blocks * 512; allocated < length {
+		t.Errorf("only %d of %d bytes allocated", allocated, length)
+	}
+}
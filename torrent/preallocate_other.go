@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package torrent
+
+import "os"
+
+func fallocate(f *os.File, length int64) error {
+	return errNoFallocate
+}
@@ -0,0 +1,41 @@
+package torrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocateCompleteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prealloc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "f")
+	data := bytes.Repeat([]byte{0xff}, 4096)
+	if err = ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening a finished download again must leave it as it is, with or
+	// without fallocate.
+	fs, _ := OsFsProvider{Preallocate: true}.NewFS(dir)
+	if _, err = fs.Open([]string{"f"}, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extendFile(f, int64(len(data)))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(name); !bytes.Equal(got, data) {
+		t.Error("reopening a complete file changed it")
+	}
+}
@@ -1,11 +1,65 @@
 package torrent
 
 import (
+	"context"
+	"fmt"
 	"golang.org/x/net/proxy"
 	"net"
 	"net/http"
 )
 
+// Peer connections, HTTP trackers and torrent downloads all dial through
+// TorrentFlags.Dial. UDP traffic can't go through the proxy: UDP trackers and
+// LPD are skipped when there is one, and DHT and uTP are left to the user.
+
+// Returned when we can't reach the SOCKS5 proxy itself, as opposed to the
+// proxy failing to reach the destination. It comes wrapped in a
+// *net.OpError.
+type ProxyUnreachableError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ProxyUnreachableError) Error() string {
+	return fmt.Sprintf("SOCKS5 proxy %s is unreachable: %v", e.Addr, e.Err)
+}
+
+func (e *ProxyUnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// viaProxy reports whether dialer goes through a proxy, so that traffic that
+// doesn't would give our address away.
+func viaProxy(dialer proxy.Dialer) bool {
+	return dialer != nil && dialer != proxy.Direct
+}
+
+// NewSOCKS5Dialer returns a dialer that connects through the SOCKS5 proxy
+// at addr. An empty username means the proxy doesn't need authentication.
+func NewSOCKS5Dialer(addr, username, password string) (proxy.Dialer, error) {
+	var auth *proxy.Auth
+	if username != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+	return proxy.SOCKS5("tcp", addr, auth, proxyForwardDialer{})
+}
+
+// proxyForwardDialer connects to the proxy itself.
+type proxyForwardDialer struct{}
+
+func (d proxyForwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (proxyForwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, &ProxyUnreachableError{addr, err}
+	}
+	return conn, nil
+}
+
 func proxyNetDial(dialer proxy.Dialer, network, address string) (net.Conn, error) {
 	if dialer != nil {
 		return dialer.Dial(network, address)
@@ -21,7 +75,14 @@ func proxyHttpClient(dialer proxy.Dialer) (client *http.Client) {
 	if dialer == nil {
 		dialer = proxy.Direct
 	}
-	tr := &http.Transport{Dial: dialer.Dial}
+	tr := &http.Transport{}
+	if cd, ok := dialer.(proxy.ContextDialer); ok {
+		// Lets a request's context cancel a dial that is waiting on the
+		// proxy.
+		tr.DialContext = cd.DialContext
+	} else {
+		tr.Dial = dialer.Dial
+	}
 	client = &http.Client{Transport: tr}
 	return
 }
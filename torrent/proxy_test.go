@@ -0,0 +1,159 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// fakeSOCKS5Proxy serves RFC 1928 CONNECT requests, with RFC 1929
+// authentication if username is set.
+type fakeSOCKS5Proxy struct {
+	listener           net.Listener
+	username, password string
+}
+
+func newFakeSOCKS5Proxy(t *testing.T, username, password string) *fakeSOCKS5Proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeSOCKS5Proxy{l, username, password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeSOCKS5Proxy) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if p.username == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		username := make([]byte, header[1])
+		io.ReadFull(conn, username)
+		io.ReadFull(conn, header[:1])
+		password := make([]byte, header[0])
+		io.ReadFull(conn, password)
+		if string(username) != p.username || string(password) != p.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// CONNECT to an IPv4 address; that is all the tests use.
+	request := make([]byte, 10)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 || request[3] != 1 {
+		return
+	}
+	addr := net.JoinHostPort(net.IP(request[4:8]).String(), strconv.Itoa(int(request[8])<<8|int(request[9])))
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		proxyUser, proxyPassword string
+		username, password       string
+		ok                       bool
+	}{
+		{"", "", "", "", true},
+		{"u", "p", "u", "p", true},
+		{"u", "p", "u", "wrong", false},
+	}
+	for _, test := range tests {
+		p := newFakeSOCKS5Proxy(t, test.proxyUser, test.proxyPassword)
+		dialer, err := NewSOCKS5Dialer(p.listener.Addr().String(), test.username, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := proxyHttpGet(dialer, server.URL)
+		if err == nil {
+			body, _ := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if string(body) != "hello" {
+				t.Errorf("got %q through the proxy", body)
+			}
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("user %q password %q: err = %v", test.username, test.password, err)
+		}
+		p.listener.Close()
+	}
+}
+
+func TestSOCKS5ProxyUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	dialer, err := NewSOCKS5Dialer(addr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = proxyNetDial(dialer, "tcp", "127.0.0.1:6881")
+	var pe *ProxyUnreachableError
+	if !errors.As(err, &pe) || pe.Addr != addr {
+		t.Errorf("dialing through a dead proxy: %v", err)
+	}
+}
+
+func TestNoUDPTrackersThroughProxy(t *testing.T) {
+	dialer, err := NewSOCKS5Dialer("127.0.0.1:1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !viaProxy(dialer) || viaProxy(nil) || viaProxy(proxy.Direct) {
+		t.Error("viaProxy is wrong")
+	}
+	got := withoutUDPTrackers([][]string{{"udp://a:80", "http://b/announce"}, {"udp://c:80"}})
+	if want := [][]string{{"http://b/announce"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err = scrapeTracker(dialer, "udp://127.0.0.1:1", strings.Repeat("i", 20)); err == nil {
+		t.Error("scraped a UDP tracker through a proxy")
+	}
+}
@@ -0,0 +1,226 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/jackpal/Taipei-Torrent/bencode"
+)
+
+// Resume data: what we had downloaded when we last ran, so a restart doesn't
+// have to hash check everything or download it again.
+
+// The fraction of the pieces claimed by resume data that LoadResumeData
+// checks, when the files haven't changed since the data was saved.
+const RESUME_VERIFY_FRACTION = 0.05
+
+type resumeData struct {
+	InfoHash string `bencode:"info hash"`
+	// The pieces we have, as a bitfield.
+	Pieces string `bencode:"pieces"`
+	// How many bytes of complete pieces each file has.
+	FileBytes []int64 `bencode:"file bytes"`
+	// The tracker that gave us TrackerID.
+	Tracker   string `bencode:"tracker"`
+	TrackerID string `bencode:"tracker id"`
+	// When we planned to announce next, in Unix seconds.
+	NextAnnounce int64 `bencode:"next announce"`
+	// The newest modification time of the torrent's files, in Unix
+	// nanoseconds. 0 if the file store can't tell.
+	ModTime int64 `bencode:"mtime"`
+}
+
+func (ts *TorrentSession) resumeFilePath() string {
+	return "./" + hex.EncodeToString([]byte(ts.M.InfoHash)) + ".resume"
+}
+
+// SaveResumeData writes the resume data to path. The file is replaced
+// atomically, so a crash leaves either the old data or the new.
+func (ts *TorrentSession) SaveResumeData(path string) (err error) {
+	pieces := ts.piecesOnDisk()
+	r := resumeData{
+		InfoHash:  ts.M.InfoHash,
+		Pieces:    string(pieces.Bytes()),
+		FileBytes: ts.fileBytes(pieces),
+		Tracker:   ts.trackerURL,
+		TrackerID: ts.trackerID,
+	}
+	if !ts.nextAnnounce.IsZero() {
+		r.NextAnnounce = ts.nextAnnounce.Unix()
+	}
+	if t, err := modTime(ts.fileStore); err == nil {
+		r.ModTime = t.UnixNano()
+	}
+	data, err := bencode.Marshal(r)
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0666)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadResumeData reads the resume data saved by SaveResumeData, and trusts
+// the pieces it claims after hash checking some of them. If the files have
+// been modified since the data was saved, every claimed piece is checked.
+// Pieces that fail are marked missing.
+func (ts *TorrentSession) LoadResumeData(path string) (err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var r resumeData
+	err = bencode.Decode(bytes.NewReader(data), &r)
+	if err != nil {
+		return
+	}
+	if r.InfoHash != ts.M.InfoHash {
+		return errors.New("resume data is for a different torrent")
+	}
+	pieceSet := NewBitsetFromBytes(ts.totalPieces, []byte(r.Pieces))
+	if pieceSet == nil {
+		return errors.New("resume data has a bad piece bitfield")
+	}
+
+	t, err := modTime(ts.fileStore)
+	changed := r.ModTime != 0 && err == nil && t.UnixNano() != r.ModTime
+	if changed {
+		log.Println("[", ts.M.Info.Name, "] Files changed since the resume data was saved")
+	}
+	ts.useClaimedPieces(pieceSet, changed)
+	ts.trackerURL, ts.trackerID = r.Tracker, r.TrackerID
+	if r.NextAnnounce != 0 {
+		ts.nextAnnounce = time.Unix(r.NextAnnounce, 0)
+	}
+	return nil
+}
+
+func (ts *TorrentSession) haveBitsetFilePath() string {
+	return "./" + hex.EncodeToString([]byte(ts.M.InfoHash)) + "-haveBitset"
+}
+
+// LoadHaveBitset reads the bare piece bitfield that -quickResume saved
+// before there was resume data. Nothing says whether the files changed
+// since, so every piece it claims is checked.
+func (ts *TorrentSession) LoadHaveBitset(path string) (err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	pieceSet := NewBitsetFromBytes(ts.totalPieces, data)
+	if pieceSet == nil {
+		return errors.New("bad haveBitset file")
+	}
+	ts.useClaimedPieces(pieceSet, true)
+	return
+}
+
+// useClaimedPieces hash checks some of the pieces in pieceSet, or all of
+// them, and takes the ones that pass as the pieces we have.
+func (ts *TorrentSession) useClaimedPieces(pieceSet *Bitset, checkAll bool) {
+	var claimed []int
+	for i := pieceSet.FindNextSet(0); i >= 0; i = pieceSet.FindNextSet(i + 1) {
+		claimed = append(claimed, i)
+	}
+	check := claimed
+	if checkAll {
+		log.Println("[", ts.M.Info.Name, "] Checking all", len(claimed), "claimed pieces")
+	} else {
+		n := int(float64(len(claimed))*RESUME_VERIFY_FRACTION + 0.999)
+		check = make([]int, n)
+		for i, j := range rand.Perm(len(claimed))[:n] {
+			check[i] = claimed[j]
+		}
+	}
+	bad := 0
+	for _, piece := range check {
+		buf := make([]byte, ts.pieceLength(piece))
+		_, rerr := ts.fileStore.ReadAt(buf, int64(piece)*ts.M.Info.PieceLength)
+		if rerr != nil || !ts.verifier.Verify(piece, buf) {
+			pieceSet.Clear(piece)
+			bad++
+		}
+	}
+	if bad > 0 {
+		log.Println("[", ts.M.Info.Name, "]", bad, "of", len(check), "checked pieces were bad")
+	}
+
+	ts.pieceSet = pieceSet
+	ts.goodPieces = len(claimed) - bad
+}
+
+// piecesOnDisk is the pieces we have, less those a write-back cache hasn't
+// written out yet. Resume data can only claim these.
+func (ts *TorrentSession) piecesOnDisk() *Bitset {
+	wb, ok := ts.fileStore.(writeBackStore)
+	if !ok {
+		return ts.pieceSet
+	}
+	pieces := NewBitsetFromBytes(ts.pieceSet.Len(), ts.pieceSet.Bytes())
+	for i := pieces.FindNextSet(0); i >= 0; i = pieces.FindNextSet(i + 1) {
+		if wb.Dirty(i) {
+			pieces.Clear(i)
+		}
+	}
+	return pieces
+}
+
+// fileBytes counts the bytes of the given pieces in each file.
+func (ts *TorrentSession) fileBytes(pieces *Bitset) (counts []int64) {
+	lengths := []int64{ts.M.Info.Length}
+	if len(ts.M.Info.Files) > 0 {
+		lengths = lengths[:0]
+		for _, f := range ts.M.Info.Files {
+			lengths = append(lengths, f.Length)
+		}
+	}
+	pieceLength := ts.M.Info.PieceLength
+	counts = make([]int64, len(lengths))
+	var start int64
+	for i, length := range lengths {
+		end := start + length
+		for piece := start / pieceLength; piece*pieceLength < end; piece++ {
+			if !pieces.IsSet(int(piece)) {
+				continue
+			}
+			from, to := piece*pieceLength, (piece+1)*pieceLength
+			if from < start {
+				from = start
+			}
+			if to > end {
+				to = end
+			}
+			counts[i] += to - from
+		}
+		start = end
+	}
+	return
+}
+
+// A FileStore that holds writes back, like PieceCache.
+type writeBackStore interface {
+	Dirty(piece int) bool
+}
+
+// A File or FileStore that can tell when its data was last modified.
+type modTimer interface {
+	ModTime() (time.Time, error)
+}
+
+func modTime(v interface{}) (t time.Time, err error) {
+	m, ok := v.(modTimer)
+	if !ok {
+		return t, fmt.Errorf("%T can't tell its modification time", v)
+	}
+	return m.ModTime()
+}
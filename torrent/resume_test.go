@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// changedStore reports a modification time that never matches saved resume
+// data, so every claimed piece gets checked.
+type changedStore struct {
+	FileStore
+}
+
+func (c changedStore) ModTime() (time.Time, error) {
+	return time.Now(), nil
+}
+
+func testResumeSession(t *testing.T, dir string, write bool) *TorrentSession {
+	const pieceLength = 1024
+	data := make([]byte, 3*pieceLength+100)
+	for i := range data {
+		data[i] = byte(i / pieceLength)
+	}
+	m := &MetaInfo{InfoHash: strings.Repeat("h", 20)}
+	m.Info.Files = []FileDict{{Length: 1500, Path: []string{"a"}}, {Length: int64(len(data)) - 1500, Path: []string{"b"}}}
+	m.Info.PieceLength = pieceLength
+	for i := 0; i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[i:end])
+		m.Info.Pieces += string(sum[:])
+	}
+	fs, _ := OsFsProvider{}.NewFS(dir)
+	store, totalSize, err := NewFileStore(&m.Info, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &TorrentSession{M: m, fileStore: store, totalPieces: 4, lastPieceLength: 100, totalSize: totalSize}
+	ts.verifier, err = NewPieceVerifier(m, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.pieceSet = NewBitset(4)
+	for i := 0; write && i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		ts.fileStore.WritePiece(data[i:end], i/pieceLength)
+	}
+	return ts
+}
+
+func TestResumeData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "x.resume")
+
+	ts := testResumeSession(t, dir, true)
+	ts.pieceSet.Set(0)
+	ts.pieceSet.Set(2)
+	ts.pieceSet.Set(3)
+	ts.trackerURL, ts.trackerID = "http://tracker/announce", "tid"
+	ts.nextAnnounce = time.Unix(time.Now().Unix()+1800, 0)
+	if got, want := ts.fileBytes(ts.pieceSet), []int64{1024, 1024 + 100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fileBytes = %v, want %v", got, want)
+	}
+	if err = ts.SaveResumeData(path); err != nil {
+		t.Fatal(err)
+	}
+
+	ts2 := testResumeSession(t, dir, false)
+	if err = ts2.LoadResumeData(path); err != nil {
+		t.Fatal(err)
+	}
+	if ts2.goodPieces != 3 || !reflect.DeepEqual(ts2.pieceSet.Bytes(), ts.pieceSet.Bytes()) || ts2.trackerID != "tid" || ts2.trackerURL != ts.trackerURL ||
+		!ts2.nextAnnounce.Equal(ts.nextAnnounce) {
+		t.Errorf("loaded %d pieces %x, tracker ID %q from %q, next announce %v", ts2.goodPieces, ts2.pieceSet.Bytes(), ts2.trackerID, ts2.trackerURL, ts2.nextAnnounce)
+	}
+
+	// Piece 2 got damaged while we were away.
+	ts3 := testResumeSession(t, dir, false)
+	ts3.fileStore.WritePiece(make([]byte, 1024), 2)
+	ts3.fileStore = changedStore{ts3.fileStore}
+	if err = ts3.LoadResumeData(path); err != nil {
+		t.Fatal(err)
+	}
+	if ts3.goodPieces != 2 || ts3.pieceSet.IsSet(2) || !ts3.pieceSet.IsSet(3) {
+		t.Errorf("after damage: %d pieces %x", ts3.goodPieces, ts3.pieceSet.Bytes())
+	}
+
+	ts4 := testResumeSession(t, dir, false)
+	ts4.M.InfoHash = strings.Repeat("x", 20)
+	if err = ts4.LoadResumeData(path); err == nil {
+		t.Error("loaded resume data for another torrent")
+	}
+}
+
+func TestResumeDataWriteBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "x.resume")
+
+	ts := testResumeSession(t, dir, true)
+	c := NewPieceCache(ts.fileStore, 1024, 1<<20)
+	ts.fileStore = c
+	ts.pieceSet.Set(0)
+	ts.pieceSet.Set(1)
+	c.WritePiece(make([]byte, 1024), 1)
+	// Piece 1 is only in memory, so it isn't claimed, and saving doesn't
+	// wait for it.
+	if err = ts.SaveResumeData(path); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Dirty(1) {
+		t.Error("saving resume data flushed the cache")
+	}
+	ts2 := testResumeSession(t, dir, false)
+	if err = ts2.LoadResumeData(path); err != nil {
+		t.Fatal(err)
+	}
+	if !ts2.pieceSet.IsSet(0) || ts2.pieceSet.IsSet(1) {
+		t.Errorf("claimed pieces %x", ts2.pieceSet.Bytes())
+	}
+	c.Close()
+}
+
+func TestLoadHaveBitset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "x-haveBitset")
+
+	// Pieces 0 and 3 are on disk, piece 1 is claimed but isn't.
+	ts := testResumeSession(t, dir, true)
+	ts.fileStore.WritePiece(make([]byte, 1024), 1)
+	if err = ioutil.WriteFile(path, bitsetOf(4, 0, 1, 3).Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.LoadHaveBitset(path); err != nil {
+		t.Fatal(err)
+	}
+	if ts.goodPieces != 2 || !reflect.DeepEqual(ts.pieceSet.Bytes(), bitsetOf(4, 0, 3).Bytes()) {
+		t.Errorf("loaded %d pieces %x", ts.goodPieces, ts.pieceSet.Bytes())
+	}
+}
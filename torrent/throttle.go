@@ -0,0 +1,117 @@
+package torrent
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth throttling, shared by every peer connection of every torrent.
+
+// The smallest burst a limited direction allows, so a block can go through
+// in one piece even under a low limit.
+const MIN_THROTTLE_BURST = STANDARD_BLOCK_LENGTH
+
+type RateLimiter struct {
+	download *rate.Limiter
+	upload   *rate.Limiter
+}
+
+// NewRateLimiter returns a limiter for the given rates, in bytes per second.
+// 0 means unlimited.
+func NewRateLimiter(downloadBPS, uploadBPS int64) *RateLimiter {
+	r := &RateLimiter{rate.NewLimiter(rate.Inf, 0), rate.NewLimiter(rate.Inf, 0)}
+	r.SetDownloadLimit(downloadBPS)
+	r.SetUploadLimit(uploadBPS)
+	return r
+}
+
+// SetDownloadLimit changes the download limit, in bytes per second. 0 means
+// unlimited. Open connections pick up the new limit right away.
+func (r *RateLimiter) SetDownloadLimit(bytesPerSec int64) {
+	setLimit(r.download, bytesPerSec)
+}
+
+// SetUploadLimit is like SetDownloadLimit, for upload.
+func (r *RateLimiter) SetUploadLimit(bytesPerSec int64) {
+	setLimit(r.upload, bytesPerSec)
+}
+
+func setLimit(l *rate.Limiter, bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	burst := bytesPerSec
+	if burst < MIN_THROTTLE_BURST {
+		burst = MIN_THROTTLE_BURST
+	}
+	l.SetBurst(int(burst))
+	l.SetLimit(rate.Limit(bytesPerSec))
+}
+
+// Conn wraps c so that its reads and writes count against the limits.
+func (r *RateLimiter) Conn(c net.Conn) net.Conn {
+	return &throttledConn{c, r}
+}
+
+type throttledConn struct {
+	net.Conn
+	r *RateLimiter
+}
+
+func (t *throttledConn) Read(p []byte) (n int, err error) {
+	// Read no more than the limiter would let through at once, and pay for
+	// it once it has arrived. The TCP window then slows the sender down.
+	if b, limited := burst(t.r.download); limited && len(p) > b {
+		p = p[:b]
+	}
+	n, err = t.Conn.Read(p)
+	waitN(t.r.download, n)
+	return
+}
+
+func (t *throttledConn) Write(p []byte) (n int, err error) {
+	chunkSize := len(p)
+	if b, limited := burst(t.r.upload); limited && chunkSize > b {
+		chunkSize = b
+	}
+	for len(p) > 0 {
+		chunk := chunkSize
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		waitN(t.r.upload, chunk)
+		var nThisTime int
+		nThisTime, err = t.Conn.Write(p[:chunk])
+		n += nThisTime
+		if err != nil {
+			return
+		}
+		p = p[chunk:]
+	}
+	return
+}
+
+// burst is how many bytes l lets through at once, and whether it limits
+// anything at all.
+func burst(l *rate.Limiter) (b int, limited bool) {
+	return l.Burst(), l.Limit() != rate.Inf
+}
+
+// waitN waits until l lets n bytes through. A limit set while we read or
+// wrote may have a smaller burst than the one we went by, so the wait is
+// split into bursts, and a burst that shrank in the meantime is retried.
+func waitN(l *rate.Limiter, n int) {
+	for n > 0 {
+		chunk := n
+		if b, limited := burst(l); limited && chunk > b {
+			chunk = b
+		}
+		if err := l.WaitN(context.Background(), chunk); err != nil {
+			continue
+		}
+		n -= chunk
+	}
+}
@@ -0,0 +1,61 @@
+package torrent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const limit = 2 * STANDARD_BLOCK_LENGTH
+	r := NewRateLimiter(0, limit)
+	a, b := net.Pipe()
+	defer a.Close()
+	go io.Copy(ioutil.Discard, b)
+	conn := r.Conn(a)
+
+	// The first second's worth goes straight out, the rest waits.
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 3*STANDARD_BLOCK_LENGTH)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("wrote 1.5s of data in %v", d)
+	}
+
+	// Lifting the limit applies to the open connection.
+	r.SetUploadLimit(0)
+	start = time.Now()
+	if _, err := conn.Write(make([]byte, 10*limit)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("unlimited write took %v", d)
+	}
+}
+
+func TestRateLimiterChangedDuringRead(t *testing.T) {
+	r := NewRateLimiter(0, 0)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := r.Conn(a)
+
+	// The read starts unlimited, so it isn't cut to the burst, but the
+	// limit set before the data arrives still applies to it.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r.SetDownloadLimit(STANDARD_BLOCK_LENGTH)
+		b.Write(make([]byte, 2*STANDARD_BLOCK_LENGTH))
+	}()
+	start := time.Now()
+	n, err := conn.Read(make([]byte, 2*STANDARD_BLOCK_LENGTH))
+	if err != nil || n != 2*STANDARD_BLOCK_LENGTH {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("read 2s of data in %v", d)
+	}
+}
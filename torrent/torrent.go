@@ -3,11 +3,9 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
@@ -15,11 +13,12 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	bencode "github.com/jackpal/bencode-go"
+	"github.com/jackpal/Taipei-Torrent/bencode"
 	"github.com/nictuku/dht"
 	"github.com/nictuku/nettools"
 )
@@ -29,6 +28,21 @@ const (
 	TARGET_NUM_PEERS = 15
 )
 
+// Minimum time between two DHT peer requests for the same torrent. Every
+// request starts a new search in the DHT node, so asking more often just runs
+// duplicate searches for an infohash that is already being looked up.
+const DHT_PEERS_REQUEST_INTERVAL = 30 * time.Second
+
+// Peers that send us this many pieces that fail their hash check are banned.
+const MAX_BAD_PIECES = 3
+
+// Endgame mode starts once fewer than this many pieces are missing, and all
+// of them are being downloaded.
+const ENDGAME_THRESHOLD = 20
+
+// How often we scrape the trackers for the size of the swarm.
+const TRACKER_SCRAPE_INTERVAL = 5 * time.Minute
+
 // BitTorrent message types. Sources:
 // http://bittorrent.org/beps/bep_0003.html
 // http://wiki.theory.org/BitTorrentSpecification
@@ -43,6 +57,14 @@ const (
 	PIECE
 	CANCEL
 	PORT      // Not implemented. For DHT support.
+
+	// Fast Extension, BEP 6.
+	SUGGEST        = 13
+	HAVE_ALL       = 14
+	HAVE_NONE      = 15
+	REJECT_REQUEST = 16
+	ALLOWED_FAST   = 17
+
 	EXTENSION = 20
 )
 
@@ -68,6 +90,8 @@ var kBitTorrentHeader = []byte{'\x13', 'B', 'i', 't', 'T', 'o', 'r',
 type ActivePiece struct {
 	downloaderCount []int // -1 means piece is already downloaded
 	buffer          []byte
+	// The addresses of the peers that sent us blocks of this piece.
+	senders map[string]bool
 }
 
 func (a *ActivePiece) chooseBlockToDownload(endgame bool) (index int) {
@@ -115,16 +139,26 @@ func (a *ActivePiece) isComplete() bool {
 	return true
 }
 
+// What the trackers last told us about a torrent's swarm.
+type TorrentHealth struct {
+	Seeders    int
+	Leechers   int
+	Downloaded int // Only known from a scrape.
+	Updated    time.Time
+}
+
 type TorrentSession struct {
 	flags                *TorrentFlags
 	M                    *MetaInfo
 	Session              SessionInfo
 	ti                   *TrackerResponse
+	health               TorrentHealth
+	scrapeChan           chan ScrapeStats
 	torrentHeader        []byte
 	fileStore            FileStore
 	trackerReportChan    chan ClientStatusReport
 	trackerInfoChan      chan *TrackerResponse
-	hintNewPeerChan      chan string
+	hintNewPeerChan      chan peerHint
 	addPeerChan          chan *BtConn
 	peers                map[string]*peerState
 	peerMessageChan      chan peerMessage
@@ -143,7 +177,19 @@ type TorrentSession struct {
 	torrentFile          string
 	chokePolicy          ChokePolicy
 	chokePolicyHeartbeat <-chan time.Time
-	execOnSeedingDone    bool
+	seeding              bool
+	lastDHTPeersRequest  time.Time
+	verifier             *PieceVerifier
+	pieceSelector        PieceSelector
+	isEndgame            bool
+	endgameThreshold     int
+	// The tracker that last gave us a tracker ID, the ID, and when we
+	// planned to announce next. Kept in the resume data.
+	trackerURL   string
+	trackerID    string
+	nextAnnounce time.Time
+	// How many bad pieces each IP address has sent us blocks of.
+	badPieces map[string]int
 }
 
 func NewTorrentSession(flags *TorrentFlags, torrent string, listenPort uint16) (t *TorrentSession, err error) {
@@ -155,9 +201,10 @@ func NewTorrentSession(flags *TorrentFlags, torrent string, listenPort uint16) (
 		quit:                 make(chan bool),
 		ended:                make(chan bool),
 		torrentFile:          torrent,
+		badPieces:            make(map[string]int),
+		endgameThreshold:     ENDGAME_THRESHOLD,
 		chokePolicy:          &ClassicChokePolicy{},
 		chokePolicyHeartbeat: time.Tick(10 * time.Second),
-		execOnSeedingDone:    len(flags.ExecOnSeeding) == 0,
 	}
 	fromMagnet := strings.HasPrefix(torrent, "magnet:")
 	ts.M, err = GetMetaInfo(flags.Dial, torrent)
@@ -183,9 +230,14 @@ func NewTorrentSession(flags *TorrentFlags, torrent string, listenPort uint16) (
 		FromMagnet:    fromMagnet,
 		HaveTorrent:   false,
 		ME:            &MetaDataExchange{},
-		OurExtensions: map[int]string{1: "ut_metadata"},
+		Extensions:    NewExtensionProtocol(listenPort),
 		OurAddresses:  map[string]bool{"127.0.0.1:" + strconv.Itoa(int(listenPort)): true},
 	}
+	ts.Session.Extensions.RegisterExtension("ut_metadata", 1, ts.DoMetadata)
+	// BEP 27: private torrents must only get peers from their trackers.
+	if ts.M.Info.Private == 0 {
+		ts.Session.Extensions.RegisterExtension("ut_pex", 2, ts.DoPEX)
+	}
 	ts.setHeader()
 
 	if !ts.Session.FromMagnet {
@@ -196,7 +248,7 @@ func NewTorrentSession(flags *TorrentFlags, torrent string, listenPort uint16) (
 
 func (ts *TorrentSession) reload(metadata string) (err error) {
 	var info InfoDict
-	err = bencode.Unmarshal(bytes.NewReader([]byte(metadata)), &info)
+	err = bencode.Unmarshal([]byte(metadata), &info)
 	if err != nil {
 		log.Println("[", ts.M.Info.Name, "] Error when reloading torrent: ", err)
 		return
@@ -226,9 +278,12 @@ func (ts *TorrentSession) load() (err error) {
 		if torrentName == "" {
 			torrentName = filepath.Base(ts.torrentFile)
 		}
-		// canonicalize the torrent path and make sure it doesn't start with ".."
-		torrentName = path.Clean("/" + torrentName)
-		dir += torrentName
+		// The torrent's files go in a directory named after it.
+		torrentName, err = SanitizeTorrentPath([]string{torrentName})
+		if err != nil {
+			return
+		}
+		dir = path.Join(dir, torrentName)
 		//Remove ".torrent" extension if present
 		if strings.HasSuffix(strings.ToLower(dir), ext) {
 			dir = dir[:len(dir)-len(ext)]
@@ -259,6 +314,15 @@ func (ts *TorrentSession) load() (err error) {
 		ts.totalPieces++
 	}
 
+	ts.verifier, err = NewPieceVerifier(ts.M, ts.totalPieces)
+	if err != nil {
+		return
+	}
+	ts.pieceSelector, err = NewPieceSelector(ts.flags.PieceSelection, ts.totalPieces)
+	if err != nil {
+		return
+	}
+
 	if ts.flags.MemoryPerTorrent < 0 {
 		ts.maxActivePieces = 2147483640
 		log.Printf("[ %s ] Max Active Pieces set to Unlimited\n", ts.M.Info.Name)
@@ -281,24 +345,16 @@ func (ts *TorrentSession) load() (err error) {
 			return
 		}
 	} else if ts.flags.QuickResume {
-		resumeFilePath := "./" + hex.EncodeToString([]byte(ts.M.InfoHash)) + "-haveBitset"
-		if resumeFile, err := os.Open(resumeFilePath); err == nil {
-			rfstat, _ := resumeFile.Stat()
-			tBA := make([]byte, 2*rfstat.Size())
-			count, _ := resumeFile.Read(tBA)
-			ts.pieceSet = NewBitsetFromBytes(ts.totalPieces, tBA[:count])
-			if ts.pieceSet == nil {
-				return fmt.Errorf("[ %s ] Malformed resume data: %v", ts.M.Info.Name, resumeFilePath)
-			}
-
-			for i := 0; i < ts.totalPieces; i++ {
-				if ts.pieceSet.IsSet(i) {
-					ts.goodPieces++
-				}
-			}
+		if err := ts.LoadResumeData(ts.resumeFilePath()); err == nil {
+			log.Printf("[ %s ] Got piece list from resume data.\n", ts.M.Info.Name)
+		} else if !os.IsNotExist(err) {
+			log.Printf("[ %s ] Couldn't load resume data: %v", ts.M.Info.Name, err)
+		} else if err := ts.LoadHaveBitset(ts.haveBitsetFilePath()); err == nil {
+			// Left by an older version. Resume data takes over from the
+			// next save.
 			log.Printf("[ %s ] Got piece list from haveBitset file.\n", ts.M.Info.Name)
-		} else {
-			log.Printf("[ %s ] Couldn't open haveBitset file: %v", ts.M.Info.Name, err)
+		} else if !os.IsNotExist(err) {
+			log.Printf("[ %s ] Couldn't load haveBitset file: %v", ts.M.Info.Name, err)
 		}
 	}
 
@@ -327,6 +383,13 @@ func (ts *TorrentSession) load() (err error) {
 	}
 
 	ts.Session.HaveTorrent = true
+
+	for _, p := range ts.peers {
+		if err := ts.applyQueuedFast(p); err != nil {
+			log.Println("[", ts.M.Info.Name, "] Closing peer", p.address, "because", err)
+			ts.ClosePeer(p)
+		}
+	}
 	return
 }
 
@@ -341,7 +404,7 @@ func (ts *TorrentSession) fetchTrackerInfo(event string) {
 	m, si := ts.M, ts.Session
 	log.Println("[", ts.M.Info.Name, "] Stats: Uploaded", si.Uploaded, "Downloaded", si.Downloaded, "Left", si.Left)
 	ts.trackerReportChan <- ClientStatusReport{
-		event, m.InfoHash, si.PeerID, si.Port, si.Uploaded, si.Downloaded, si.Left}
+		event, m.InfoHash, si.PeerID, si.Port, si.Uploaded, si.Downloaded, si.Left, si.ExternalIP}
 }
 
 func (ts *TorrentSession) setHeader() {
@@ -352,6 +415,8 @@ func (ts *TorrentSession) setHeader() {
 	}
 	// Support Extension Protocol (BEP-0010)
 	header[25] |= 0x10
+	// Support Fast Extension (BEP-0006)
+	header[27] |= 0x04
 	copy(header[28:48], []byte(ts.M.InfoHash))
 	copy(header[48:68], []byte(ts.Session.PeerID))
 	ts.torrentHeader = header
@@ -361,12 +426,17 @@ func (ts *TorrentSession) Header() (header []byte) {
 	return ts.torrentHeader
 }
 
+type peerHint struct {
+	peer   string
+	source PeerSource
+}
+
 // Try to connect if the peer is not already in our peers.
 // Can be called from any goroutine.
-func (ts *TorrentSession) HintNewPeer(peer string) {
+func (ts *TorrentSession) HintNewPeer(peer string, source PeerSource) {
 	if len(ts.hintNewPeerChan) < cap(ts.hintNewPeerChan) { //We don't want to block the main loop because a single torrent is having problems
 	select {
-	case ts.hintNewPeerChan <- peer:
+	case ts.hintNewPeerChan <- peerHint{peer, source}:
 	case <-ts.ended:
 	}
 	} else {
@@ -374,11 +444,17 @@ func (ts *TorrentSession) HintNewPeer(peer string) {
 	}
 }
 
-func (ts *TorrentSession) tryNewPeer(peer string) bool {
+func (ts *TorrentSession) tryNewPeer(peer string, source PeerSource) bool {
+	if blocked, _ := ts.flags.Blocklist.isBlockedAddr(peer); blocked {
+		return false
+	}
+	if ts.isBanned(peer) {
+		return false
+	}
 	if (ts.Session.HaveTorrent || ts.Session.FromMagnet) && len(ts.peers) < MAX_NUM_PEERS {
 		if _, ok := ts.Session.OurAddresses[peer]; !ok {
 		if _, ok := ts.peers[peer]; !ok {
-			go ts.connectToPeer(peer)
+			go ts.connectToPeer(peer, source)
 			return true
 		}
 		} else {
@@ -388,8 +464,8 @@ func (ts *TorrentSession) tryNewPeer(peer string) bool {
 	return false
 }
 
-func (ts *TorrentSession) connectToPeer(peer string) {
-	conn, err := proxyNetDial(ts.flags.Dial, "tcp", peer)
+func (ts *TorrentSession) connectToPeer(peer string, source PeerSource) {
+	conn, err := ts.dialPeer(peer)
 	if err != nil {
 		// log.Println("[", ts.M.Info.Name, "] Failed to connect to", peer, err)
 		return
@@ -414,11 +490,22 @@ func (ts *TorrentSession) connectToPeer(peer string) {
 		Infohash: peersInfoHash,
 		id:       id,
 		conn:     conn,
+		source:   source,
 	}
 	// log.Println("[", ts.M.Info.Name, "] Connected to", peer)
 	ts.AddPeer(btconn)
 }
 
+// dialPeer tries uTP first, if we use it, then TCP.
+func (ts *TorrentSession) dialPeer(peer string) (conn net.Conn, err error) {
+	if s := ts.flags.utpSocket; s != nil {
+		if conn, err = s.Dial(peer, UTP_CONNECT_TIMEOUT); err == nil {
+			return
+		}
+	}
+	return proxyNetDial(ts.flags.Dial, "tcp", peer)
+}
+
 func (ts *TorrentSession) AcceptNewPeer(btconn *BtConn) {
 	_, err := btconn.conn.Write(ts.Header())
 	if err != nil {
@@ -457,6 +544,12 @@ func (ts *TorrentSession) addPeerImp(btconn *BtConn) {
 		return
 	}
 
+	if ts.isBanned(peer) {
+		log.Println("[", ts.M.Info.Name, "] Rejecting banned peer", peer)
+		btconn.conn.Close()
+		return
+	}
+
 	for _, p := range ts.peers {
 		if p.id == btconn.id {
 			log.Println("[", ts.M.Info.Name, "] Rejecting peer because already have a peer with the same id")
@@ -483,9 +576,17 @@ func (ts *TorrentSession) addPeerImp(btconn *BtConn) {
 		}
 	}
 
-	ps := NewPeerState(btconn.conn)
+	conn := btconn.conn
+	_, overUTP := conn.(*utpConn)
+	if ts.flags.RateLimiter != nil {
+		conn = ts.flags.RateLimiter.Conn(conn)
+	}
+	ps := NewPeerState(conn)
 	ps.address = peer
 	ps.id = btconn.id
+	ps.source = btconn.source
+	ps.fast = theirheader[7]&0x04 == 0x04
+	ps.utp = overUTP
 
 	// By default, a peer has no pieces. If it has pieces, it should send
 	// a BITFIELD message as a first message
@@ -500,9 +601,9 @@ func (ts *TorrentSession) addPeerImp(btconn *BtConn) {
 	go ps.peerReader(ts.peerMessageChan)
 
 	if int(theirheader[5])&0x10 == 0x10 {
-		ps.SendExtensions(ts.Session.Port)
+		ps.SendExtensions(ts.Session.Extensions)
 	} else if ts.pieceSet != nil {
-		ps.SendBitfield(ts.pieceSet)
+		ts.sendHaves(ps)
 	}
 }
 
@@ -512,6 +613,9 @@ func (ts *TorrentSession) ClosePeer(peer *peerState) {
 	}
 
 	//log.Println("[", ts.M.Info.Name, "] Closing peer", peer.address)
+	if ts.pieceSelector != nil && ts.peers[peer.address] == peer {
+		ts.pieceSelector.RemovePeerPieces(peer.have)
+	}
 	_ = ts.removeRequests(peer)
 	peer.Close()
 	delete(ts.peers, peer.address)
@@ -544,6 +648,24 @@ func (ts *TorrentSession) Quit() (err error) {
 	return
 }
 
+// scrape runs in its own goroutine, so a slow tracker doesn't hold up the
+// session.
+func (ts *TorrentSession) scrape() {
+	announceList := ts.M.AnnounceList
+	if announceList == nil {
+		announceList = [][]string{{ts.M.Announce}}
+	}
+	stats, err := scrapeTrackers(ts.flags.Dial, announceList, ts.M.InfoHash)
+	if err != nil {
+		log.Println("[", ts.M.Info.Name, "] Couldn't scrape trackers:", err)
+		return
+	}
+	select {
+	case ts.scrapeChan <- stats:
+	case <-ts.ended:
+	}
+}
+
 func (ts *TorrentSession) Shutdown() (err error) {
 	close(ts.ended)
 
@@ -552,6 +674,12 @@ func (ts *TorrentSession) Shutdown() (err error) {
 		if err != nil {
 			log.Println("[", ts.M.Info.Name, "] Error closing filestore:", err)
 		}
+		// Closing wrote out any pieces a cache was holding back.
+		if ts.flags.QuickResume && ts.Session.HaveTorrent {
+			if err := ts.SaveResumeData(ts.resumeFilePath()); err != nil {
+				log.Println("[", ts.M.Info.Name, "] Couldn't save resume data:", err)
+			}
+		}
 	}
 
 	for _, peer := range ts.peers {
@@ -575,8 +703,10 @@ func (ts *TorrentSession) DoTorrent() {
 	heartbeatChan := time.Tick(heartbeatDuration)
 
 	keepAliveChan := time.Tick(60 * time.Second)
+	pexChan := time.Tick(PEX_INTERVAL)
 	var retrackerChan <-chan time.Time
-	ts.hintNewPeerChan = make(chan string, MAX_NUM_PEERS)
+	var scrapeTicker <-chan time.Time
+	ts.hintNewPeerChan = make(chan peerHint, MAX_NUM_PEERS)
 	ts.addPeerChan = make(chan *BtConn, MAX_NUM_PEERS)
 	if !ts.trackerLessMode {
 		// Start out polling tracker every 20 seconds until we get a response.
@@ -584,11 +714,13 @@ func (ts *TorrentSession) DoTorrent() {
 		retrackerChan = time.Tick(20 * time.Second)
 		ts.trackerInfoChan = make(chan *TrackerResponse)
 		ts.trackerReportChan = make(chan ClientStatusReport)
-		startTrackerClient(ts.flags.Dial, ts.M.Announce, ts.M.AnnounceList, ts.trackerInfoChan, ts.trackerReportChan)
+		startTrackerClient(ts.flags.Dial, ts.M.Announce, ts.M.AnnounceList, ts.trackerURL, ts.trackerID, ts.nextAnnounce, ts.trackerInfoChan, ts.trackerReportChan)
+		scrapeTicker = time.Tick(TRACKER_SCRAPE_INTERVAL)
+		ts.scrapeChan = make(chan ScrapeStats)
 	}
 
 	if ts.Session.UseDHT {
-		ts.dht.PeersRequest(ts.M.InfoHash, true)
+		ts.requestDHTPeers(time.Now())
 	}
 
 	if !ts.trackerLessMode && ts.Session.HaveTorrent {
@@ -600,15 +732,14 @@ func (ts *TorrentSession) DoTorrent() {
 	lastDownloaded := ts.Session.Downloaded
 
 	for {
-		if !ts.execOnSeedingDone && ts.goodPieces == ts.totalPieces {
-			ts.execOnSeeding()
-			ts.execOnSeedingDone = true
+		if !ts.seeding && ts.totalPieces > 0 && ts.goodPieces == ts.totalPieces {
+			ts.startSeeding()
 		}
 		select {
 		case <-ts.chokePolicyHeartbeat:
 			ts.chokePeers()
-		case hintNewPeer := <-ts.hintNewPeerChan:
-			ts.tryNewPeer(hintNewPeer)
+		case hint := <-ts.hintNewPeerChan:
+			ts.tryNewPeer(hint.peer, hint.source)
 		case btconn := <-ts.addPeerChan:
 			ts.addPeerImp(btconn)
 		case <-retrackerChan:
@@ -617,6 +748,12 @@ func (ts *TorrentSession) DoTorrent() {
 			}
 		case ti := <-ts.trackerInfoChan:
 			ts.ti = ti
+			if ti.TrackerId != "" {
+				ts.trackerURL, ts.trackerID = ti.Tracker, ti.TrackerId
+			}
+			ts.health.Seeders = int(ti.Complete)
+			ts.health.Leechers = int(ti.Incomplete)
+			ts.health.Updated = time.Now()
 			log.Println("[", ts.M.Info.Name, "] Torrent has", ts.ti.Complete, "seeders and", ts.ti.Incomplete, "leachers")
 			if !ts.trackerLessMode {
 				newPeerCount := 0
@@ -627,7 +764,7 @@ func (ts *TorrentSession) DoTorrent() {
 						log.Println("[", ts.M.Info.Name, "] Tracker gave us", len(peers)/peerLen, "peers")
 						for i := 0; i < len(peers); i += peerLen {
 							peer := nettools.BinaryToDottedPort(peers[i : i+peerLen])
-							if ts.tryNewPeer(peer) {
+							if ts.tryNewPeer(peer, SourceTracker) {
 								newPeerCount++
 							}
 						}
@@ -643,7 +780,7 @@ func (ts *TorrentSession) DoTorrent() {
 							host := net.IP(peerEntry[0:16])
 							port := int((uint(peerEntry[16]) << 8) | uint(peerEntry[17]))
 							peer := net.JoinHostPort(host.String(), strconv.Itoa(port))
-							if ts.tryNewPeer(peer) {
+							if ts.tryNewPeer(peer, SourceTracker) {
 								newPeerCount++
 							}
 						}
@@ -660,9 +797,18 @@ func (ts *TorrentSession) DoTorrent() {
 			} else if interval > maxInterval {
 				interval = maxInterval
 			}
+			// Announcing more often than this could get us banned.
+			if interval < ts.ti.MinInterval {
+				interval = ts.ti.MinInterval
+			}
 			log.Println("[", ts.M.Info.Name, "] ..checking again in", interval, "seconds")
 			retrackerChan = time.Tick(time.Duration(interval) * time.Second)
+			ts.nextAnnounce = time.Now().Add(time.Duration(interval) * time.Second)
 
+		case <-scrapeTicker:
+			go ts.scrape()
+		case stats := <-ts.scrapeChan:
+			ts.health = TorrentHealth{stats.Complete, stats.Incomplete, stats.Downloaded, time.Now()}
 		case pm := <-ts.peerMessageChan:
 			peer, message := pm.peer, pm.message
 			peer.lastReadTime = time.Now()
@@ -683,9 +829,11 @@ func (ts *TorrentSession) DoTorrent() {
 			}
 			speed := humanSize(float64(ts.Session.Downloaded-lastDownloaded) / heartbeatDuration.Seconds())
 			lastDownloaded = ts.Session.Downloaded
-			log.Printf("[ %s ] Peers: %d downloaded: %d (%s/s) uploaded: %d ratio: %f pieces: %d/%d\n",
+			log.Printf("[ %s ] Peers: %d seeders: %d leechers: %d downloaded: %d (%s/s) uploaded: %d ratio: %f pieces: %d/%d\n",
 				ts.M.Info.Name,
 				len(ts.peers),
+				ts.health.Seeders,
+				ts.health.Leechers,
 				ts.Session.Downloaded,
 				speed,
 				ts.Session.Uploaded,
@@ -698,7 +846,7 @@ func (ts *TorrentSession) DoTorrent() {
 			}
 			if len(ts.peers) < TARGET_NUM_PEERS && (ts.totalPieces == 0 || ts.goodPieces < ts.totalPieces) {
 				if ts.Session.UseDHT {
-					go ts.dht.PeersRequest(ts.M.InfoHash, true)
+					ts.requestDHTPeers(time.Now())
 				}
 				if !ts.trackerLessMode {
 					if ts.ti == nil || ts.ti.Complete > 100 {
@@ -706,6 +854,8 @@ func (ts *TorrentSession) DoTorrent() {
 					}
 				}
 			}
+		case <-pexChan:
+			ts.sendPEX()
 		case <-keepAliveChan:
 			now := time.Now()
 			for _, peer := range ts.peers {
@@ -734,6 +884,57 @@ func (ts *TorrentSession) DoTorrent() {
 	}
 }
 
+// startSeeding is called once we have every piece. We stop downloading, tell
+// the tracker and the DHT we have the whole torrent, and from then on only
+// upload, until we're told to quit or reach the seed ratio.
+func (ts *TorrentSession) startSeeding() {
+	ts.seeding = true
+	log.Println("[", ts.M.Info.Name, "] Download complete, seeding")
+
+	// Only announce completion if we did the downloading, not when we were
+	// started with the whole torrent.
+	if !ts.trackerLessMode && ts.Session.Downloaded > 0 {
+		ts.fetchTrackerInfo("completed")
+	}
+	if ts.Session.UseDHT {
+		ts.lastDHTPeersRequest = time.Now()
+		go ts.dht.PeersRequest(ts.M.InfoHash, true)
+	}
+
+	for _, p := range ts.peers {
+		// Seeds have nothing for us, and want nothing from us.
+		if p.have != nil && p.have.n == ts.totalPieces && p.have.FindNextClear(0) == -1 {
+			ts.ClosePeer(p)
+			continue
+		}
+		// Endgame requests for blocks that came from someone else.
+		for k := range p.our_requests {
+			ts.requestBlockImp(p, int(k>>32), int(k&0xffffffff)/STANDARD_BLOCK_LENGTH, false)
+		}
+		ts.checkInteresting(p)
+	}
+	ts.isEndgame = false
+	ts.activePieces = make(map[int]*ActivePiece)
+	ts.chokePeers()
+
+	if ts.flags.ExecOnSeeding != "" {
+		ts.execOnSeeding()
+	}
+	if ts.flags.OnSeedingStart != nil {
+		ts.flags.OnSeedingStart(ts.M.InfoHash)
+	}
+}
+
+// Ask the DHT for more peers, unless a search for this torrent was started
+// less than DHT_PEERS_REQUEST_INTERVAL ago.
+func (ts *TorrentSession) requestDHTPeers(now time.Time) {
+	if now.Sub(ts.lastDHTPeersRequest) < DHT_PEERS_REQUEST_INTERVAL {
+		return
+	}
+	ts.lastDHTPeersRequest = now
+	go ts.dht.PeersRequest(ts.M.InfoHash, true)
+}
+
 func (ts *TorrentSession) chokePeers() (err error) {
 	// log.Printf("[ %s ] Choking peers", ts.M.Info.Name)
 	peers := ts.peers
@@ -741,12 +942,13 @@ func (ts *TorrentSession) chokePeers() (err error) {
 	for _, peer := range peers {
 		if peer.peer_interested {
 			peer.computeDownloadRate()
+			peer.computeUploadRate()
 			// log.Printf("%s %g bps", peer.address, peer.DownloadBPS())
 			chokers = append(chokers, Choker(peer))
 		}
 	}
 	var unchokeCount int
-	unchokeCount, err = ts.chokePolicy.Choke(chokers)
+	unchokeCount, err = ts.chokePolicy.Choke(chokers, ts.seeding)
 	if err != nil {
 		return
 	}
@@ -766,6 +968,13 @@ func (ts *TorrentSession) RequestBlock(p *peerState) (error) {
 	if !ts.Session.HaveTorrent { // We can't request a block without a torrent
 		return nil
 	}
+	if ts.seeding {
+		return nil
+	}
+	if ts.isEndgame {
+		ts.requestEndgameBlocks(p)
+		return nil
+	}
 
 	for k := range ts.activePieces {
 		if p.have.IsSet(k) {
@@ -800,32 +1009,24 @@ func (ts *TorrentSession) RequestBlock(p *peerState) (error) {
 	}
 	pieceLength := ts.pieceLength(piece)
 	pieceCount := (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
-	ts.activePieces[piece] = &ActivePiece{make([]int, pieceCount), make([]byte, pieceLength)}
-	return ts.RequestBlock2(p, piece, false)
+	ts.activePieces[piece] = &ActivePiece{make([]int, pieceCount), make([]byte, pieceLength), make(map[string]bool)}
+	err := ts.RequestBlock2(p, piece, false)
+	ts.checkEndgame()
+	return err
 }
 
 func (ts *TorrentSession) ChoosePiece(p *peerState) (piece int) {
-	n := ts.totalPieces
-	start := rand.Intn(n)
-	piece = ts.checkRange(p, start, n)
-	if piece == -1 {
-		piece = ts.checkRange(p, 0, start)
-	}
-	return
-}
-
-// checkRange returns the first piece in range start..end that is not in the
-// torrent's pieceSet but is in the peer's pieceSet.
-func (ts *TorrentSession) checkRange(p *peerState, start, end int) (piece int) {
-	clampedEnd := min(end, min(p.have.n, ts.pieceSet.n))
-	for i := start; i < clampedEnd; i++ {
-		if (!ts.pieceSet.IsSet(i)) && p.have.IsSet(i) {
-			if _, ok := ts.activePieces[i]; !ok {
-				return i
-			}
+	candidates := NewBitset(ts.totalPieces)
+	for i := p.have.FindNextSet(0); i >= 0 && i < ts.totalPieces; i = p.have.FindNextSet(i + 1) {
+		if _, ok := ts.activePieces[i]; !ok && !ts.pieceSet.IsSet(i) {
+			candidates.Set(i)
 		}
 	}
-	return -1
+	piece, err := ts.pieceSelector.Next(candidates)
+	if err != nil {
+		return -1
+	}
+	return
 }
 
 func (ts *TorrentSession) RequestBlock2(p *peerState, piece int, endGame bool) (err error) {
@@ -839,6 +1040,71 @@ func (ts *TorrentSession) RequestBlock2(p *peerState, piece int, endGame bool) (
 	return
 }
 
+// checkEndgame starts endgame mode when every missing piece is being
+// downloaded and few are left. From then on unchoked peers are also asked for
+// blocks that other peers are already sending, so a slow peer can't hold up
+// the end of the download. RecordBlock cancels the other requests when a
+// block arrives.
+func (ts *TorrentSession) checkEndgame() {
+	remaining := ts.totalPieces - ts.goodPieces
+	if ts.isEndgame || remaining == 0 || remaining >= ts.endgameThreshold ||
+		len(ts.activePieces) < remaining {
+		return
+	}
+	log.Println("[", ts.M.Info.Name, "] Entering endgame with", remaining, "pieces left")
+	ts.isEndgame = true
+	for _, p := range ts.peers {
+		if !p.peer_choking {
+			ts.requestEndgameBlocks(p)
+		}
+	}
+}
+
+// requestEndgameBlocks fills p's request queue with missing blocks it has
+// that we haven't already asked it for, the least requested ones first, so
+// the duplicates are spread over the peers.
+func (ts *TorrentSession) requestEndgameBlocks(p *peerState) {
+	var blocks []endgameBlock
+	for piece, v := range ts.activePieces {
+		if !p.have.IsSet(piece) {
+			continue
+		}
+		for block, count := range v.downloaderCount {
+			requestIndex := (uint64(piece) << 32) | uint64(block*STANDARD_BLOCK_LENGTH)
+			if _, ok := p.our_requests[requestIndex]; count < 0 || ok {
+				continue
+			}
+			blocks = append(blocks, endgameBlock{piece, block, count})
+		}
+	}
+	sort.Sort(byRequestCount(blocks))
+	for _, b := range blocks {
+		if len(p.our_requests) >= p.maxRequests() {
+			break
+		}
+		ts.activePieces[b.piece].downloaderCount[b.block]++
+		ts.requestBlockImp(p, b.piece, b.block, true)
+	}
+}
+
+type endgameBlock struct {
+	piece, block, requests int
+}
+
+type byRequestCount []endgameBlock
+
+func (a byRequestCount) Len() int      { return len(a) }
+func (a byRequestCount) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byRequestCount) Less(i, j int) bool {
+	if a[i].requests != a[j].requests {
+		return a[i].requests < a[j].requests
+	}
+	if a[i].piece != a[j].piece {
+		return a[i].piece < a[j].piece
+	}
+	return a[i].block < a[j].block
+}
+
 // Request or cancel a block
 func (ts *TorrentSession) requestBlockImp(p *peerState, piece int, block int, request bool) {
 	begin := block * STANDARD_BLOCK_LENGTH
@@ -876,15 +1142,14 @@ func (ts *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32)
 	delete(p.our_requests, requestIndex)
 	v, ok := ts.activePieces[int(piece)]
 	if ok {
-		requestCount := v.recordBlock(int(block))
-		if requestCount > 1 {
-			// Someone else has also requested this, so send cancel notices
-			for _, peer := range ts.peers {
-				if p != peer {
-					if _, ok := peer.our_requests[requestIndex]; ok {
-						ts.requestBlockImp(peer, int(piece), int(block), false)
-						requestCount--
-					}
+		v.senders[p.address] = true
+		v.recordBlock(int(block))
+		// Anyone else who was asked for this block, in endgame or after
+		// running out of pieces, gets a cancel notice.
+		for _, peer := range ts.peers {
+			if p != peer {
+				if _, ok := peer.our_requests[requestIndex]; ok {
+					ts.requestBlockImp(peer, int(piece), int(block), false)
 				}
 			}
 		}
@@ -892,9 +1157,13 @@ func (ts *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32)
 		if v.isComplete() {
 			delete(ts.activePieces, int(piece))
 
-			ok, err = checkPiece(v.buffer, ts.M, int(piece))
-			if !ok || err != nil {
-				log.Println("[", ts.M.Info.Name, "] Closing peer that sent a bad piece", piece, p.id, err)
+			if !ts.verifier.Verify(int(piece), v.buffer) {
+				// The piece is no longer active, so it will be downloaded
+				// again from scratch.
+				log.Println("[", ts.M.Info.Name, "] Closing peer that sent a bad piece", piece, p.id)
+				ts.recordBadPiece(v)
+				// Not every missing piece is in flight any more.
+				ts.isEndgame = false
 				p.Close()
 				return
 			}
@@ -902,8 +1171,11 @@ func (ts *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32)
 			ts.Session.Left -= uint64(len(v.buffer))
 			ts.pieceSet.Set(int(piece))
 			ts.goodPieces++
+			ts.checkEndgame()
 			if ts.flags.QuickResume {
-				ioutil.WriteFile("./"+hex.EncodeToString([]byte(ts.M.InfoHash))+"-haveBitset", ts.pieceSet.Bytes(), 0777)
+				if err := ts.SaveResumeData(ts.resumeFilePath()); err != nil {
+					log.Println("[", ts.M.Info.Name, "] Couldn't save resume data:", err)
+				}
 			}
 			var percentComplete float32
 			if ts.totalPieces > 0 {
@@ -911,12 +1183,6 @@ func (ts *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32)
 			}
 			log.Println("[", ts.M.Info.Name, "] Have", ts.goodPieces, "of", ts.totalPieces,
 				"pieces", percentComplete, "% complete")
-			if ts.goodPieces == ts.totalPieces {
-				if !ts.trackerLessMode {
-					ts.fetchTrackerInfo("completed")
-				}
-				// TODO: Drop connections to all seeders.
-			}
 			for _, p := range ts.peers {
 				if p.have != nil {
 					if int(piece) < p.have.n && p.have.IsSet(int(piece)) {
@@ -938,9 +1204,35 @@ func (ts *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32)
 	return
 }
 
+// recordBadPiece blames every peer that sent part of a piece that failed its
+// hash check. Peers that reach MAX_BAD_PIECES are not let back in.
+func (ts *TorrentSession) recordBadPiece(v *ActivePiece) {
+	for addr := range v.senders {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		ts.badPieces[host]++
+		if ts.badPieces[host] == MAX_BAD_PIECES {
+			log.Println("[", ts.M.Info.Name, "] Banning", host, "for sending", MAX_BAD_PIECES, "bad pieces")
+		}
+	}
+}
+
+// isBanned reports whether the peer at addr sent us MAX_BAD_PIECES bad
+// pieces.
+func (ts *TorrentSession) isBanned(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && ts.badPieces[host] >= MAX_BAD_PIECES
+}
+
 func (ts *TorrentSession) doChoke(p *peerState) (err error) {
 	p.peer_choking = true
-	err = ts.removeRequests(p)
+	// With the Fast Extension a choke doesn't cancel our requests. The peer
+	// rejects the ones it won't serve.
+	if !p.fast {
+		err = ts.removeRequests(p)
+	}
 	return
 }
 
@@ -993,11 +1285,14 @@ func (ts *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 }
 
 func (ts *TorrentSession) extensionMessage(message []byte, p *peerState) (err error) {
-	if message[0] == EXTENSION {
+	switch message[0] {
+	case EXTENSION:
 		err := ts.DoExtension(message[1:], p)
 		if err != nil {
 			log.Printf("[ %s ] Failed extensions for %s: %s\n", ts.M.Info.Name, p.address, err)
 		}
+	case HAVE_ALL, HAVE_NONE, ALLOWED_FAST:
+		err = p.queueFastMessage(message)
 	}
 	return
 }
@@ -1018,7 +1313,7 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 			return errors.New("Unexpected length")
 		}
 		p.peer_choking = false
-		for i := 0; i < MAX_OUR_REQUESTS; i++ {
+		for i := 0; i < p.maxRequests(); i++ {
 			err = ts.RequestBlock(p)
 			if err != nil {
 				return
@@ -1044,7 +1339,12 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		}
 		n := bytesToUint32(message[1:])
 		if n < uint32(p.have.n) {
-			p.have.Set(int(n))
+			if !p.have.IsSet(int(n)) {
+				p.have.Set(int(n))
+				if ts.pieceSelector != nil {
+					ts.pieceSelector.AddPeerPiece(int(n))
+				}
+			}
 			if !p.am_interested && !ts.pieceSet.IsSet(int(n)) {
 				p.SetInterested(true)
 			}
@@ -1056,10 +1356,16 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		if !p.can_receive_bitfield {
 			return errors.New("Late bitfield operation")
 		}
-		p.have = NewBitsetFromBytes(ts.totalPieces, message[1:])
-		if p.have == nil {
+		have := NewBitsetFromBytes(ts.totalPieces, message[1:])
+		if have == nil {
 			return errors.New("Invalid bitfield data")
 		}
+		// A magnet link's piece selector only exists once the metadata does.
+		if ts.pieceSelector != nil {
+			ts.pieceSelector.RemovePeerPieces(p.have)
+			ts.pieceSelector.AddPeerPieces(have)
+		}
+		p.have = have
 		ts.checkInteresting(p)
 	case REQUEST:
 		// log.Println("[", ts.M.Info.Name, "] request", p.address)
@@ -1081,6 +1387,12 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		if int64(begin)+int64(length) > ts.M.Info.PieceLength {
 			return errors.New("begin + length out of range")
 		}
+		if p.am_choking && !p.ourAllowedFast[index] {
+			if p.fast {
+				p.sendRejectRequest(index, begin, length)
+			}
+			return
+		}
 		// TODO: Asynchronous
 		// p.AddRequest(index, begin, length)
 		return ts.sendRequest(p, index, begin, length)
@@ -1116,7 +1428,11 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 
 		p.creditDownload(int64(length))
 		ts.RecordBlock(p, index, begin, uint32(length))
-		err = ts.RequestBlock(p)
+		if p.peer_choking {
+			err = ts.requestAllowedFast(p)
+		} else {
+			err = ts.RequestBlock(p)
+		}
 	case CANCEL:
 		// log.Println("[", ts.M.Info.Name, "] cancel")
 		if len(message) != 13 {
@@ -1148,15 +1464,78 @@ func (ts *TorrentSession) generalMessage(message []byte, p *peerState) (err erro
 		if len(message) != 3 {
 			return fmt.Errorf("Unexpected length for port message: %d", len(message))
 		}
-		go ts.dht.AddNode(p.address)
+		if ts.Session.UseDHT {
+			go ts.dht.AddNode(p.address)
+		}
+	case SUGGEST:
+		if len(message) != 5 {
+			return errors.New("Unexpected length")
+		}
+		// Only a hint, which we don't need: we choose pieces ourselves.
+	case HAVE_ALL, HAVE_NONE:
+		if len(message) != 1 {
+			return errors.New("Unexpected length")
+		}
+		if !p.fast {
+			return errors.New("Fast Extension message from a peer without it")
+		}
+		if !p.can_receive_bitfield {
+			return errors.New("Late have all/none message")
+		}
+		if ts.pieceSelector != nil {
+			ts.pieceSelector.RemovePeerPieces(p.have)
+		}
+		p.have = NewBitset(ts.totalPieces)
+		if messageID == HAVE_ALL {
+			for i := 0; i < ts.totalPieces; i++ {
+				p.have.Set(i)
+			}
+			if ts.pieceSelector != nil {
+				ts.pieceSelector.AddPeerPieces(p.have)
+			}
+		}
+		ts.checkInteresting(p)
+	case REJECT_REQUEST:
+		if len(message) != 13 {
+			return errors.New("Unexpected message length")
+		}
+		if !p.fast {
+			return errors.New("Fast Extension message from a peer without it")
+		}
+		err = ts.doRejectRequest(p, bytesToUint32(message[1:5]), bytesToUint32(message[5:9]))
+	case ALLOWED_FAST:
+		if len(message) != 5 {
+			return errors.New("Unexpected length")
+		}
+		if !p.fast {
+			return errors.New("Fast Extension message from a peer without it")
+		}
+		if !ts.Session.HaveTorrent {
+			// We can't check the index yet.
+			return p.queueFastMessage(message)
+		}
+		n := bytesToUint32(message[1:])
+		if n >= uint32(p.have.n) {
+			return errors.New("allowed fast index is out of range")
+		}
+		p.theirAllowedFast[int(n)] = true
+		if p.peer_choking && p.have.IsSet(int(n)) && !ts.pieceSet.IsSet(int(n)) {
+			p.SetInterested(true)
+			err = ts.requestAllowedFast(p)
+		}
 	case EXTENSION:
+		if len(message) < 2 {
+			return errors.New("Unexpected length")
+		}
 		err := ts.DoExtension(message[1:], p)
 		if err != nil {
 			log.Printf("[ %s ] Failed extensions for %s: %s\n", ts.M.Info.Name, p.address, err)
 		}
 
-		if ts.Session.HaveTorrent {
-			p.SendBitfield(ts.pieceSet)
+		// Our pieces go right after the extension handshake, not after every
+		// extension message.
+		if ts.Session.HaveTorrent && message[1] == EXTENSION_HANDSHAKE {
+			ts.sendHaves(p)
 		}
 	default:
 		return fmt.Errorf("Unknown message id: %d\n", messageID)
@@ -1185,39 +1564,23 @@ func (ts *TorrentSession) DoExtension(msg []byte, p *peerState) (err error) {
 
 	var h ExtensionHandshake
 	if msg[0] == EXTENSION_HANDSHAKE {
-		err = bencode.Unmarshal(bytes.NewReader(msg[1:]), &h)
+		err = bencode.Unmarshal(msg[1:], &h)
 		if err != nil {
 			log.Println("[", ts.M.Info.Name, "] Error when unmarshaling extension handshake")
 			return err
 		}
 
-		p.theirExtensions = make(map[string]int)
-		for name, code := range h.M {
-			p.theirExtensions[name] = code
-		}
+		p.theirExtensions = ts.Session.Extensions.agreed(h.M)
+		p.reqq = int(h.Reqq)
+		p.metadataSize = h.MetadataSize
 
 		if ts.Session.HaveTorrent || ts.Session.ME != nil && ts.Session.ME.Transferring {
 			return
 		}
+		ts.requestMetadata(p)
 
-		// Fill metadata info
-		if h.MetadataSize != uint(0) {
-			nPieces := uint(math.Ceil(float64(h.MetadataSize) / float64(16*1024)))
-			ts.Session.ME.Pieces = make([][]byte, nPieces)
-		}
-
-		if _, ok := p.theirExtensions["ut_metadata"]; ok {
-			ts.Session.ME.Transferring = true
-			p.sendMetadataRequest(0)
-		}
-
-	} else if ext, ok := ts.Session.OurExtensions[int(msg[0])]; ok {
-		switch ext {
-		case "ut_metadata":
-			ts.DoMetadata(msg[1:], p)
-		default:
-			log.Println("[", ts.M.Info.Name, "] Unknown extension: ", ext)
-		}
+	} else if _, handler, ok := ts.Session.Extensions.Lookup(msg[0]); ok {
+		handler(msg[1:], p)
 	} else {
 		log.Println("[", ts.M.Info.Name, "] Unknown extension: ", int(msg[0]))
 	}
@@ -1231,22 +1594,24 @@ type MetadataMessage struct {
 	TotalSize uint  `bencode:"total_size"`
 }
 
-//From bittorrent.org, a bep 9 data message is structured as follows:
-//d8:msg_typei1e5:piecei0e10:total_sizei34256eexxxx
-//xxxx being the piece data
-//So, simplest approach: search for 'ee' as the end of bencoded data
-func getMetadataPiece(msg []byte) ([]byte, error) {
-	for i := 0; i < len(msg)-1; i++ {
-		if msg[i] == 'e' && msg[i+1] == 'e' {
-			return msg[i+2:], nil
-		}
+// requestMetadata starts downloading the metadata from p, if it has it.
+func (ts *TorrentSession) requestMetadata(p *peerState) bool {
+	if _, ok := p.theirExtensions["ut_metadata"]; !ok {
+		return false
 	}
-	return nil, errors.New("Couldn't find an appropriate end to the bencoded message")
+	// Fill metadata info
+	if p.metadataSize != uint(0) {
+		nPieces := uint(math.Ceil(float64(p.metadataSize) / float64(16*1024)))
+		ts.Session.ME.Pieces = make([][]byte, nPieces)
+	}
+	ts.Session.ME.Transferring = true
+	ts.Session.ME.senders = make(map[string]bool)
+	p.sendMetadataRequest(0)
+	return true
 }
 
 func (ts *TorrentSession) DoMetadata(msg []byte, p *peerState) {
-	var message MetadataMessage
-	err := bencode.Unmarshal(bytes.NewReader(msg), &message)
+	message, piece, err := parseMetadataMessage(msg)
 	if err != nil {
 		log.Println("[", ts.M.Info.Name, "] Error when parsing metadata:", err)
 		return
@@ -1262,12 +1627,14 @@ func (ts *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 			return
 		}
 
-		piece, err := getMetadataPiece(msg)
-		if err != nil {
-			log.Println("[", ts.M.Info.Name, "] Error when getting metadata piece: ", err)
+		if message.Piece >= uint(len(ts.Session.ME.Pieces)) {
+			log.Println("[", ts.M.Info.Name, "] Unexpected metadata piece", message.Piece, "from", p.address)
 			return
 		}
 		ts.Session.ME.Pieces[message.Piece] = piece
+		if ts.Session.ME.senders != nil {
+			ts.Session.ME.senders[p.address] = true
+		}
 
 		finished := true
 		for idx, data := range ts.Session.ME.Pieces {
@@ -1293,7 +1660,9 @@ func (ts *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 		sha.Write(b)
 		actual := string(sha.Sum(nil))
 		if actual != ts.M.InfoHash {
-			log.Printf("[ %s ] Invalid metadata; got %x\n", ts.M.Info.Name, actual)
+			log.Printf("[ %s ] Invalid metadata from %s; got %x\n", ts.M.Info.Name, p.address, actual)
+			ts.rejectMetadata()
+			return
 		}
 
 		metadata := string(b)
@@ -1309,8 +1678,33 @@ func (ts *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 	}
 }
 
+// rejectMetadata throws away metadata that failed its hash check, bans the
+// peers that sent it, and starts again from another peer.
+func (ts *TorrentSession) rejectMetadata() {
+	senders := ts.Session.ME.senders
+	ts.Session.ME.Pieces = nil
+	ts.Session.ME.Transferring = false
+	ts.Session.ME.senders = nil
+	for addr := range senders {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		log.Println("[", ts.M.Info.Name, "] Banning", host, "for sending bad metadata")
+		ts.badPieces[host] = MAX_BAD_PIECES
+		if p, ok := ts.peers[addr]; ok {
+			ts.ClosePeer(p)
+		}
+	}
+	for _, p := range ts.peers {
+		if ts.requestMetadata(p) {
+			return
+		}
+	}
+}
+
 func (ts *TorrentSession) sendRequest(peer *peerState, index, begin, length uint32) (err error) {
-	if !peer.am_choking {
+	if !peer.am_choking || peer.ourAllowedFast[index] {
 		// log.Println("[", ts.M.Info.Name, "] Sending block", index, begin, length)
 		buf := make([]byte, length+9)
 		buf[0] = PIECE
@@ -1322,6 +1716,7 @@ func (ts *TorrentSession) sendRequest(peer *peerState, index, begin, length uint
 			return
 		}
 		peer.sendMessage(buf)
+		peer.creditUpload(int64(length))
 		ts.Session.Uploaded += uint64(length)
 	}
 	return
@@ -1340,13 +1735,6 @@ func (ts *TorrentSession) isInteresting(p *peerState) bool {
 	return false
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 func humanSize(value float64) string {
 	switch {
 	case value > 1<<30:
@@ -2,9 +2,12 @@ package torrent
 
 import (
 	"encoding/hex"
+	"errors"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 
 	"github.com/nictuku/dht"
 	"golang.org/x/net/proxy"
@@ -19,9 +22,29 @@ type TorrentFlags struct {
 	UseDHT              bool
 	UseUPnP             bool
 	UseNATPMP           bool
+	UseUTP              bool
 	TrackerlessMode     bool
 	ExecOnSeeding       string
 
+	// Called, on the torrent's goroutine, when a torrent has every piece and
+	// starts seeding.
+	OnSeedingStart func(infoHash string)
+
+	// Local address to listen on for peers and DHT. Nil means all interfaces.
+	BindIP net.IP
+
+	// Comma separated list of DHT routers used to bootstrap the DHT node.
+	// Empty means use the DHT package defaults.
+	DHTRouters string
+
+	// Hard limit on the number of nodes the DHT remembers. Zero means use the
+	// DHT package default.
+	DHTMaxNodes int
+
+	// Limit on the number of peers the DHT remembers for each infohash.
+	// Zero means use the DHT package default.
+	DHTMaxInfoHashPeers int
+
 	// The dial function to use. Nil means use net.Dial
 	Dial proxy.Dialer
 
@@ -37,7 +60,18 @@ type TorrentFlags struct {
 	//Provides cache to each torrent
 	Cacher CacheProvider
 
-	//Whether to write and use *.haveBitset resume data
+	//Which piece to download next: "rarest" (the default if empty),
+	//"sequential" or "random"
+	PieceSelection string
+
+	//Limits download and upload bandwidth, across all torrents. Nil means
+	//unlimited.
+	RateLimiter *RateLimiter
+
+	//Peers we never connect to or accept connections from. Nil means none.
+	Blocklist *Blocklist
+
+	//Whether to write and use *.resume data (see SaveResumeData)
 	QuickResume bool
 
 	//How many torrents should be active at a time
@@ -46,23 +80,44 @@ type TorrentFlags struct {
 	//Maximum amount of memory (in MiB) to use for each torrent's Active Pieces.
 	//0 means a single Active Piece. Negative means Unlimited Active Pieces.
 	MemoryPerTorrent int
+
+	// The uTP socket on our port, if we use uTP. Set by CreateListener.
+	utpSocket *UTPSocket
 }
 
 func RunTorrents(flags *TorrentFlags, torrentFiles []string) (err error) {
-	conChan, listenPort, err := ListenForPeerConnections(flags)
+	if flags.UseUTP && flags.UseDHT {
+		// The DHT opens its own UDP socket, so it can't share our port with
+		// uTP, and on any other port it would announce the wrong one.
+		return errors.New("uTP and DHT can't be used together: both need UDP on the peer port")
+	}
+	conChan, listenPort, nat, err := ListenForPeerConnections(flags)
 	if err != nil {
 		log.Println("Couldn't listen for peers connection: ", err)
 		return
 	}
+	if nat != nil {
+		defer nat.Close()
+	}
+	if flags.utpSocket != nil {
+		defer flags.utpSocket.Close()
+	}
 	quitChan := listenSigInt()
 
 	createChan := make(chan string, flags.MaxActive)
 	startChan := make(chan *TorrentSession, 1)
 	doneChan := make(chan *TorrentSession, 1)
 
-	var dhtNode dht.DHT
+	// dhtPeersChan stays nil, and so never fires, when DHT is not in use.
+	var dhtNode *dht.DHT
+	var dhtPeersChan chan map[dht.InfoHash][]string
 	if flags.UseDHT {
-		dhtNode = *startDHT(flags.Port)
+		dhtNode = startDHT(flags)
+		if dhtNode != nil {
+			dhtPeersChan = dhtNode.PeersRequestResults
+		} else {
+			flags.UseDHT = false
+		}
 	}
 
 	torrentSessions := make(map[string]*TorrentSession)
@@ -94,11 +149,16 @@ func RunTorrents(flags *TorrentFlags, torrentFiles []string) (err error) {
 	}
 
 	lpd := &Announcer{}
+	if flags.UseLPD && viaProxy(flags.Dial) {
+		log.Println("Not using Local Peer Discovery, its multicasts can't go through the proxy")
+		flags.UseLPD = false
+	}
 	if flags.UseLPD {
-		lpd, err = NewAnnouncer(uint16(listenPort))
-		if err != nil {
-			log.Println("Couldn't listen for Local Peer Discoveries: ", err)
+		if l, lerr := NewAnnouncer(uint16(listenPort)); lerr != nil {
+			log.Println("Couldn't listen for Local Peer Discoveries: ", lerr)
 			flags.UseLPD = false
+		} else {
+			lpd = l
 		}
 	}
 
@@ -108,7 +168,13 @@ mainLoop:
 		select {
 		case ts := <-startChan:
 			if !theWorldisEnding {
-				ts.dht = &dhtNode
+				ts.dht = dhtNode
+				if nat != nil && nat.ExternalIP() != nil {
+					// So a tracker handing us our own address doesn't make us
+					// connect to ourselves.
+					ts.Session.OurAddresses[net.JoinHostPort(nat.ExternalIP().String(), strconv.Itoa(nat.ExternalPort()))] = true
+					ts.Session.ExternalIP = nat.ExternalIP()
+				}
 				if flags.UseLPD {
 					lpd.Announce(ts.M.InfoHash)
 				}
@@ -145,13 +211,16 @@ mainLoop:
 			if ts, ok := torrentSessions[c.Infohash]; ok {
 				ts.AcceptNewPeer(c)
 			}
-		case dhtPeers := <-dhtNode.PeersRequestResults:
+		case dhtPeers := <-dhtPeersChan:
 			for key, peers := range dhtPeers {
 				if ts, ok := torrentSessions[string(key)]; ok {
 					// log.Printf("Received %d DHT peers for torrent session %x\n", len(peers), []byte(key))
 					for _, peer := range peers {
-						peer = dht.DecodePeerAddress(peer)
-						ts.HintNewPeer(peer)
+						ip, port, err := ParsePeerContact(peer)
+						if err != nil {
+							continue
+						}
+						ts.HintNewPeer(net.JoinHostPort(ip.String(), strconv.Itoa(port)), SourceDHT)
 					}
 				} else {
 					log.Printf("Received DHT peer for an unknown torrent session %x\n", []byte(key))
@@ -164,11 +233,12 @@ mainLoop:
 			}
 			if ts, ok := torrentSessions[string(hexhash)]; ok {
 				// log.Printf("Received LPD announce for ih %s", announce.Infohash)
-				ts.HintNewPeer(announce.Peer)
+				ts.HintNewPeer(announce.Peer, SourceLPD)
 			}
 		}
 	}
-	if flags.UseDHT {
+	if dhtNode != nil {
+		// Stops the DHT goroutines and closes its UDP socket.
 		dhtNode.Stop()
 	}
 	return
@@ -180,11 +250,26 @@ func listenSigInt() chan os.Signal {
 	return c
 }
 
-func startDHT(listenPort int) *dht.DHT {
-	// TODO: UPnP UDP port mapping.
+func startDHT(flags *TorrentFlags) *dht.DHT {
 	cfg := dht.NewConfig()
-	cfg.Port = listenPort
+	if flags.BindIP != nil {
+		cfg.Address = flags.BindIP.String()
+	}
+	// By now flags.Port holds the port the peer listener actually bound,
+	// even when 0 was requested, so the DHT shares it.
+	cfg.Port = flags.Port
 	cfg.NumTargetPeers = TARGET_NUM_PEERS
+	if flags.DHTRouters != "" {
+		// The DHT node pings every router in the list and only needs one of
+		// them to answer to join the network.
+		cfg.DHTRouters = flags.DHTRouters
+	}
+	if flags.DHTMaxNodes > 0 {
+		cfg.MaxNodes = flags.DHTMaxNodes
+	}
+	if flags.DHTMaxInfoHashPeers > 0 {
+		cfg.MaxInfoHashPeers = flags.DHTMaxInfoHashPeers
+	}
 	dhtnode, err := dht.New(cfg)
 	if err != nil {
 		log.Println("DHT node creation error:", err)
@@ -0,0 +1,145 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEndgame(t *testing.T) {
+	const blocks = 4
+	ts := &TorrentSession{
+		M:                &MetaInfo{Info: InfoDict{PieceLength: blocks * STANDARD_BLOCK_LENGTH}},
+		Session:          SessionInfo{HaveTorrent: true},
+		peers:            make(map[string]*peerState),
+		activePieces:     make(map[int]*ActivePiece),
+		totalPieces:      3,
+		lastPieceLength:  blocks * STANDARD_BLOCK_LENGTH,
+		goodPieces:       1,
+		endgameThreshold: 3,
+	}
+	newActivePiece := func() *ActivePiece {
+		return &ActivePiece{make([]int, blocks), make([]byte, blocks*STANDARD_BLOCK_LENGTH), make(map[string]bool)}
+	}
+	var peers []*peerState
+	for _, addr := range []string{"10.0.0.1:1", "10.0.0.2:2", "10.0.0.3:3"} {
+		p := NewPeerState(nil)
+		p.address = addr
+		p.have = bitsetOf(3, 0, 1, 2)
+		p.peer_choking = false
+		ts.peers[addr] = p
+		peers = append(peers, p)
+	}
+	// The third peer is choking us.
+	peers[2].peer_choking = true
+
+	// Piece 1 is half done, the first peer has the rest of it. Piece 2 is
+	// missing and not being downloaded, so it's not endgame yet.
+	ts.activePieces[1] = newActivePiece()
+	ts.activePieces[1].downloaderCount = []int{-1, -1, 1, 1}
+	ts.requestBlockImp(peers[0], 1, 2, true)
+	ts.requestBlockImp(peers[0], 1, 3, true)
+	ts.checkEndgame()
+	if ts.isEndgame {
+		t.Fatal("endgame started with a piece not in flight")
+	}
+
+	ts.activePieces[2] = newActivePiece()
+	ts.checkEndgame()
+	if !ts.isEndgame {
+		t.Fatal("endgame didn't start")
+	}
+	// The first peer's queue is already full. The second gets the blocks
+	// nobody has been asked for yet, up to its own limit.
+	if len(peers[0].our_requests) != MAX_OUR_REQUESTS {
+		t.Errorf("%v has %d requests, want %d", peers[0].address, len(peers[0].our_requests), MAX_OUR_REQUESTS)
+	}
+	if len(peers[1].our_requests) != MAX_OUR_REQUESTS {
+		t.Errorf("%v has %d requests, want %d", peers[1].address, len(peers[1].our_requests), MAX_OUR_REQUESTS)
+	}
+	for requestIndex := range peers[1].our_requests {
+		if requestIndex>>32 != 2 {
+			t.Errorf("%v was asked for a block of piece %d", peers[1].address, requestIndex>>32)
+		}
+	}
+	if len(peers[2].our_requests) != 0 {
+		t.Errorf("choking peer was sent %d requests", len(peers[2].our_requests))
+	}
+
+	// Once piece 2 is all asked for, duplicates of piece 1 follow.
+	ts.RecordBlock(peers[1], 2, 0, STANDARD_BLOCK_LENGTH)
+	ts.RecordBlock(peers[1], 2, STANDARD_BLOCK_LENGTH, STANDARD_BLOCK_LENGTH)
+	ts.RequestBlock(peers[1])
+	ts.RecordBlock(peers[1], 2, 2*STANDARD_BLOCK_LENGTH, STANDARD_BLOCK_LENGTH)
+	ts.RequestBlock(peers[1])
+	if got := ts.activePieces[1].downloaderCount; got[2] != 2 {
+		t.Errorf("piece 1 downloader counts = %v", got)
+	}
+
+	// When a block arrives, the other peer's request for it is cancelled.
+	ts.RecordBlock(peers[1], 1, 2*STANDARD_BLOCK_LENGTH, STANDARD_BLOCK_LENGTH)
+	if _, ok := peers[0].our_requests[1<<32|2*STANDARD_BLOCK_LENGTH]; ok {
+		t.Error("duplicate request was not cancelled")
+	}
+}
+
+func TestStartSeeding(t *testing.T) {
+	var seeding []string
+	ts := &TorrentSession{
+		flags: &TorrentFlags{OnSeedingStart: func(infoHash string) {
+			seeding = append(seeding, infoHash)
+		}},
+		M:               &MetaInfo{InfoHash: "ih", Info: InfoDict{PieceLength: STANDARD_BLOCK_LENGTH}},
+		Session:         SessionInfo{HaveTorrent: true},
+		peers:           make(map[string]*peerState),
+		activePieces:    make(map[int]*ActivePiece),
+		chokePolicy:     &ClassicChokePolicy{},
+		trackerLessMode: true,
+		totalPieces:     2,
+		lastPieceLength: STANDARD_BLOCK_LENGTH,
+		goodPieces:      2,
+		pieceSet:        bitsetOf(2, 0, 1),
+	}
+	addPeer := func(addr string, have ...int) *peerState {
+		c, _ := net.Pipe()
+		p := NewPeerState(c)
+		p.address = addr
+		p.have = bitsetOf(2, have...)
+		p.am_interested = true
+		ts.peers[addr] = p
+		return p
+	}
+	seed := addPeer("10.0.0.1:1", 0, 1)
+	leech := addPeer("10.0.0.2:2", 1)
+	// Left over from endgame.
+	ts.requestBlockImp(leech, 1, 0, true)
+
+	ts.startSeeding()
+	if !ts.seeding || len(seeding) != 1 || seeding[0] != "ih" {
+		t.Fatalf("seeding %v, OnSeedingStart calls %v", ts.seeding, seeding)
+	}
+	if _, ok := ts.peers[seed.address]; ok {
+		t.Error("still connected to a seed")
+	}
+	if len(leech.our_requests) != 0 || leech.am_interested {
+		t.Errorf("leech: %d requests, interested %v", len(leech.our_requests), leech.am_interested)
+	}
+	if err := ts.RequestBlock(leech); err != nil || len(leech.our_requests) != 0 {
+		t.Errorf("requested blocks while seeding")
+	}
+}
+
+func TestBannedPeerNotDialed(t *testing.T) {
+	ts := &TorrentSession{
+		flags:     &TorrentFlags{},
+		M:         &MetaInfo{},
+		Session:   SessionInfo{HaveTorrent: true},
+		peers:     make(map[string]*peerState),
+		badPieces: map[string]int{"10.0.0.1": MAX_BAD_PIECES, "10.0.0.2": MAX_BAD_PIECES - 1},
+	}
+	if ts.tryNewPeer("10.0.0.1:6881", SourceTracker) {
+		t.Error("dialed a banned peer")
+	}
+	if ts.isBanned("10.0.0.2:6881") {
+		t.Error("banned a peer before it reached MAX_BAD_PIECES")
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -17,8 +19,11 @@ import (
 
 // Code to talk to trackers.
 // Implements:
-//  BEP 12 Multitracker Metadata Extension
+//  BEP 12 Multitracker Metadata Extension: trackers are tried tier by tier,
+//   in random order within a tier. The one that answers moves to the front
+//   of its tier. Trackers that fail are left alone for a while.
 //  BEP 15 UDP Tracker Protocol
+//  BEP 48 Tracker Protocol Extension: Scrape
 
 type ClientStatusReport struct {
 	Event      string
@@ -28,9 +33,14 @@ type ClientStatusReport struct {
 	Uploaded   uint64
 	Downloaded uint64
 	Left       uint64
+	// Our address as the NAT gateway sees it, if we know it.
+	ExternalIP net.IP
 }
 
-func startTrackerClient(dialer proxy.Dialer, announce string, announceList [][]string, trackerInfoChan chan *TrackerResponse, reports chan ClientStatusReport) {
+// The tracker ID from an earlier run is echoed back to the tracker it came
+// from, if there is one. Regular announces, those without an event, are
+// held back until nextAnnounce, which an earlier run was told to wait for.
+func startTrackerClient(dialer proxy.Dialer, announce string, announceList [][]string, tracker, trackerID string, nextAnnounce time.Time, trackerInfoChan chan *TrackerResponse, reports chan ClientStatusReport) {
 	if announce != "" && announceList == nil {
 		// Convert the plain announce into an announceList to simplify logic
 		announceList = [][]string{[]string{announce}}
@@ -39,6 +49,9 @@ func startTrackerClient(dialer proxy.Dialer, announce string, announceList [][]s
 	if announceList != nil {
 		announceList = shuffleAnnounceList(announceList)
 	}
+	if viaProxy(dialer) {
+		announceList = withoutUDPTrackers(announceList)
+	}
 
 	// Discard status old status reports if they are produced more quickly than they can
 	// be consumed.
@@ -62,8 +75,15 @@ func startTrackerClient(dialer proxy.Dialer, announce string, announceList [][]s
 	}()
 
 	go func() {
+		states := make(map[string]*trackerState)
+		if tracker != "" && trackerID != "" {
+			states[tracker] = &trackerState{trackerID: trackerID}
+		}
 		for report := range recentReports {
-			tr := queryTrackers(dialer, announceList, report)
+			if report.Event == "" && time.Now().Before(nextAnnounce) {
+				continue
+			}
+			tr := queryTrackers(dialer, announceList, states, report)
 			if tr != nil {
 				trackerInfoChan <- tr
 			}
@@ -71,6 +91,25 @@ func startTrackerClient(dialer proxy.Dialer, announce string, announceList [][]s
 	}()
 }
 
+// withoutUDPTrackers drops the UDP trackers from announceList. They can't be
+// reached through a proxy, and going around it would give our address away.
+func withoutUDPTrackers(announceList [][]string) (result [][]string) {
+	for _, level := range announceList {
+		var kept []string
+		for _, tracker := range level {
+			if strings.HasPrefix(tracker, "udp:") {
+				log.Println("Not using UDP tracker", tracker, "through the proxy")
+				continue
+			}
+			kept = append(kept, tracker)
+		}
+		if len(kept) > 0 {
+			result = append(result, kept)
+		}
+	}
+	return
+}
+
 // Deep copy announcelist and shuffle each level.
 func shuffleAnnounceList(announceList [][]string) (result [][]string) {
 	result = make([][]string, len(announceList))
@@ -90,25 +129,80 @@ func shuffleAnnounceListLevel(level []string) (shuffled []string) {
 	return
 }
 
-func queryTrackers(dialer proxy.Dialer, announceList [][]string, report ClientStatusReport) (tr *TrackerResponse) {
+const (
+	// How long we wait before trying a tracker that is down again. Doubles
+	// with each failure.
+	TRACKER_MIN_BACKOFF = time.Second
+	TRACKER_MAX_BACKOFF = 30 * time.Minute
+	// How many HTTP redirects we follow for one announce.
+	TRACKER_MAX_REDIRECTS = 5
+)
+
+// What we remember about a tracker from one announce to the next.
+type trackerState struct {
+	// Echoed back on every announce, if the tracker gave us one.
+	trackerID string
+	// Consecutive failures, and when we may try again.
+	failures int
+	retryAt  time.Time
+}
+
+func (s *trackerState) failed(now time.Time) {
+	backoff := TRACKER_MAX_BACKOFF
+	if s.failures < 30 && TRACKER_MIN_BACKOFF<<uint(s.failures) < TRACKER_MAX_BACKOFF {
+		backoff = TRACKER_MIN_BACKOFF << uint(s.failures)
+	}
+	s.failures++
+	s.retryAt = now.Add(backoff)
+}
+
+func (s *trackerState) succeeded(tr *TrackerResponse) {
+	s.failures = 0
+	s.retryAt = time.Time{}
+	if tr.TrackerId != "" {
+		s.trackerID = tr.TrackerId
+	}
+}
+
+func queryTrackers(dialer proxy.Dialer, announceList [][]string, states map[string]*trackerState, report ClientStatusReport) (tr *TrackerResponse) {
 	for _, level := range announceList {
 		for i, tracker := range level {
+			state := states[tracker]
+			if state == nil {
+				state = &trackerState{}
+				states[tracker] = state
+			}
+			now := time.Now()
+			if now.Before(state.retryAt) {
+				continue
+			}
 			var err error
-			tr, err = queryTracker(dialer, report, tracker)
-			if err == nil {
-				// Move successful tracker to front of slice for next announcement
-				// cycle.
-				copy(level[1:i+1], level[0:i])
-				level[0] = tracker
-				return
+			tr, err = queryTracker(dialer, report, tracker, state)
+			if err != nil {
+				// Whether it's down or refusing us, asking again right away
+				// won't help.
+				state.failed(now)
+				what := "refused us"
+				if isTrackerUnavailable(err) {
+					what = "is unavailable"
+				}
+				log.Println("Tracker", tracker, what, "("+err.Error()+"),", state.failures, "times in a row, not trying it again for", state.retryAt.Sub(now))
+				continue
 			}
+			state.succeeded(tr)
+			tr.Tracker = tracker
+			// Move successful tracker to front of slice for next announcement
+			// cycle.
+			copy(level[1:i+1], level[0:i])
+			level[0] = tracker
+			return
 		}
 	}
 	log.Println("Error: Did not successfully contact a tracker:", announceList)
-	return
+	return nil
 }
 
-func queryTracker(dialer proxy.Dialer, report ClientStatusReport, trackerUrl string) (tr *TrackerResponse, err error) {
+func queryTracker(dialer proxy.Dialer, report ClientStatusReport, trackerUrl string, state *trackerState) (tr *TrackerResponse, err error) {
 	u, err := url.Parse(trackerUrl)
 	if err != nil {
 		log.Println("Error: Invalid announce URL(", trackerUrl, "):", err)
@@ -118,7 +212,7 @@ func queryTracker(dialer proxy.Dialer, report ClientStatusReport, trackerUrl str
 	case "http":
 		fallthrough
 	case "https":
-		return queryHTTPTracker(dialer, report, u)
+		return queryHTTPTracker(dialer, report, u, state)
 	case "udp":
 		return queryUDPTracker(report, u)
 	default:
@@ -128,7 +222,7 @@ func queryTracker(dialer proxy.Dialer, report ClientStatusReport, trackerUrl str
 	}
 }
 
-func queryHTTPTracker(dialer proxy.Dialer, report ClientStatusReport, u *url.URL) (tr *TrackerResponse, err error) {
+func queryHTTPTracker(dialer proxy.Dialer, report ClientStatusReport, u *url.URL, state *trackerState) (tr *TrackerResponse, err error) {
 	uq := u.Query()
 	uq.Add("info_hash", report.InfoHash)
 	uq.Add("peer_id", report.PeerID)
@@ -137,6 +231,9 @@ func queryHTTPTracker(dialer proxy.Dialer, report ClientStatusReport, u *url.URL
 	uq.Add("downloaded", strconv.FormatUint(report.Downloaded, 10))
 	uq.Add("left", strconv.FormatUint(report.Left, 10))
 	uq.Add("compact", "1")
+	if report.ExternalIP != nil {
+		uq.Add("ip", report.ExternalIP.String())
+	}
 
 	// Don't report IPv6 address, the user might prefer to keep
 	// that information private when communicating with IPv4 hosts.
@@ -151,6 +248,9 @@ func queryHTTPTracker(dialer proxy.Dialer, report ClientStatusReport, u *url.URL
 	if report.Event != "" {
 		uq.Add("event", report.Event)
 	}
+	if state.trackerID != "" {
+		uq.Add("trackerid", state.trackerID)
+	}
 
 	// This might reorder the existing query string in the Announce url
 	// This might break some broken trackers that don't parse URLs properly.
@@ -163,167 +263,230 @@ func queryHTTPTracker(dialer proxy.Dialer, report ClientStatusReport, u *url.URL
 	} else if tr.FailureReason != "" {
 		log.Println("Error: Tracker returned failure reason:", tr.FailureReason)
 		err = fmt.Errorf("tracker failure %s", tr.FailureReason)
+	} else if tr.WarningMessage != "" {
+		log.Println("Tracker", u.Host, "warns:", tr.WarningMessage)
 	}
 	return
 }
 
-func findLocalIPV6AddressFor(hostAddr string) (local string, err error) {
-	// Figure out our IPv6 address to talk to a given host.
-	host, hostPort, err := net.SplitHostPort(hostAddr)
+// HTTPTrackerClient scrapes an HTTP tracker. Announces go through
+// queryHTTPTracker.
+type HTTPTrackerClient struct {
+	dialer    proxy.Dialer
+	scrapeURL *url.URL
+}
+
+// NewHTTPTrackerClient creates a client for the tracker with the given
+// announce URL. It fails if the tracker doesn't support scrape.
+func NewHTTPTrackerClient(dialer proxy.Dialer, announce string) (c *HTTPTrackerClient, err error) {
+	u, err := scrapeURL(announce)
 	if err != nil {
-		host = hostAddr
-		hostPort = "1234"
+		return
 	}
-	dummyAddr := net.JoinHostPort(host, hostPort)
-	log.Println("Looking for host ", dummyAddr)
-	conn, err := net.Dial("udp6", dummyAddr)
+	c = &HTTPTrackerClient{dialer: dialer, scrapeURL: u}
+	return
+}
+
+// scrapeURL finds a tracker's scrape URL the usual way: by replacing
+// "announce" at the start of the last path segment with "scrape".
+func scrapeURL(announce string) (u *url.URL, err error) {
+	u, err = url.Parse(announce)
 	if err != nil {
-		log.Println("No IPV6 for host ", host, err)
-		return "", err
+		return
 	}
-	defer conn.Close()
-	localAddr := conn.LocalAddr()
-	local, _, err = net.SplitHostPort(localAddr.String())
-	if err != nil {
-		local = localAddr.String()
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return nil, fmt.Errorf("Tracker %v doesn't support scrape", announce)
 	}
+	u.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
 	return
 }
 
-func queryUDPTracker(report ClientStatusReport, u *url.URL) (tr *TrackerResponse, err error) {
-	serverAddr, err := net.ResolveUDPAddr("udp", u.Host)
+type httpScrapeResponse struct {
+	FailureReason string `bencode:"failure reason"`
+	Files         map[string]ScrapeStats
+}
+
+// Scrape asks the tracker for swarm statistics for all of infoHashes in one
+// request. Torrents the tracker doesn't know are left out of stats.
+func (c *HTTPTrackerClient) Scrape(infoHashes []string) (stats map[string]ScrapeStats, err error) {
+	u := *c.scrapeURL
+	uq := u.Query()
+	for _, ih := range infoHashes {
+		uq.Add("info_hash", ih)
+	}
+	u.RawQuery = uq.Encode()
+
+	var response httpScrapeResponse
+	err = getTrackerResponse(c.dialer, u.String(), &response)
 	if err != nil {
 		return
 	}
-	con, err := net.DialUDP("udp", nil, serverAddr)
-	if err != nil {
+	if response.FailureReason != "" {
+		err = fmt.Errorf("tracker failure %s", response.FailureReason)
 		return
 	}
-	defer func() { con.Close() }()
+	stats = make(map[string]ScrapeStats)
+	for _, ih := range infoHashes {
+		if s, ok := response.Files[ih]; ok {
+			stats[ih] = s
+		}
+	}
+	return
+}
+
+// scrapeTrackers returns the swarm statistics for one torrent from the
+// first tracker in announceList that will give them.
+func scrapeTrackers(dialer proxy.Dialer, announceList [][]string, infoHash string) (stats ScrapeStats, err error) {
+	err = errors.New("No tracker to scrape")
+	for _, level := range announceList {
+		for _, tracker := range level {
+			stats, err = scrapeTracker(dialer, tracker, infoHash)
+			if err == nil {
+				return
+			}
+		}
+	}
+	return
+}
 
-	var connectionID uint64
-	for retry := uint(0); retry < uint(8); retry++ {
-		err = con.SetDeadline(time.Now().Add(15 * (1 << retry) * time.Second))
+func scrapeTracker(dialer proxy.Dialer, tracker string, infoHash string) (stats ScrapeStats, err error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return
+	}
+	switch u.Scheme {
+	case "http", "https":
+		var c *HTTPTrackerClient
+		c, err = NewHTTPTrackerClient(dialer, tracker)
 		if err != nil {
 			return
 		}
-
-		connectionID, err = connectToUDPTracker(con)
-		if err == nil {
-			break
+		var m map[string]ScrapeStats
+		m, err = c.Scrape([]string{infoHash})
+		if err != nil {
+			return
 		}
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-			continue
+		var ok bool
+		if stats, ok = m[infoHash]; !ok {
+			err = fmt.Errorf("Tracker %v doesn't know the torrent", tracker)
+		}
+	case "udp":
+		if viaProxy(dialer) {
+			err = fmt.Errorf("Can't scrape UDP tracker %v through the proxy", tracker)
+			return
 		}
+		var c *UDPTrackerClient
+		c, err = NewUDPTrackerClient(u.Host)
 		if err != nil {
 			return
 		}
+		var s []ScrapeStats
+		s, err = c.Scrape([]string{infoHash})
+		if err == nil {
+			stats = s[0]
+		}
+	default:
+		err = fmt.Errorf("Unknown scheme %v in %v", u.Scheme, tracker)
 	}
-
-	return getAnnouncementFromUDPTracker(con, connectionID, report)
+	return
 }
 
-func connectToUDPTracker(con *net.UDPConn) (connectionID uint64, err error) {
-	var connectionRequest_connectionID uint64 = 0x41727101980
-	var action uint32 = 0
-	transactionID := rand.Uint32()
-
-	connectionRequest := new(bytes.Buffer)
-	err = binary.Write(connectionRequest, binary.BigEndian, connectionRequest_connectionID)
+func findLocalIPV6AddressFor(hostAddr string) (local string, err error) {
+	// Figure out our IPv6 address to talk to a given host.
+	host, hostPort, err := net.SplitHostPort(hostAddr)
 	if err != nil {
-		return
+		host = hostAddr
+		hostPort = "1234"
 	}
-	err = binary.Write(connectionRequest, binary.BigEndian, action)
+	dummyAddr := net.JoinHostPort(host, hostPort)
+	log.Println("Looking for host ", dummyAddr)
+	conn, err := net.Dial("udp6", dummyAddr)
 	if err != nil {
-		return
+		log.Println("No IPV6 for host ", host, err)
+		return "", err
 	}
-	err = binary.Write(connectionRequest, binary.BigEndian, transactionID)
+	defer conn.Close()
+	localAddr := conn.LocalAddr()
+	local, _, err = net.SplitHostPort(localAddr.String())
 	if err != nil {
-		return
+		local = localAddr.String()
 	}
+	return
+}
 
-	_, err = con.Write(connectionRequest.Bytes())
+func queryUDPTracker(report ClientStatusReport, u *url.URL) (tr *TrackerResponse, err error) {
+	client, err := NewUDPTrackerClient(u.Host)
 	if err != nil {
 		return
 	}
+	_, tr, err = client.Announce(report)
+	return
+}
 
-	connectionResponseBytes := make([]byte, 16)
+const (
+	// BEP 15 lets a client reuse a connection ID for up to a minute.
+	UDP_CONNECTION_ID_LIFETIME = time.Minute
+	// Each try waits 15 * 2^n seconds for a reply.
+	UDP_TRACKER_TRIES   = 3
+	UDP_TRACKER_TIMEOUT = 15 * time.Second
+	// Peers requested per announce.
+	UDP_TRACKER_NUM_WANT = 50
+)
 
-	var connectionResponseLen int
-	connectionResponseLen, err = con.Read(connectionResponseBytes)
-	if err != nil {
-		return
-	}
-	if connectionResponseLen != 16 {
-		err = fmt.Errorf("Unexpected response size %d", connectionResponseLen)
-		return
-	}
-	connectionResponse := bytes.NewBuffer(connectionResponseBytes)
-	var connectionResponseAction uint32
-	err = binary.Read(connectionResponse, binary.BigEndian, &connectionResponseAction)
-	if err != nil {
-		return
-	}
-	if connectionResponseAction != 0 {
-		err = fmt.Errorf("Unexpected response action %d", connectionResponseAction)
-		return
-	}
-	var connectionResponseTransactionID uint32
-	err = binary.Read(connectionResponse, binary.BigEndian, &connectionResponseTransactionID)
-	if err != nil {
-		return
-	}
-	if connectionResponseTransactionID != transactionID {
-		err = fmt.Errorf("Unexpected response transactionID %x != %x",
-			connectionResponseTransactionID, transactionID)
-		return
-	}
+const (
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+)
 
-	err = binary.Read(connectionResponse, binary.BigEndian, &connectionID)
-	if err != nil {
-		return
-	}
-	return
+// Magic connection ID sent in connect requests.
+const udpProtocolID = 0x41727101980
+
+// Swarm statistics for one torrent, as reported by a tracker scrape.
+type ScrapeStats struct {
+	Complete   int // Seeders
+	Incomplete int // Leechers
+	Downloaded int // Times the torrent has been completely downloaded
 }
 
-func getAnnouncementFromUDPTracker(con *net.UDPConn, connectionID uint64, report ClientStatusReport) (tr *TrackerResponse, err error) {
-	transactionID := rand.Uint32()
+type udpConnectionID struct {
+	id      uint64
+	expires time.Time
+}
 
-	announcementRequest := new(bytes.Buffer)
-	err = binary.Write(announcementRequest, binary.BigEndian, connectionID)
-	if err != nil {
-		return
-	}
-	var action uint32 = 1
-	err = binary.Write(announcementRequest, binary.BigEndian, action)
-	if err != nil {
-		return
-	}
-	err = binary.Write(announcementRequest, binary.BigEndian, transactionID)
-	if err != nil {
-		return
-	}
-	err = binary.Write(announcementRequest, binary.BigEndian, []byte(report.InfoHash))
-	if err != nil {
-		return
-	}
-	err = binary.Write(announcementRequest, binary.BigEndian, []byte(report.PeerID))
-	if err != nil {
-		return
-	}
-	err = binary.Write(announcementRequest, binary.BigEndian, report.Downloaded)
-	if err != nil {
-		return
-	}
-	err = binary.Write(announcementRequest, binary.BigEndian, report.Left)
+// Connection IDs for recently contacted UDP trackers, by tracker address.
+var udpConnectionIDs = struct {
+	sync.Mutex
+	m map[string]udpConnectionID
+}{m: make(map[string]udpConnectionID)}
+
+// UDPTrackerClient talks to a tracker using the BEP 15 UDP tracker protocol.
+type UDPTrackerClient struct {
+	addr *net.UDPAddr
+	// Base timeout for the first try. Doubles on each retry.
+	timeout time.Duration
+}
+
+// NewUDPTrackerClient creates a client for the tracker at host:port.
+func NewUDPTrackerClient(hostPort string) (c *UDPTrackerClient, err error) {
+	addr, err := net.ResolveUDPAddr("udp", hostPort)
 	if err != nil {
 		return
 	}
-	err = binary.Write(announcementRequest, binary.BigEndian, report.Uploaded)
-	if err != nil {
+	c = &UDPTrackerClient{addr: addr, timeout: UDP_TRACKER_TIMEOUT}
+	return
+}
+
+// Announce reports our status to the tracker and returns the peers it gave us.
+// tr holds the same information in the form the HTTP tracker client returns.
+func (c *UDPTrackerClient) Announce(report ClientStatusReport) (peers []net.Addr, tr *TrackerResponse, err error) {
+	if len(report.InfoHash) != 20 || len(report.PeerID) != 20 {
+		err = errors.New("UDP tracker announce needs a 20 byte infohash and peer ID")
 		return
 	}
-	var event uint32 = 0
+	var event uint32
 	switch report.Event {
 	case "":
 		event = 0
@@ -337,97 +500,192 @@ func getAnnouncementFromUDPTracker(con *net.UDPConn, connectionID uint64, report
 		err = fmt.Errorf("Unknown event string %v", report.Event)
 		return
 	}
-	err = binary.Write(announcementRequest, binary.BigEndian, event)
-	if err != nil {
-		return
+
+	request := new(bytes.Buffer)
+	request.WriteString(report.InfoHash)
+	request.WriteString(report.PeerID)
+	binary.Write(request, binary.BigEndian, report.Downloaded)
+	binary.Write(request, binary.BigEndian, report.Left)
+	binary.Write(request, binary.BigEndian, report.Uploaded)
+	binary.Write(request, binary.BigEndian, event)
+	// IP address: 0 means use the sender's.
+	var ip uint32
+	if ip4 := report.ExternalIP.To4(); ip4 != nil {
+		ip = binary.BigEndian.Uint32(ip4)
 	}
-	var ipAddress uint32 = 0
-	err = binary.Write(announcementRequest, binary.BigEndian, ipAddress)
+	binary.Write(request, binary.BigEndian, ip)
+	binary.Write(request, binary.BigEndian, uint32(0)) // Key
+	binary.Write(request, binary.BigEndian, int32(UDP_TRACKER_NUM_WANT))
+	binary.Write(request, binary.BigEndian, report.Port)
+
+	response, err := c.request(udpActionAnnounce, request.Bytes())
 	if err != nil {
 		return
 	}
-	var key uint32 = 0
-	err = binary.Write(announcementRequest, binary.BigEndian, key)
-	if err != nil {
+	// interval, leechers, seeders, then compact peers.
+	if len(response) < 12 {
+		err = fmt.Errorf("Unexpected announce response size %d", len(response))
 		return
 	}
+	interval := binary.BigEndian.Uint32(response[0:4])
+	leechers := binary.BigEndian.Uint32(response[4:8])
+	seeders := binary.BigEndian.Uint32(response[8:12])
+	peerData := response[12:]
 
-	const peerRequestCount = 10
-	var numWant uint32 = peerRequestCount
-	err = binary.Write(announcementRequest, binary.BigEndian, numWant)
-	if err != nil {
-		return
+	// The tracker answers in the address family we asked it over.
+	peerLen := 6
+	if c.addr.IP.To4() == nil {
+		peerLen = 18
 	}
-	err = binary.Write(announcementRequest, binary.BigEndian, report.Port)
-	if err != nil {
-		return
+	peerData = peerData[:len(peerData)-len(peerData)%peerLen]
+	for i := 0; i < len(peerData); i += peerLen {
+		ip, port, _ := ParsePeerContact(string(peerData[i : i+peerLen]))
+		peers = append(peers, &net.TCPAddr{IP: ip, Port: port})
 	}
 
-	_, err = con.Write(announcementRequest.Bytes())
-	if err != nil {
-		return
+	tr = &TrackerResponse{
+		Interval:   uint(interval),
+		Complete:   uint(seeders),
+		Incomplete: uint(leechers),
 	}
-
-	const minimumResponseLen = 20
-	const peerDataSize = 6
-	expectedResponseLen := minimumResponseLen + peerDataSize*peerRequestCount
-	responseBytes := make([]byte, expectedResponseLen)
-
-	var responseLen int
-	responseLen, err = con.Read(responseBytes)
-	if err != nil {
-		return
+	if peerLen == 6 {
+		tr.Peers = string(peerData)
+	} else {
+		tr.Peers6 = string(peerData)
 	}
-	if responseLen < minimumResponseLen {
-		err = fmt.Errorf("Unexpected response size %d", responseLen)
-		return
+	return
+}
+
+// Scrape asks the tracker for swarm statistics. The stats are returned in the
+// same order as infoHashes.
+func (c *UDPTrackerClient) Scrape(infoHashes []string) (stats []ScrapeStats, err error) {
+	request := new(bytes.Buffer)
+	for _, ih := range infoHashes {
+		if len(ih) != 20 {
+			err = fmt.Errorf("Bad infohash length %d", len(ih))
+			return
+		}
+		request.WriteString(ih)
 	}
-	response := bytes.NewBuffer(responseBytes)
-	var responseAction uint32
-	err = binary.Read(response, binary.BigEndian, &responseAction)
+	response, err := c.request(udpActionScrape, request.Bytes())
 	if err != nil {
 		return
 	}
-	if action != 1 {
-		err = fmt.Errorf("Unexpected response action %d", action)
-		return
-	}
-	var responseTransactionID uint32
-	err = binary.Read(response, binary.BigEndian, &responseTransactionID)
-	if err != nil {
+	if len(response) < 12*len(infoHashes) {
+		err = fmt.Errorf("Unexpected scrape response size %d for %d infohashes", len(response), len(infoHashes))
 		return
 	}
-	if transactionID != responseTransactionID {
-		err = fmt.Errorf("Unexpected response transactionID %x", responseTransactionID)
-		return
+	stats = make([]ScrapeStats, len(infoHashes))
+	for i := range stats {
+		entry := response[12*i:]
+		stats[i] = ScrapeStats{
+			Complete:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+			Incomplete: int(binary.BigEndian.Uint32(entry[8:12])),
+		}
 	}
-	var interval uint32
-	err = binary.Read(response, binary.BigEndian, &interval)
+	return
+}
+
+// request sends an announce or scrape, connecting first if we don't have a
+// current connection ID, and returns the response body that follows the
+// action and transaction ID.
+func (c *UDPTrackerClient) request(action uint32, body []byte) (response []byte, err error) {
+	con, err := net.DialUDP("udp", nil, c.addr)
 	if err != nil {
 		return
 	}
-	var leechers uint32
-	err = binary.Read(response, binary.BigEndian, &leechers)
+	defer con.Close()
+
+	connectionID, err := c.connectionID(con)
 	if err != nil {
 		return
 	}
-	var seeders uint32
-	err = binary.Read(response, binary.BigEndian, &seeders)
+	packet := new(bytes.Buffer)
+	binary.Write(packet, binary.BigEndian, connectionID)
+	binary.Write(packet, binary.BigEndian, action)
+	binary.Write(packet, binary.BigEndian, uint32(0)) // Transaction ID, filled in by roundTrip.
+	packet.Write(body)
+	response, err = c.roundTrip(con, action, packet.Bytes())
 	if err != nil {
-		return
+		// The tracker may have expired our connection ID early.
+		c.forgetConnectionID()
+	}
+	return
+}
+
+func (c *UDPTrackerClient) connectionID(con *net.UDPConn) (id uint64, err error) {
+	key := c.addr.String()
+	udpConnectionIDs.Lock()
+	cached, ok := udpConnectionIDs.m[key]
+	udpConnectionIDs.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.id, nil
 	}
 
-	peerCount := (responseLen - minimumResponseLen) / peerDataSize
-	peerDataBytes := make([]byte, peerDataSize*peerCount)
-	err = binary.Read(response, binary.BigEndian, &peerDataBytes)
+	packet := new(bytes.Buffer)
+	binary.Write(packet, binary.BigEndian, uint64(udpProtocolID))
+	binary.Write(packet, binary.BigEndian, uint32(udpActionConnect))
+	binary.Write(packet, binary.BigEndian, uint32(0))
+	response, err := c.roundTrip(con, udpActionConnect, packet.Bytes())
 	if err != nil {
 		return
 	}
+	if len(response) < 8 {
+		err = fmt.Errorf("Unexpected connect response size %d", len(response)+8)
+		return
+	}
+	id = binary.BigEndian.Uint64(response)
 
-	tr = &TrackerResponse{
-		Interval:   uint(interval),
-		Complete:   uint(seeders),
-		Incomplete: uint(leechers),
-		Peers:      string(peerDataBytes)}
+	udpConnectionIDs.Lock()
+	udpConnectionIDs.m[key] = udpConnectionID{id, time.Now().Add(UDP_CONNECTION_ID_LIFETIME)}
+	udpConnectionIDs.Unlock()
+	return
+}
+
+func (c *UDPTrackerClient) forgetConnectionID() {
+	udpConnectionIDs.Lock()
+	delete(udpConnectionIDs.m, c.addr.String())
+	udpConnectionIDs.Unlock()
+}
+
+// roundTrip sends packet, with a fresh transaction ID written into bytes
+// 12..16, until the tracker answers or we run out of tries. Replies for other
+// transactions are ignored.
+func (c *UDPTrackerClient) roundTrip(con *net.UDPConn, action uint32, packet []byte) (response []byte, err error) {
+	buf := make([]byte, 2048)
+	for try := uint(0); try < UDP_TRACKER_TRIES; try++ {
+		transactionID := rand.Uint32()
+		binary.BigEndian.PutUint32(packet[12:16], transactionID)
+		if _, err = con.Write(packet); err != nil {
+			return
+		}
+		deadline := time.Now().Add(c.timeout * (1 << try))
+		if err = con.SetReadDeadline(deadline); err != nil {
+			return
+		}
+		for {
+			var n int
+			n, err = con.Read(buf)
+			if err != nil {
+				break
+			}
+			if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+				continue
+			}
+			responseAction := binary.BigEndian.Uint32(buf[0:4])
+			switch responseAction {
+			case action:
+				return append([]byte(nil), buf[8:n]...), nil
+			case udpActionError:
+				return nil, fmt.Errorf("tracker failure %s", buf[8:n])
+			default:
+				return nil, fmt.Errorf("Unexpected response action %d", responseAction)
+			}
+		}
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			return
+		}
+	}
 	return
 }
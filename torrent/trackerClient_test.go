@@ -0,0 +1,389 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers BEP 15 requests on a local socket.
+type fakeUDPTracker struct {
+	con      *net.UDPConn
+	connects int32
+	// The IP field of the last announce.
+	announcedIP uint32
+	// Number of packets to ignore, to exercise retransmission.
+	drop int
+}
+
+func newFakeUDPTracker(t *testing.T, drop int) *fakeUDPTracker {
+	con, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUDPTracker{con: con, drop: drop}
+	go f.serve()
+	return f
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.con.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if f.drop > 0 {
+			f.drop--
+			continue
+		}
+		connectionID := binary.BigEndian.Uint64(buf[0:8])
+		action := binary.BigEndian.Uint32(buf[8:12])
+		reply := new(bytes.Buffer)
+		binary.Write(reply, binary.BigEndian, action)
+		reply.Write(buf[12:16]) // Transaction ID
+		switch {
+		case action == udpActionConnect:
+			atomic.AddInt32(&f.connects, 1)
+			binary.Write(reply, binary.BigEndian, uint64(1234))
+		case connectionID != 1234:
+			reply.Reset()
+			binary.Write(reply, binary.BigEndian, uint32(udpActionError))
+			reply.Write(buf[12:16])
+			reply.WriteString("bad connection id")
+		case action == udpActionAnnounce:
+			atomic.StoreUint32(&f.announcedIP, binary.BigEndian.Uint32(buf[84:88]))
+			binary.Write(reply, binary.BigEndian, []uint32{1800, 3, 5})
+			reply.Write([]byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2})
+		case action == udpActionScrape:
+			for i := 16; i+20 <= n; i += 20 {
+				seed := uint32(buf[i])
+				binary.Write(reply, binary.BigEndian, []uint32{seed, 7, 2})
+			}
+		}
+		f.con.WriteToUDP(reply.Bytes(), addr)
+	}
+}
+
+func testUDPTrackerClient(t *testing.T, f *fakeUDPTracker) *UDPTrackerClient {
+	c, err := NewUDPTrackerClient(f.con.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.timeout = 50 * time.Millisecond
+	return c
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	f := newFakeUDPTracker(t, 0)
+	defer f.con.Close()
+	c := testUDPTrackerClient(t, f)
+	report := ClientStatusReport{
+		Event:    "started",
+		InfoHash: strings.Repeat("i", 20),
+		PeerID:   strings.Repeat("p", 20),
+		Port:     7777,
+		Left:     100,
+	}
+	peers, tr, err := c.Announce(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []net.Addr{
+		&net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+		&net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 6882},
+	}
+	if !reflect.DeepEqual(peers, want) {
+		t.Errorf("peers = %v, want %v", peers, want)
+	}
+	if tr.Interval != 1800 || tr.Incomplete != 3 || tr.Complete != 5 || len(tr.Peers) != 12 {
+		t.Errorf("TrackerResponse = %+v", tr)
+	}
+
+	// A second announce reuses the cached connection ID.
+	if _, _, err = c.Announce(report); err != nil {
+		t.Fatal(err)
+	}
+	if connects := atomic.LoadInt32(&f.connects); connects != 1 {
+		t.Errorf("connected %d times, want 1", connects)
+	}
+	if ip := atomic.LoadUint32(&f.announcedIP); ip != 0 {
+		t.Errorf("announced IP %x without an external IP", ip)
+	}
+
+	report.ExternalIP = net.IPv4(203, 0, 113, 7)
+	if _, _, err = c.Announce(report); err != nil {
+		t.Fatal(err)
+	}
+	if ip := atomic.LoadUint32(&f.announcedIP); ip != 0xcb007107 {
+		t.Errorf("announced IP %x, want cb007107", ip)
+	}
+}
+
+func TestUDPTrackerRetransmit(t *testing.T) {
+	f := newFakeUDPTracker(t, 2)
+	defer f.con.Close()
+	c := testUDPTrackerClient(t, f)
+	stats, err := c.Scrape([]string{"\x04" + strings.Repeat("a", 19), "\x09" + strings.Repeat("b", 19)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScrapeStats{{Complete: 4, Downloaded: 7, Incomplete: 2}, {Complete: 9, Downloaded: 7, Incomplete: 2}}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestUDPTrackerTimeout(t *testing.T) {
+	f := newFakeUDPTracker(t, UDP_TRACKER_TRIES)
+	defer f.con.Close()
+	c := testUDPTrackerClient(t, f)
+	_, err := c.Scrape([]string{strings.Repeat("a", 20)})
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("Scrape error = %v, want a timeout", err)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	f := newFakeUDPTracker(t, 0)
+	defer f.con.Close()
+	c := testUDPTrackerClient(t, f)
+	udpConnectionIDs.Lock()
+	udpConnectionIDs.m[c.addr.String()] = udpConnectionID{99, time.Now().Add(time.Minute)}
+	udpConnectionIDs.Unlock()
+	_, err := c.Scrape([]string{strings.Repeat("a", 20)})
+	if err == nil || !strings.Contains(err.Error(), "bad connection id") {
+		t.Errorf("Scrape error = %v, want tracker failure", err)
+	}
+	// The stale ID is forgotten, so the next request reconnects.
+	if _, err = c.Scrape([]string{strings.Repeat("a", 20)}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHTTPTracker(t *testing.T) {
+	var requests []*http.Request
+	var fail bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/announce?"+r.URL.RawQuery, http.StatusFound)
+	})
+	mux.HandleFunc("/announce", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if fail {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("d8:intervali1800e12:min intervali900e5:peers6:\x0a\x00\x00\x01\x1a\xe110:tracker id3:abce"))
+		gz.Close()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	announceList := [][]string{{server.URL + "/"}}
+	states := make(map[string]*trackerState)
+	report := ClientStatusReport{InfoHash: strings.Repeat("h", 20), PeerID: strings.Repeat("p", 20), Port: 6881}
+	for i := 0; i < 2; i++ {
+		tr := queryTrackers(nil, announceList, states, report)
+		if tr == nil || tr.Interval != 1800 || tr.MinInterval != 900 || tr.Peers != "\x0a\x00\x00\x01\x1a\xe1" || tr.Tracker != server.URL+"/" {
+			t.Fatalf("announce %d: got %+v", i, tr)
+		}
+	}
+	if len(requests) != 2 {
+		t.Fatalf("tracker saw %d announces, want 2", len(requests))
+	}
+	if ua := requests[0].Header.Get("User-Agent"); ua != "Taipei-Torrent/"+VERSION {
+		t.Errorf("User-Agent %q", ua)
+	}
+	q0, q1 := requests[0].URL.Query(), requests[1].URL.Query()
+	if q0.Get("compact") != "1" || q0.Get("trackerid") != "" || q1.Get("trackerid") != "abc" || q0.Get("ip") != "" {
+		t.Errorf("queries %v then %v", q0, q1)
+	}
+	report.ExternalIP = net.IPv4(203, 0, 113, 7)
+	queryTrackers(nil, announceList, states, report)
+	if len(requests) != 3 || requests[2].URL.Query().Get("ip") != "203.0.113.7" {
+		t.Errorf("announce with an external IP: %v", requests[len(requests)-1].URL)
+	}
+
+	// A tracker that is down isn't asked again until its backoff ends.
+	fail = true
+	if tr := queryTrackers(nil, announceList, states, report); tr != nil {
+		t.Fatalf("got %+v from a failing tracker", tr)
+	}
+	queryTrackers(nil, announceList, states, report)
+	if len(requests) != 4 {
+		t.Errorf("tracker saw %d announces, want 4", len(requests))
+	}
+	state := states[announceList[0][0]]
+	if state.failures != 1 || state.retryAt.Sub(time.Now()) > TRACKER_MIN_BACKOFF {
+		t.Errorf("after one failure: %+v", state)
+	}
+	state.failed(time.Now())
+	state.failed(time.Now())
+	if d := state.retryAt.Sub(time.Now()); d <= 2*TRACKER_MIN_BACKOFF || d > 4*TRACKER_MIN_BACKOFF {
+		t.Errorf("backoff after three failures is %v", d)
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce, scrape string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce.php?passkey=k", "http://example.com/x/scrape.php?passkey=k"},
+		{"http://example.com/announce/x", ""},
+		{"http://example.com/a", ""},
+	}
+	for _, test := range tests {
+		u, err := scrapeURL(test.announce)
+		if test.scrape == "" {
+			if err == nil {
+				t.Errorf("scrapeURL(%q) = %v, want an error", test.announce, u)
+			}
+		} else if err != nil || u.String() != test.scrape {
+			t.Errorf("scrapeURL(%q) = %v, %v, want %q", test.announce, u, err, test.scrape)
+		}
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	var infoHashes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		infoHashes = r.URL.Query()["info_hash"]
+		w.Write([]byte("d5:filesd20:" + strings.Repeat("a", 20) + "d8:completei4e10:downloadedi7e10:incompletei2eeee"))
+	}))
+	defer server.Close()
+
+	c, err := NewHTTPTrackerClient(nil, server.URL+"/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := strings.Repeat("a", 20), strings.Repeat("b", 20)
+	stats, err := c.Scrape([]string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(infoHashes, []string{a, b}) {
+		t.Errorf("tracker was asked about %q", infoHashes)
+	}
+	want := map[string]ScrapeStats{a: {Complete: 4, Downloaded: 7, Incomplete: 2}}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("Scrape = %v, want %v", stats, want)
+	}
+
+	// The first tracker that knows the torrent answers.
+	announceList := [][]string{{"http://example.com/a"}, {server.URL + "/announce"}}
+	if s, err := scrapeTrackers(nil, announceList, a); err != nil || s != want[a] {
+		t.Errorf("scrapeTrackers = %v, %v", s, err)
+	}
+	if _, err := scrapeTrackers(nil, announceList, b); err == nil {
+		t.Error("scraped a torrent the tracker doesn't know")
+	}
+}
+
+func TestAnnounceListTiers(t *testing.T) {
+	var asked []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refuses", func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.URL.Path)
+		w.Write([]byte("d14:failure reason12:unregisterede"))
+	})
+	for _, path := range []string{"/a", "/b"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			asked = append(asked, r.URL.Path)
+			w.Write([]byte("d8:intervali1800ee"))
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	announceList := shuffleAnnounceList([][]string{
+		{server.URL + "/refuses"},
+		{server.URL + "/a", server.URL + "/b"},
+	})
+	states := make(map[string]*trackerState)
+	if tr := queryTrackers(nil, announceList, states, ClientStatusReport{}); tr == nil {
+		t.Fatal("no tracker answered")
+	}
+	if len(asked) != 2 || asked[0] != "/refuses" {
+		t.Fatalf("first announce asked %v", asked)
+	}
+	// The tracker that answered is now first in its tier, and the one that
+	// refused us is backing off.
+	first := asked[1]
+	asked = nil
+	queryTrackers(nil, announceList, states, ClientStatusReport{})
+	if len(asked) != 1 || asked[0] != first {
+		t.Errorf("second announce asked %v, want [%v]", asked, first)
+	}
+	if states[server.URL+"/refuses"].failures != 1 {
+		t.Errorf("refusing tracker state %+v", states[server.URL+"/refuses"])
+	}
+}
+
+func TestIsTrackerUnavailable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&trackerHTTPError{503, "overloaded"}, true},
+		{&trackerHTTPError{404, "no such torrent"}, false},
+		{&url.Error{Op: "Get", URL: "http://example.com/", Err: errors.New("refused")}, true},
+		{errors.New("Bad Request"), false},
+	}
+	for _, test := range tests {
+		if got := isTrackerUnavailable(test.err); got != test.want {
+			t.Errorf("isTrackerUnavailable(%v) = %v", test.err, got)
+		}
+	}
+}
+
+func TestTrackerClientWaitsForNextAnnounce(t *testing.T) {
+	announces := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	infoChan := make(chan *TrackerResponse)
+	reports := make(chan ClientStatusReport)
+	startTrackerClient(nil, server.URL, nil, "", "", time.Now().Add(300*time.Millisecond), infoChan, reports)
+	report := ClientStatusReport{InfoHash: strings.Repeat("h", 20), PeerID: strings.Repeat("p", 20), Port: 6881}
+
+	// A regular announce before then is dropped, but events go out.
+	reports <- report
+	report.Event = "started"
+	reports <- report
+	<-infoChan
+	if event := <-announces; event != "started" {
+		t.Errorf("first announce had event %q", event)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	report.Event = ""
+	reports <- report
+	<-infoChan
+	if event := <-announces; event != "" {
+		t.Errorf("second announce had event %q", event)
+	}
+	if len(announces) != 0 {
+		t.Errorf("%d more announces", len(announces))
+	}
+}
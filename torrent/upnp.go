@@ -268,13 +268,48 @@ func soapRequest(url, function, message, domain string) (r *http.Response, err e
 
 	if r.StatusCode >= 400 {
 		// log.Stderr(function, r.StatusCode)
-		err = errors.New("Error " + strconv.Itoa(r.StatusCode) + " for " + function)
+		var fault soapFault
+		xml.NewDecoder(r.Body).Decode(&fault)
+		r.Body.Close()
+		err = &upnpError{function, r.StatusCode, fault.ErrorCode}
 		r = nil
 		return
 	}
 	return
 }
 
+// UPnP error codes we handle.
+const (
+	UPNP_CONFLICT_IN_MAPPING_ENTRY       = 718
+	UPNP_ONLY_PERMANENT_LEASES_SUPPORTED = 725
+)
+
+// How many external ports AddPortMapping tries when the one it wants is
+// taken by another machine.
+const UPNP_PORT_TRIES = 10
+
+type soapFault struct {
+	ErrorCode int `xml:"Body>Fault>detail>UPnPError>errorCode"`
+}
+
+type upnpError struct {
+	Function   string
+	StatusCode int
+	ErrorCode  int // From the SOAP fault, 0 if there was none.
+}
+
+func (e *upnpError) Error() string {
+	if e.ErrorCode != 0 {
+		return "Error " + strconv.Itoa(e.StatusCode) + " (UPnP error " + strconv.Itoa(e.ErrorCode) + ") for " + e.Function
+	}
+	return "Error " + strconv.Itoa(e.StatusCode) + " for " + e.Function
+}
+
+func isUPnPError(err error, code int) bool {
+	e, ok := err.(*upnpError)
+	return ok && e.ErrorCode == code
+}
+
 type statusInfo struct {
 	externalIpAddress string
 }
@@ -294,15 +329,17 @@ func (n *upnpNAT) getExternalIPAddress() (info statusInfo, err error) {
 	}
 	var envelope Envelope
 	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return
+	}
 	reader := bytes.NewReader(data)
 	xml.NewDecoder(reader).Decode(&envelope)
-
-	info = statusInfo{envelope.Soap.ExternalIP.IPAddress}
-
-	if err != nil {
+	if envelope.Soap == nil || envelope.Soap.ExternalIP == nil {
+		err = errors.New("No external IP address in GetExternalIPAddress response")
 		return
 	}
 
+	info = statusInfo{envelope.Soap.ExternalIP.IPAddress}
 	return
 }
 
@@ -315,7 +352,28 @@ func (n *upnpNAT) GetExternalAddress() (addr net.IP, err error) {
 	return
 }
 
+// AddPortMapping moves on to the next external port if the one asked for
+// is mapped to another machine.
 func (n *upnpNAT) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (mappedExternalPort int, err error) {
+	for i := 0; i < UPNP_PORT_TRIES; i++ {
+		mappedExternalPort = externalPort + i
+		err = n.addPortMapping(protocol, mappedExternalPort, internalPort, description, timeout)
+		if isUPnPError(err, UPNP_ONLY_PERMANENT_LEASES_SUPPORTED) && timeout != 0 {
+			// NATMapper deletes the mapping when we're done with it.
+			timeout = 0
+			err = n.addPortMapping(protocol, mappedExternalPort, internalPort, description, timeout)
+		}
+		if !isUPnPError(err, UPNP_CONFLICT_IN_MAPPING_ENTRY) {
+			break
+		}
+	}
+	if err != nil {
+		mappedExternalPort = 0
+	}
+	return
+}
+
+func (n *upnpNAT) addPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (err error) {
 	// A single concatenation would break ARM compilation.
 	message := "<u:AddPortMapping xmlns:u=\"urn:" + n.urnDomain + ":service:WANIPConnection:1\">\r\n" +
 		"<NewRemoteHost></NewRemoteHost><NewExternalPort>" + strconv.Itoa(externalPort)
@@ -336,9 +394,7 @@ func (n *upnpNAT) AddPortMapping(protocol string, externalPort, internalPort int
 		return
 	}
 
-	// TODO: check response to see if the port was forwarded
 	// log.Println(message, response)
-	mappedExternalPort = externalPort
 	_ = response
 	return
 }
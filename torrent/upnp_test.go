@@ -0,0 +1,38 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+const upnpConflictFault = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>718</errorCode>
+<errorDescription>ConflictInMappingEntry</errorDescription></UPnPError></detail>
+</s:Fault></s:Body></s:Envelope>`
+
+func TestUPnPAddPortMappingConflict(t *testing.T) {
+	externalPort := regexp.MustCompile("<NewExternalPort>([0-9]+)</NewExternalPort>")
+	var asked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		port := externalPort.FindSubmatch(body)[1]
+		asked = append(asked, string(port))
+		if string(port) != "6883" {
+			// Another machine has these.
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(upnpConflictFault))
+		}
+	}))
+	defer server.Close()
+
+	n := &upnpNAT{serviceURL: server.URL, ourIP: "192.168.1.2", urnDomain: "schemas-upnp-org"}
+	mapped, err := n.AddPortMapping("tcp", 6881, 6881, "test", 3600)
+	if err != nil || mapped != 6883 || len(asked) != 3 {
+		t.Errorf("AddPortMapping = %d, %v after asking for %v", mapped, err, asked)
+	}
+}
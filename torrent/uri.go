@@ -2,68 +2,100 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	_ "io"
 	"net/url"
+	"strconv"
 	"strings"
+)
 
-	_ "github.com/nictuku/dht"
+// Errors returned by ParseMagnetURI. The returned error wraps one of these, so
+// callers can tell them apart with errors.Is.
+var (
+	ErrMalformedMagnet   = errors.New("malformed magnet URI")
+	ErrUnsupportedURN    = errors.New("unsupported magnet URN")
+	ErrBadMagnetInfoHash = errors.New("invalid magnet infohash")
 )
 
-type Magnet struct {
-	InfoHashes []string
-	Names      []string
-	Trackers   [][]string
+// MagnetInfo is the content of a bittorrent magnet link.
+type MagnetInfo struct {
+	// The 20 byte binary infohash, the same form as MetaInfo.InfoHash.
+	InfoHash    string
+	DisplayName string
+	Trackers    []string
+	// Total size of the torrent's content in bytes, or 0 if not given.
+	ExactLength int64
 }
 
-func parseMagnet(s string) (Magnet, error) {
-	// References:
-	// - http://bittorrent.org/beps/bep_0009.html
-	// - http://en.wikipedia.org/wiki/Magnet_URI_scheme
-	//
-	// Example bittorrent magnet link:
-	//
-	// => magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu-12.04-desktop-i386.iso
-	//
-	// xt: exact topic.
-	//   ~ urn: uniform resource name.
-	//   ~ btih: bittorrent infohash.
-	// dn: display name (optional).
-	// tr: address tracker (optional).
-	u, err := url.Parse(s)
+// ParseMagnetURI parses a magnet link of the form
+//
+// => magnet:?xt=urn:btih:<infohash>&dn=<name>&tr=<tracker>&xl=<length>
+//
+// xt: exact topic. The infohash is either 40 hex or 32 base32 characters.
+// dn: display name (optional).
+// tr: tracker address (optional, may be repeated).
+// xl: exact length in bytes (optional).
+//
+// References:
+// - http://bittorrent.org/beps/bep_0009.html
+// - http://en.wikipedia.org/wiki/Magnet_URI_scheme
+func ParseMagnetURI(uri string) (*MagnetInfo, error) {
+	u, err := url.Parse(uri)
 	if err != nil {
-		return Magnet{}, err
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMagnet, err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("%w: scheme is %q, not magnet", ErrMalformedMagnet, u.Scheme)
+	}
+	q := u.Query()
+	xts := q["xt"]
+	if len(xts) == 0 {
+		return nil, fmt.Errorf("%w: missing the 'xt' argument", ErrMalformedMagnet)
 	}
-	xts, ok := u.Query()["xt"]
-	if !ok {
-		return Magnet{}, fmt.Errorf("Magnet URI missing the 'xt' argument: " + s)
+	m := &MagnetInfo{
+		DisplayName: q.Get("dn"),
+		Trackers:    q["tr"],
 	}
-	infoHashes := make([]string, 0, len(xts))
+	// A magnet link may name the same content under several URNs. Use the
+	// first bittorrent one.
 	for _, xt := range xts {
-		s := strings.Split(xt, "urn:btih:")
-		if len(s) != 2 {
-			return Magnet{}, fmt.Errorf("Magnet URI xt parameter missing the 'urn:btih:' prefix. Not a bittorrent hash link?")
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
 		}
-		ih := s[1]
-		// TODO: support base32 encoded hashes, if they still exist.
-		if len(ih) != sha1.Size*2 { // hex format.
-			return Magnet{}, fmt.Errorf("Magnet URI contains infohash with unexpected length. Wanted %d, got %d: %v", sha1.Size, len(ih), ih)
+		m.InfoHash, err = decodeMagnetInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		if err != nil {
+			return nil, err
 		}
-		infoHashes = append(infoHashes, s[1])
+		break
 	}
-
-	var names []string
-	n, ok := u.Query()["dn"]
-	if ok {
-		names = n
+	if m.InfoHash == "" {
+		return nil, fmt.Errorf("%w: no urn:btih: in %q. Not a bittorrent link?", ErrUnsupportedURN, xts)
 	}
-
-	var trackers [][]string
-	tr, ok := u.Query()["tr"]
-	if ok {
-		trackers = [][]string{tr}
+	if xl := q.Get("xl"); xl != "" {
+		m.ExactLength, err = strconv.ParseInt(xl, 10, 64)
+		if err != nil || m.ExactLength < 0 {
+			return nil, fmt.Errorf("%w: bad 'xl' length %q", ErrMalformedMagnet, xl)
+		}
 	}
-	fmt.Println("Trackers: ", trackers)
+	return m, nil
+}
 
-	return Magnet{InfoHashes: infoHashes, Names: names, Trackers: trackers}, nil
+func decodeMagnetInfoHash(ih string) (string, error) {
+	var b []byte
+	var err error
+	switch len(ih) {
+	case sha1.Size * 2:
+		b, err = hex.DecodeString(ih)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(ih))
+	default:
+		return "", fmt.Errorf("%w: %q is %d characters long, want 40 (hex) or 32 (base32)",
+			ErrBadMagnetInfoHash, ih, len(ih))
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %q: %v", ErrBadMagnetInfoHash, ih, err)
+	}
+	return string(b), nil
 }
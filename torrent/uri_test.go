@@ -1,27 +1,67 @@
 package torrent
 
 import (
+	"encoding/hex"
+	"errors"
 	"reflect"
 	"testing"
 )
 
 type magnetTest struct {
-	uri        string
-	infoHashes []string
+	uri      string
+	infoHash string // hex
+	name     string
+	trackers []string
+	length   int64
 }
 
 func TestParseMagnet(t *testing.T) {
 	uris := []magnetTest{
-		{uri: "magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu-12.04-desktop-i386.iso&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80&tr=udp%3A%2F%2Ftracker.publicbt.com%3A80&tr=udp%3A%2F%2Ftracker.istole.it%3A6969&tr=udp%3A%2F%2Ftracker.ccc.de%3A80", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"}},
+		{uri: "magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu-12.04-desktop-i386.iso&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80&tr=udp%3A%2F%2Ftracker.publicbt.com%3A80&tr=udp%3A%2F%2Ftracker.istole.it%3A6969&tr=udp%3A%2F%2Ftracker.ccc.de%3A80",
+			infoHash: "bbb6db69965af769f664b6636e7914f8735141b3",
+			name:     "Ubuntu-12.04-desktop-i386.iso",
+			trackers: []string{"udp://tracker.openbittorrent.com:80", "udp://tracker.publicbt.com:80", "udp://tracker.istole.it:6969", "udp://tracker.ccc.de:80"}},
+		// Same infohash, base32 encoded.
+		{uri: "magnet:?xt=urn:btih:XO3NW2MWLL3WT5TEWZRW46IU7BZVCQNT&xl=736776192",
+			infoHash: "bbb6db69965af769f664b6636e7914f8735141b3",
+			length:   736776192},
+		{uri: "magnet:?xt=urn:sha1:YNCKHTQCWBTRNJIV4WNAE52SJUQCZO5C&xt=urn:btih:BBB6DB69965AF769F664B6636E7914F8735141B3",
+			infoHash: "bbb6db69965af769f664b6636e7914f8735141b3"},
 	}
 
 	for _, u := range uris {
-		m, err := parseMagnet(u.uri)
+		m, err := ParseMagnetURI(u.uri)
 		if err != nil {
-			t.Errorf("ParseMagnet failed for uri %v: %v", u.uri, err)
+			t.Errorf("ParseMagnetURI failed for uri %v: %v", u.uri, err)
+			continue
 		}
-		if !reflect.DeepEqual(u.infoHashes, m.InfoHashes) {
-			t.Errorf("ParseMagnet failed, wanted %v, got %v", u.infoHashes, m.InfoHashes)
+		if ih := hex.EncodeToString([]byte(m.InfoHash)); ih != u.infoHash {
+			t.Errorf("ParseMagnetURI(%v) infohash = %v, want %v", u.uri, ih, u.infoHash)
+		}
+		if m.DisplayName != u.name || m.ExactLength != u.length || !reflect.DeepEqual(m.Trackers, u.trackers) {
+			t.Errorf("ParseMagnetURI(%v) = %+v", u.uri, m)
+		}
+	}
+}
+
+func TestParseMagnetErrors(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want error
+	}{
+		{"magnet:?xt=urn:btih:%zz", ErrMalformedMagnet},
+		{"http://example.com/?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3", ErrMalformedMagnet},
+		{"magnet:?dn=foo", ErrMalformedMagnet},
+		{"magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&xl=big", ErrMalformedMagnet},
+		{"magnet:?xt=urn:sha1:YNCKHTQCWBTRNJIV4WNAE52SJUQCZO5C", ErrUnsupportedURN},
+		{"magnet:?xt=urn:btih:bbb6db69", ErrBadMagnetInfoHash},
+		{"magnet:?xt=urn:btih:zzb6db69965af769f664b6636e7914f8735141b3", ErrBadMagnetInfoHash},
+		{"magnet:?xt=urn:btih:XO3NW2MWLL3WT5TES5RW46IU7BZVCQN1", ErrBadMagnetInfoHash},
+	}
+	for _, tt := range tests {
+		_, err := ParseMagnetURI(tt.uri)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("ParseMagnetURI(%v) error = %v, want %v", tt.uri, err, tt.want)
 		}
 	}
 }
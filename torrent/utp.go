@@ -0,0 +1,963 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Micro Transport Protocol, BEP 29: reliable, ordered streams over UDP.
+// Its LEDBAT congestion control backs off as soon as it sees queuing delay
+// build up, so our peer traffic yields to everything else on the link.
+//
+// Every connection shares one UDP socket, a UTPSocket, which is also the
+// net.Listener for the connections peers open to us.
+
+const (
+	// Largest payload we put in a packet. With the header and a selective
+	// ack it still fits in one 1500 byte Ethernet frame.
+	UTP_MAX_PAYLOAD = 1400
+	// LEDBAT's target queuing delay. Above it we send slower.
+	UTP_TARGET_DELAY = 100 * time.Millisecond
+	// Most the congestion window grows by in one round trip, in bytes.
+	UTP_MAX_CWND_INCREASE = 3000
+	// Room for the three packets after a lost one that tell us it was
+	// lost, without waiting for a timeout.
+	UTP_MIN_CWND = 4 * UTP_MAX_PAYLOAD
+	// Most bytes we buffer, waiting for Read or for a missing packet. We
+	// advertise what's left of it, and drop packets beyond it.
+	UTP_RECV_WINDOW = 1 << 20
+	// Packets beyond the next one we expect that we keep when they arrive
+	// out of order. Senders keep no more than this in flight.
+	UTP_MAX_REORDER = 1024
+	UTP_INITIAL_RTO = time.Second
+	UTP_MIN_RTO     = 500 * time.Millisecond
+	UTP_MAX_RTO     = 30 * time.Second
+	// Retransmission timeouts in a row before we give up on a connection.
+	UTP_MAX_TIMEOUTS = 6
+	// How long we wait for a peer to answer our SYN before trying TCP.
+	UTP_CONNECT_TIMEOUT = 3 * time.Second
+	// How often we look for packets to retransmit.
+	UTP_TICK = 50 * time.Millisecond
+	// Incoming connections waiting for Accept.
+	UTP_ACCEPT_BACKLOG = 16
+)
+
+// Packet types
+const (
+	utpTypeData = iota
+	utpTypeFin
+	utpTypeState
+	utpTypeReset
+	utpTypeSyn
+)
+
+// Connection states
+const (
+	utpSynSent = iota
+	utpConnected
+	utpFinSent
+	utpClosed
+)
+
+const (
+	utpVersion   = 1
+	utpHeaderLen = 20
+	utpExtSACK   = 1
+	// Selective acks cover at most this many packets after the next one we
+	// expect.
+	utpMaxSACKBits = 256
+)
+
+var (
+	errUTPClosed  = errors.New("use of closed uTP connection")
+	errUTPReset   = errors.New("uTP connection reset by peer")
+	errUTPTimeout = errors.New("uTP connection timed out")
+)
+
+type utpHeader struct {
+	typ           byte
+	connID        uint16
+	timestamp     uint32 // Sender's clock, in microseconds
+	timestampDiff uint32 // Delay the sender saw on our last packet
+	wndSize       uint32 // Bytes the sender can still buffer
+	seqNr         uint16
+	ackNr         uint16
+	sack          []byte // Selective ack bitmask, nil if none
+}
+
+func (h *utpHeader) marshal(payload []byte) []byte {
+	n := utpHeaderLen + len(payload)
+	if h.sack != nil {
+		n += 2 + len(h.sack)
+	}
+	b := make([]byte, n)
+	b[0] = h.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:], h.seqNr)
+	binary.BigEndian.PutUint16(b[18:], h.ackNr)
+	off := utpHeaderLen
+	if h.sack != nil {
+		b[1] = utpExtSACK
+		// b[off] is 0: no extension follows.
+		b[off+1] = byte(len(h.sack))
+		copy(b[off+2:], h.sack)
+		off += 2 + len(h.sack)
+	}
+	copy(b[off:], payload)
+	return b
+}
+
+func parseUTPPacket(b []byte) (h utpHeader, payload []byte, err error) {
+	if len(b) < utpHeaderLen || b[0]&0xf != utpVersion || b[0]>>4 > utpTypeSyn {
+		err = errors.New("Not a uTP packet")
+		return
+	}
+	h.typ = b[0] >> 4
+	h.connID = binary.BigEndian.Uint16(b[2:])
+	h.timestamp = binary.BigEndian.Uint32(b[4:])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:])
+	h.wndSize = binary.BigEndian.Uint32(b[12:])
+	h.seqNr = binary.BigEndian.Uint16(b[16:])
+	h.ackNr = binary.BigEndian.Uint16(b[18:])
+	off := utpHeaderLen
+	for ext := b[1]; ext != 0; {
+		if len(b) < off+2 || len(b) < off+2+int(b[off+1]) {
+			err = errors.New("Truncated uTP extension")
+			return
+		}
+		next, length := b[off], int(b[off+1])
+		if ext == utpExtSACK {
+			h.sack = b[off+2 : off+2+length]
+		}
+		ext = next
+		off += 2 + length
+	}
+	payload = b[off:]
+	return
+}
+
+// seqLess compares sequence numbers, which wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func utpNow() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+type UTPSocket struct {
+	pc net.PacketConn
+
+	mu     sync.Mutex
+	conns  map[utpConnKey]*utpConn
+	closed bool
+
+	backlog chan *utpConn
+	quit    chan bool
+}
+
+// Connections are told apart by the peer's address and the connection id
+// their packets carry.
+type utpConnKey struct {
+	addr   string
+	recvID uint16
+}
+
+// ListenUTP opens a UDP socket for uTP connections.
+func ListenUTP(laddr *net.UDPAddr) (s *UTPSocket, err error) {
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return
+	}
+	return NewUTPSocket(pc), nil
+}
+
+// NewUTPSocket runs uTP over pc, which it owns from now on.
+func NewUTPSocket(pc net.PacketConn) *UTPSocket {
+	s := &UTPSocket{pc: pc, conns: make(map[utpConnKey]*utpConn),
+		backlog: make(chan *utpConn, UTP_ACCEPT_BACKLOG), quit: make(chan bool)}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Accept waits for a peer to connect to us.
+func (s *UTPSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.quit:
+		return nil, errUTPClosed
+	}
+}
+
+func (s *UTPSocket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close breaks every connection and closes the socket.
+func (s *UTPSocket) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.quit)
+	for _, c := range s.connList() {
+		c.mu.Lock()
+		if c.state != utpClosed {
+			c.sendReset()
+		}
+		c.closeWith(errUTPClosed)
+		c.mu.Unlock()
+	}
+	return s.pc.Close()
+}
+
+// Dial connects to addr, a host:port, giving up after timeout.
+func (s *UTPSocket) Dial(addr string, timeout time.Duration) (conn net.Conn, err error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errUTPClosed
+	}
+	var key utpConnKey
+	for {
+		key = utpConnKey{raddr.String(), uint16(rand.Intn(1 << 16))}
+		if _, used := s.conns[key]; !used {
+			break
+		}
+	}
+	c := newUTPConn(s, raddr, key.recvID, key.recvID+1)
+	c.state = utpSynSent
+	c.seqNr = 1
+	s.conns[key] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queue(utpTypeSyn, nil)
+	deadline := time.Now().Add(timeout)
+	for c.state == utpSynSent {
+		if err = c.wait(deadline); err != nil {
+			c.closeWith(err)
+			return nil, &net.OpError{Op: "dial", Net: "utp", Addr: raddr, Err: err}
+		}
+	}
+	if c.state != utpConnected {
+		return nil, &net.OpError{Op: "dial", Net: "utp", Addr: raddr, Err: c.err}
+	}
+	return c, nil
+}
+
+func (s *UTPSocket) readLoop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.quit:
+			default:
+				log.Println("uTP socket read failed:", err)
+				s.Close()
+			}
+			return
+		}
+		h, payload, err := parseUTPPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		// The buffer is reused for the next packet.
+		payload = append([]byte(nil), payload...)
+		s.dispatch(&h, payload, addr)
+	}
+}
+
+func (s *UTPSocket) dispatch(h *utpHeader, payload []byte, addr net.Addr) {
+	if h.typ == utpTypeSyn {
+		s.accept(h, addr)
+		return
+	}
+	s.mu.Lock()
+	c := s.conns[utpConnKey{addr.String(), h.connID}]
+	if c == nil && h.typ == utpTypeReset {
+		// Resets for connections the peer didn't know carry our send id.
+		for key, other := range s.conns {
+			if key.addr == addr.String() && other.sendID == h.connID {
+				c = other
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	if c != nil {
+		c.handle(h, payload)
+	} else if h.typ != utpTypeReset {
+		s.send(addr, &utpHeader{typ: utpTypeReset, connID: h.connID, timestamp: utpNow(), ackNr: h.seqNr}, nil)
+	}
+}
+
+// accept answers a SYN.
+func (s *UTPSocket) accept(h *utpHeader, addr net.Addr) {
+	key := utpConnKey{addr.String(), h.connID + 1}
+	s.mu.Lock()
+	if c := s.conns[key]; c != nil {
+		s.mu.Unlock()
+		c.handle(h, nil)
+		return
+	}
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	c := newUTPConn(s, addr, h.connID+1, h.connID)
+	c.state = utpConnected
+	c.seqNr = uint16(rand.Intn(1 << 16))
+	c.ackNr = h.seqNr
+	c.peerWnd = int(h.wndSize)
+	// Nobody else has c yet. Holding its lock until the state packet is
+	// out keeps packets from the peer waiting until we're ready for them.
+	c.mu.Lock()
+	s.conns[key] = c
+	s.mu.Unlock()
+	defer c.mu.Unlock()
+	c.replyDiff = utpNow() - h.timestamp
+	c.sendState()
+	select {
+	case s.backlog <- c:
+	default:
+		log.Println("uTP accept backlog full, refusing", addr)
+		c.sendReset()
+		c.closeWith(errUTPClosed)
+	}
+}
+
+func (s *UTPSocket) send(addr net.Addr, h *utpHeader, payload []byte) {
+	// Lost packets are the protocol's problem, so errors are too.
+	s.pc.WriteTo(h.marshal(payload), addr)
+}
+
+func (s *UTPSocket) remove(c *utpConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := utpConnKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *UTPSocket) connList() (conns []*utpConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return
+}
+
+func (s *UTPSocket) tickLoop() {
+	ticker := time.NewTicker(UTP_TICK)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, c := range s.connList() {
+				c.tick(now)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// utpConn is one uTP connection. Locks: a utpConn's mu may be held while
+// taking its socket's, never the other way around.
+type utpConn struct {
+	s      *UTPSocket
+	raddr  net.Addr
+	recvID uint16 // Id on the packets we receive
+	sendID uint16 // Id on the packets we send
+
+	mu sync.Mutex
+	// Closed, and replaced, whenever something a blocked Read, Write or
+	// Dial waits for may have changed.
+	changed    chan bool
+	state      int
+	err        error // Why the connection broke
+	userClosed bool
+
+	seqNr uint16 // Of the next packet we send
+	ackNr uint16 // Of the last packet we received in order
+
+	// Sending
+	outbuf     []*utpPacket // Sent but not acked, by seqNr
+	inflight   int          // Payload bytes in outbuf
+	cwnd       float64      // Congestion window, in bytes
+	peerWnd    int
+	rtt        time.Duration // Zero until the first sample
+	rttVar     time.Duration
+	rto        time.Duration
+	rtoAt      time.Time // When outbuf[0] is due for retransmission
+	timeouts   int       // In a row
+	lastAckNr  uint16
+	dupAcks    int
+	delays     utpDelayHistory
+	replyDiff  uint32 // Delay we saw on the peer's last packet
+	readDL     time.Time
+	writeDL    time.Time
+	finQueued  bool
+	finAcked   bool
+	lossSeqNr  uint16 // Losses of packets before this were already counted
+	lossMarked bool
+
+	// Receiving
+	readBuf      bytes.Buffer
+	reorder      map[uint16][]byte // Arrived ahead of a missing packet
+	reorderBytes int
+	gotFin       bool
+	finSeqNr     uint16
+}
+
+type utpPacket struct {
+	typ     byte
+	seqNr   uint16
+	payload []byte
+	sentAt  time.Time
+	resent  bool // Acks for it don't measure the round trip (Karn)
+	fastRtx bool // Already retransmitted because later packets got through
+}
+
+func newUTPConn(s *UTPSocket, raddr net.Addr, recvID, sendID uint16) *utpConn {
+	return &utpConn{s: s, raddr: raddr, recvID: recvID, sendID: sendID,
+		changed: make(chan bool), cwnd: UTP_MIN_CWND, peerWnd: UTP_RECV_WINDOW,
+		rto: UTP_INITIAL_RTO, reorder: make(map[uint16][]byte)}
+}
+
+func (c *utpConn) broadcast() {
+	close(c.changed)
+	c.changed = make(chan bool)
+}
+
+// wait releases c.mu until something changes or deadline passes.
+func (c *utpConn) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	changed := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// closeWith ends the connection, unless it has ended already.
+func (c *utpConn) closeWith(err error) {
+	if c.state == utpClosed {
+		return
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = utpClosed
+	c.outbuf, c.inflight = nil, 0
+	c.reorder, c.reorderBytes = nil, 0
+	c.s.remove(c)
+	c.broadcast()
+}
+
+func (c *utpConn) recvWindow() int {
+	wnd := UTP_RECV_WINDOW - c.readBuf.Len() - c.reorderBytes
+	if wnd < 0 {
+		wnd = 0
+	}
+	return wnd
+}
+
+func (c *utpConn) header(typ byte, seqNr uint16) *utpHeader {
+	h := &utpHeader{typ: typ, connID: c.sendID, timestamp: utpNow(), timestampDiff: c.replyDiff,
+		wndSize: uint32(c.recvWindow()), seqNr: seqNr, ackNr: c.ackNr}
+	if typ == utpTypeSyn {
+		// The peer learns our ids from the SYN.
+		h.connID = c.recvID
+	}
+	if typ == utpTypeState || typ == utpTypeData {
+		h.sack = c.sackMask()
+	}
+	return h
+}
+
+// sackMask has bit i set if we have packet ackNr+2+i.
+func (c *utpConn) sackMask() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	var mask [utpMaxSACKBits / 8]byte
+	n := 0
+	for seqNr := range c.reorder {
+		if i := int(seqNr - c.ackNr - 2); i < utpMaxSACKBits {
+			mask[i/8] |= 1 << uint(i%8)
+			if i/8 >= n {
+				n = i/8 + 1
+			}
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	// The length must be a multiple of 4.
+	return mask[:(n+3)/4*4]
+}
+
+// queue sends a packet that takes a sequence number, and keeps it until
+// it's acked.
+func (c *utpConn) queue(typ byte, payload []byte) {
+	p := &utpPacket{typ: typ, seqNr: c.seqNr, payload: payload}
+	c.seqNr++
+	if len(c.outbuf) == 0 {
+		c.rtoAt = time.Now().Add(c.rto)
+	}
+	c.outbuf = append(c.outbuf, p)
+	c.inflight += len(payload)
+	c.transmit(p)
+}
+
+func (c *utpConn) transmit(p *utpPacket) {
+	p.sentAt = time.Now()
+	c.s.send(c.raddr, c.header(p.typ, p.seqNr), p.payload)
+}
+
+// sendState acks what we have, without taking a sequence number.
+func (c *utpConn) sendState() {
+	c.s.send(c.raddr, c.header(utpTypeState, c.seqNr), nil)
+}
+
+func (c *utpConn) sendReset() {
+	c.s.send(c.raddr, c.header(utpTypeReset, c.seqNr), nil)
+}
+
+func (c *utpConn) handle(h *utpHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == utpClosed {
+		return
+	}
+	c.replyDiff = utpNow() - h.timestamp
+	switch h.typ {
+	case utpTypeReset:
+		c.closeWith(errUTPReset)
+		return
+	case utpTypeSyn:
+		// Our answer got lost.
+		c.sendState()
+		return
+	}
+	if c.state == utpSynSent {
+		if h.typ != utpTypeState {
+			// The peer resends data we get before its answer to our SYN.
+			return
+		}
+		// The state packet carries the sequence number of the peer's
+		// first data packet.
+		c.ackNr = h.seqNr - 1
+		c.state = utpConnected
+	}
+	c.peerWnd = int(h.wndSize)
+	c.processAck(h)
+	switch h.typ {
+	case utpTypeData:
+		c.receive(h.seqNr, payload)
+		c.sendState()
+	case utpTypeFin:
+		c.gotFin, c.finSeqNr = true, h.seqNr
+		c.receive(h.seqNr, nil)
+		c.sendState()
+	}
+	if c.state == utpFinSent && c.finAcked {
+		c.closeWith(errUTPClosed)
+	}
+	c.broadcast()
+}
+
+// receive drops packets that don't fit in the window we advertise, so a
+// peer can't make us buffer more than that. It will send them again.
+func (c *utpConn) receive(seqNr uint16, payload []byte) {
+	if seqNr != c.ackNr+1 {
+		// Keep it if it's ahead; if it's behind we have it already.
+		if d := seqNr - c.ackNr; d > 1 && d <= UTP_MAX_REORDER {
+			if c.readBuf.Len()+c.reorderBytes+len(payload) > UTP_RECV_WINDOW {
+				return
+			}
+			if _, dup := c.reorder[seqNr]; !dup {
+				c.reorder[seqNr] = payload
+				c.reorderBytes += len(payload)
+			}
+		}
+		return
+	}
+	// Packets held for reordering don't count here: they can only be
+	// delivered after this one.
+	if c.readBuf.Len()+len(payload) > UTP_RECV_WINDOW {
+		return
+	}
+	c.deliver(payload)
+	c.ackNr = seqNr
+	for {
+		payload, ok := c.reorder[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ackNr+1)
+		c.reorderBytes -= len(payload)
+		c.deliver(payload)
+		c.ackNr++
+	}
+}
+
+func (c *utpConn) deliver(payload []byte) {
+	// Nobody will Read it after Close.
+	if !c.userClosed {
+		c.readBuf.Write(payload)
+	}
+}
+
+func (c *utpConn) processAck(h *utpHeader) {
+	now := time.Now()
+	before := len(c.outbuf)
+	acked := 0 // Bytes
+	for len(c.outbuf) > 0 && !seqLess(h.ackNr, c.outbuf[0].seqNr) {
+		acked += c.ackPacket(0, now)
+	}
+	if h.sack != nil {
+		for i := 0; i < len(c.outbuf); {
+			bit := int(c.outbuf[i].seqNr - h.ackNr - 2)
+			if bit < len(h.sack)*8 && h.sack[bit/8]&(1<<uint(bit%8)) != 0 {
+				acked += c.ackPacket(i, now)
+			} else {
+				i++
+			}
+		}
+	}
+
+	if len(c.outbuf) < before {
+		c.timeouts = 0
+		c.dupAcks = 0
+		c.rtoAt = now.Add(c.rto)
+		if h.timestampDiff != 0 {
+			c.delays.add(h.timestampDiff, now)
+		}
+		c.grow(acked)
+	} else if h.typ == utpTypeState && h.ackNr == c.lastAckNr && len(c.outbuf) > 0 {
+		c.dupAcks++
+	}
+	c.lastAckNr = h.ackNr
+
+	// A packet was lost, rather than delayed, once three sent after it
+	// got through, or once the one before it was acked three times over.
+	var received []int // Bits set in the selective ack
+	for bit := 0; bit < len(h.sack)*8; bit++ {
+		if h.sack[bit/8]&(1<<uint(bit%8)) != 0 {
+			received = append(received, bit)
+		}
+	}
+	for i, p := range c.outbuf {
+		bit := int(int16(p.seqNr - h.ackNr - 2))
+		later := len(received) - sort.SearchInts(received, bit+1)
+		if later < 3 && !(i == 0 && c.dupAcks >= 3) {
+			if i > 0 {
+				break
+			}
+			continue
+		}
+		if !p.fastRtx {
+			p.fastRtx, p.resent = true, true
+			c.transmit(p)
+			c.lost(p.seqNr)
+		}
+	}
+}
+
+// ackPacket removes outbuf[i], and returns its payload size.
+func (c *utpConn) ackPacket(i int, now time.Time) (size int) {
+	p := c.outbuf[i]
+	c.outbuf = append(c.outbuf[:i], c.outbuf[i+1:]...)
+	size = len(p.payload)
+	c.inflight -= size
+	if p.typ == utpTypeFin {
+		c.finAcked = true
+	}
+	if !p.resent {
+		c.sampleRTT(now.Sub(p.sentAt))
+	}
+	return
+}
+
+func (c *utpConn) sampleRTT(rtt time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = rtt, rtt/2
+	} else {
+		delta := c.rtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (rtt - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < UTP_MIN_RTO {
+		c.rto = UTP_MIN_RTO
+	} else if c.rto > UTP_MAX_RTO {
+		c.rto = UTP_MAX_RTO
+	}
+}
+
+// grow is LEDBAT: the window grows in proportion to how far our queuing
+// delay is under the target, and shrinks as far as it is over.
+func (c *utpConn) grow(acked int) {
+	if acked == 0 {
+		return
+	}
+	offTarget := float64(UTP_TARGET_DELAY-c.delays.ourDelay()) / float64(UTP_TARGET_DELAY)
+	if offTarget < -1 {
+		offTarget = -1
+	}
+	c.cwnd += UTP_MAX_CWND_INCREASE * offTarget * float64(acked) / c.cwnd
+	if c.cwnd < UTP_MIN_CWND {
+		c.cwnd = UTP_MIN_CWND
+	} else if c.cwnd > UTP_RECV_WINDOW {
+		// No peer of ours buffers more than that anyway.
+		c.cwnd = UTP_RECV_WINDOW
+	}
+}
+
+// lost halves the window, once for everything that was in flight when
+// the packet seqNr was sent.
+func (c *utpConn) lost(seqNr uint16) {
+	if c.lossMarked && seqLess(seqNr, c.lossSeqNr) {
+		return
+	}
+	c.lossMarked, c.lossSeqNr = true, c.seqNr
+	c.cwnd /= 2
+	if c.cwnd < UTP_MIN_CWND {
+		c.cwnd = UTP_MIN_CWND
+	}
+}
+
+func (c *utpConn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == utpClosed || len(c.outbuf) == 0 || now.Before(c.rtoAt) {
+		return
+	}
+	p := c.outbuf[0]
+	// A peer that isn't reading has closed its window. The retransmission
+	// probes it; that goes unacked doesn't mean the peer is gone.
+	if c.peerWnd >= len(p.payload) {
+		c.timeouts++
+	}
+	if c.timeouts > UTP_MAX_TIMEOUTS {
+		c.closeWith(errUTPTimeout)
+		return
+	}
+	c.rto *= 2
+	if c.rto > UTP_MAX_RTO {
+		c.rto = UTP_MAX_RTO
+	}
+	c.cwnd = UTP_MIN_CWND
+	c.lossMarked, c.lossSeqNr = true, c.seqNr
+	p.resent = true
+	c.transmit(p)
+	c.rtoAt = now.Add(c.rto)
+}
+
+// canSend reports whether size more bytes fit in both windows. One packet
+// may always be in flight, so a closed window gets probed.
+func (c *utpConn) canSend(size int) bool {
+	if len(c.outbuf) == 0 {
+		return true
+	}
+	if c.seqNr-c.outbuf[0].seqNr >= UTP_MAX_REORDER {
+		return false
+	}
+	limit := int(c.cwnd)
+	if c.peerWnd < limit {
+		limit = c.peerWnd
+	}
+	return c.inflight+size <= limit
+}
+
+func (c *utpConn) Read(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.readBuf.Len() == 0 {
+		switch {
+		case c.userClosed:
+			return 0, errUTPClosed
+		case c.gotFin && c.ackNr == c.finSeqNr:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		if err = c.wait(c.readDL); err != nil {
+			return
+		}
+	}
+	wasShut := c.recvWindow() < UTP_MAX_PAYLOAD
+	n, _ = c.readBuf.Read(b)
+	if wasShut && c.recvWindow() >= UTP_MAX_PAYLOAD && c.state != utpClosed {
+		// Tell the peer it can send again.
+		c.sendState()
+	}
+	return
+}
+
+// Write returns once b is sent, not once it's acked.
+func (c *utpConn) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(b) > 0 {
+		switch {
+		case c.userClosed:
+			return n, errUTPClosed
+		case c.err != nil:
+			return n, c.err
+		}
+		size := len(b)
+		if size > UTP_MAX_PAYLOAD {
+			size = UTP_MAX_PAYLOAD
+		}
+		if !c.canSend(size) {
+			if err = c.wait(c.writeDL); err != nil {
+				return
+			}
+			continue
+		}
+		payload := make([]byte, size)
+		copy(payload, b)
+		c.queue(utpTypeData, payload)
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// Close sends a FIN after whatever is still unacked, and returns without
+// waiting for it to be acked.
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.userClosed {
+		return nil
+	}
+	c.userClosed = true
+	c.readBuf.Reset()
+	switch c.state {
+	case utpSynSent:
+		c.closeWith(errUTPClosed)
+	case utpConnected:
+		c.queue(utpTypeFin, nil)
+		c.state = utpFinSent
+	}
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL, c.writeDL = t, t
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL = t
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDL = t
+	c.broadcast()
+	return nil
+}
+
+// utpDelayHistory tracks the one way delay of our packets, as the peer
+// measures it. Its clock isn't ours, so only the difference from the
+// lowest delay seen lately means anything: that is the queuing delay.
+// The lowest is kept per minute, for the last two, so a route change
+// doesn't leave us comparing against a delay we can't get any more.
+type utpDelayHistory struct {
+	last, cur, prev uint32
+	haveCur         bool
+	havePrev        bool
+	rotated         time.Time
+}
+
+func (d *utpDelayHistory) add(sample uint32, now time.Time) {
+	if now.Sub(d.rotated) > time.Minute {
+		d.prev, d.havePrev = d.cur, d.haveCur
+		d.haveCur = false
+		d.rotated = now
+	}
+	// The samples wrap around like sequence numbers.
+	if !d.haveCur || int32(sample-d.cur) < 0 {
+		d.cur, d.haveCur = sample, true
+	}
+	d.last = sample
+}
+
+func (d *utpDelayHistory) ourDelay() time.Duration {
+	if !d.haveCur {
+		return 0
+	}
+	base := d.cur
+	if d.havePrev && int32(d.prev-base) < 0 {
+		base = d.prev
+	}
+	delay := int32(d.last - base)
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay) * time.Microsecond
+}
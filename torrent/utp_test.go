@@ -0,0 +1,202 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops a share of the packets it is asked to send.
+type lossyPacketConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	rand *rand.Rand
+	loss float64
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rand.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func newTestUTPSocket(t *testing.T, loss float64) *UTPSocket {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewUTPSocket(&lossyPacketConn{PacketConn: pc, rand: rand.New(rand.NewSource(1)), loss: loss})
+}
+
+func TestUTPHeader(t *testing.T) {
+	h := utpHeader{typ: utpTypeState, connID: 7, timestamp: 1, timestampDiff: 2,
+		wndSize: 3, seqNr: 65535, ackNr: 9, sack: []byte{5, 0, 0, 0}}
+	h2, payload, err := parseUTPPacket(h.marshal([]byte("hi")))
+	if err != nil || string(payload) != "hi" || !bytes.Equal(h2.sack, h.sack) {
+		t.Fatalf("parsed %+v %q %v", h2, payload, err)
+	}
+	h2.sack = h.sack
+	if h2.typ != h.typ || h2.connID != h.connID || h2.seqNr != h.seqNr || h2.ackNr != h.ackNr ||
+		h2.timestamp != h.timestamp || h2.timestampDiff != h.timestampDiff || h2.wndSize != h.wndSize {
+		t.Errorf("round trip of %+v gave %+v", h, h2)
+	}
+	if _, _, err = parseUTPPacket([]byte("d1:ad2:id20:")); err == nil {
+		t.Error("parsed a DHT message as uTP")
+	}
+}
+
+func TestUTPTransfer(t *testing.T) {
+	for _, loss := range []float64{0, 0.05} {
+		server := newTestUTPSocket(t, loss)
+		client := newTestUTPSocket(t, loss)
+
+		data := make([]byte, 256<<10)
+		rand.New(rand.NewSource(2)).Read(data)
+		received := make(chan []byte)
+		go func() {
+			conn, err := server.Accept()
+			if err != nil {
+				received <- nil
+				return
+			}
+			// Answer with the first few bytes, to check traffic both ways.
+			b, _ := ioutil.ReadAll(conn)
+			conn.Write(b[:10])
+			conn.Close()
+			received <- b
+		}()
+
+		conn, err := client.Dial(server.Addr().String(), UTP_CONNECT_TIMEOUT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+		if _, err = conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		conn.(*utpConn).closeWrite(t)
+		if b := <-received; !bytes.Equal(b, data) {
+			t.Errorf("%v loss: server got %d bytes, not what we sent", loss, len(b))
+		}
+		reply, err := ioutil.ReadAll(conn)
+		if err != nil || !bytes.Equal(reply, data[:10]) {
+			t.Errorf("%v loss: reply %x, %v", loss, reply, err)
+		}
+		conn.Close()
+		client.Close()
+		server.Close()
+	}
+}
+
+// closeWrite sends a FIN but keeps reading, like a TCP half close.
+func (c *utpConn) closeWrite(t *testing.T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != utpConnected {
+		t.Fatal("not connected")
+	}
+	c.queue(utpTypeFin, nil)
+}
+
+func TestUTPDeadline(t *testing.T) {
+	server := newTestUTPSocket(t, 0)
+	defer server.Close()
+	client := newTestUTPSocket(t, 0)
+	defer client.Close()
+
+	conn, err := client.Dial(server.Addr().String(), UTP_CONNECT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read past the deadline: %v", err)
+	}
+
+	// Closing the listening side resets the connection.
+	server.Close()
+	conn.SetReadDeadline(time.Time{})
+	conn.Write([]byte("hello"))
+	if _, err = conn.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("Read from a reset connection: %v", err)
+	}
+}
+
+func TestUTPDialTimeout(t *testing.T) {
+	client := newTestUTPSocket(t, 0)
+	defer client.Close()
+	// A UDP socket that never answers.
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err = client.Dial(pc.LocalAddr().String(), 100*time.Millisecond); err == nil {
+		t.Error("connected to a socket that doesn't speak uTP")
+	}
+	if n := len(client.connList()); n != 0 {
+		t.Errorf("%d connections left after a failed dial", n)
+	}
+}
+
+func TestUTPReceiveBuffer(t *testing.T) {
+	// Out of order packets alone can't fill more than the window.
+	c := newUTPConn(nil, nil, 1, 2)
+	payload := make([]byte, UTP_MAX_PAYLOAD)
+	for seqNr := uint16(2); seqNr <= UTP_MAX_REORDER; seqNr++ {
+		c.receive(seqNr, payload)
+	}
+	if c.reorderBytes > UTP_RECV_WINDOW || c.recvWindow() != UTP_RECV_WINDOW-c.reorderBytes {
+		t.Errorf("holding %d bytes out of order", c.reorderBytes)
+	}
+
+	// Nor can a peer whose data we never read.
+	server := newTestUTPSocket(t, 0)
+	defer server.Close()
+	client := newTestUTPSocket(t, 0)
+	defer client.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := server.Accept()
+		accepted <- conn
+	}()
+	conn, err := client.Dial(server.Addr().String(), UTP_CONNECT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	n, err := conn.Write(make([]byte, 2*UTP_RECV_WINDOW))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("wrote %d bytes to a peer that doesn't read: %v", n, err)
+	}
+	sc := (<-accepted).(*utpConn)
+	sc.mu.Lock()
+	buffered := sc.readBuf.Len() + sc.reorderBytes
+	sc.mu.Unlock()
+	if buffered > UTP_RECV_WINDOW {
+		t.Errorf("buffered %d bytes", buffered)
+	}
+	// Reading opens the window again.
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	go io.Copy(ioutil.Discard, sc)
+	if _, err = conn.Write(make([]byte, UTP_RECV_WINDOW)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUTPWithDHTRefused(t *testing.T) {
+	flags := &TorrentFlags{UseUTP: true, UseDHT: true}
+	if err := RunTorrents(flags, nil); err == nil {
+		t.Error("ran with both uTP and DHT")
+	}
+}